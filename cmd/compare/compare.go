@@ -0,0 +1,363 @@
+package compare
+
+import (
+	"flag"
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var usage string = `Usage of compare:
+Given two control tables (A and B) and a fim library folder, or two composite FIMs, compare scenario B against scenario A.
+e.g. today's forecast (B) against yesterday's (A), or 500yr event (B) against 100yr event (A).
+With control tables, only reaches whose flow or control stage differ between A and B are compared.
+Interpolated controls (flow_upper and weight columns) are not supported, compare composite FIMs built by 'fim' instead.
+Library FIMs are converted once to temporary files and read one row at a time, outputs are written one row at a time.
+GDAL VSI paths can be used for library and composite FIMs, given GDAL must have access to cloud creds.
+
+Outputs:
+- Difference raster of B depth minus A depth, dry pixels count as 0 depth. Pixels dry in both are nodata.
+- Optional class raster with classes 1 newly wet, 2 newly dry, 3 deeper, 4 shallower, 5 unchanged and a color table.
+- Optional summary CSV of area of each class per reach_id (control tables only) and for all reaches, in squared CRS units.
+Changed pixels are attributed to the reach that provides B value, or A value if dry in B.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+const diffNoData = -9999
+
+// Classes of the class raster, 0 is nodata
+const (
+	classNone = iota
+	classNewlyWet
+	classNewlyDry
+	classDeeper
+	classShallower
+	classUnchanged
+	classCount
+)
+
+var classNames = []string{"", "newly wet", "newly dry", "deeper", "shallower", "unchanged"}
+
+var classColors = []utils.VRTColorEntry{
+	{C1: 0, C2: 0, C3: 0, C4: 0},
+	{C1: 33, C2: 113, C3: 181, C4: 255},
+	{C1: 230, C2: 85, C3: 13, C4: 255},
+	{C1: 8, C2: 48, C3: 107, C4: 255},
+	{C1: 158, C2: 202, C3: 225, C4: 255},
+	{C1: 189, C2: 189, C3: 189, C4: 255},
+}
+
+func Run(args []string) error {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(usage)
+		flags.PrintDefaults()
+	}
+
+	var controlsA, controlsB, fimA, fimB, fimLibDir, outputFormat, outputFile, classFile, summaryFile string
+	var tolerance float64
+	var concurrent int
+	var creation utils.CreationOptions
+
+	flags.StringVar(&controlsA, "a", "", "Path to the controls CSV file of scenario A, requires -lib")
+	flags.StringVar(&controlsB, "b", "", "Path to the controls CSV file of scenario B, requires -lib")
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&fimA, "fim_a", "", "Path to composite FIM of scenario A, instead of -a and -lib")
+	flags.StringVar(&fimB, "fim_b", "", "Path to composite FIM of scenario B, instead of -b and -lib")
+	flags.StringVar(&outputFormat, "fmt", "COG", "Output format: 'COG' or 'GTIFF'")
+	flags.StringVar(&outputFile, "o", "", "Output difference raster path")
+	flags.StringVar(&classFile, "o_class", "", "Optional output class raster path")
+	flags.StringVar(&summaryFile, "o_summary", "", "Optional output CSV of area of each class per reach_id")
+	flags.Float64Var(&tolerance, "tol", 0, "Depth changes up to this value are classified as unchanged")
+	flags.IntVar(&concurrent, "cc", 25, "Concurrent Count, number of FIMs to read concurrently")
+	creation.RegisterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	outputFormat = strings.ToUpper(outputFormat)
+
+	// Validate required flags
+	controlsMode := controlsA != "" || controlsB != ""
+	if outputFile == "" ||
+		controlsMode && (controlsA == "" || controlsB == "" || fimLibDir == "") ||
+		!controlsMode && (fimA == "" || fimB == "") {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	if controlsMode && (fimA != "" || fimB != "") {
+		return fmt.Errorf("-fim_a and -fim_b can not be used with -a and -b")
+	}
+	if outputFormat != "COG" && outputFormat != "GTIFF" {
+		return fmt.Errorf("invalid output format '%s', must be 'COG' or 'GTIFF'", outputFormat)
+	}
+	if tolerance < 0 {
+		return fmt.Errorf("invalid tolerance %g, must be positive", tolerance)
+	}
+	if err := creation.Validate(); err != nil {
+		return err
+	}
+
+	for _, tool := range append([]string{"gdalinfo"}, creation.RequiredTools(outputFormat)...) {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	// Rasters to read, rasters of A and B as indexes into them and reach of each raster in controls mode
+	var paths []string
+	var idxA, idxB []int
+	var reachIDs []string
+	if controlsMode {
+		absFimLibPath, err := library.AbsPath(fimLibDir)
+		if err != nil {
+			return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+		}
+		entriesA, err := library.ReadControls(controlsA, absFimLibPath)
+		if err != nil {
+			return err
+		}
+		entriesB, err := library.ReadControls(controlsB, absFimLibPath)
+		if err != nil {
+			return err
+		}
+		if err := checkNotInterpolated(controlsA, entriesA); err != nil {
+			return err
+		}
+		if err := checkNotInterpolated(controlsB, entriesB); err != nil {
+			return err
+		}
+
+		changedA, changedB := changedEntries(entriesA, entriesB)
+		slog.Debug("Found changed reaches", "a_count", len(changedA), "b_count", len(changedB))
+		if len(changedA) == 0 && len(changedB) == 0 {
+			return fmt.Errorf("controls files have the same flow and control stage for all reaches, nothing to compare")
+		}
+
+		for _, e := range changedA {
+			idxA = append(idxA, len(paths))
+			paths = append(paths, e.Path)
+			reachIDs = append(reachIDs, e.ReachID)
+		}
+		for _, e := range changedB {
+			idxB = append(idxB, len(paths))
+			paths = append(paths, e.Path)
+			reachIDs = append(reachIDs, e.ReachID)
+		}
+	} else {
+		paths, idxA, idxB = []string{fimA, fimB}, []int{0}, []int{1}
+	}
+
+	info, err := utils.GDALInfo(paths[0])
+	if err != nil {
+		return err
+	}
+	srsWKT := info.CoordinateSystem.WKT
+	mosaic, err := utils.OpenMosaic(paths, concurrent)
+	if err != nil {
+		return err
+	}
+	defer mosaic.Close()
+
+	diffGrid := mosaic.Grid
+	diffGrid.NoData, diffGrid.HasNoData = diffNoData, true
+	diffWriter, err := utils.NewRasterWriter(diffGrid)
+	if err != nil {
+		return err
+	}
+	defer diffWriter.Cleanup()
+	var classWriter *utils.RasterWriter
+	if classFile != "" {
+		if classWriter, err = utils.NewClassRasterWriter(mosaic.Grid, classColors, classNames); err != nil {
+			return err
+		}
+		defer classWriter.Cleanup()
+	}
+
+	pixels, err := compareMosaic(mosaic, idxA, idxB, tolerance, func(diff, classes []float32) error {
+		if err := diffWriter.WriteRow(diff); err != nil {
+			return err
+		}
+		if classWriter != nil {
+			return classWriter.WriteRow(classes)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := diffWriter.Close(srsWKT, outputFile, outputFormat, creation); err != nil {
+		return err
+	}
+	fmt.Printf("Difference raster created at %s\n", outputFile)
+
+	if classWriter != nil {
+		if err := classWriter.Close(srsWKT, classFile, outputFormat, creation); err != nil {
+			return err
+		}
+		fmt.Printf("Class raster created at %s\n", classFile)
+	}
+
+	if summaryFile != "" {
+		if err := writeSummary(pixels, reachIDs, mosaic.Grid.PixelArea(), summaryFile); err != nil {
+			return fmt.Errorf("error writing summary: %v", err)
+		}
+		fmt.Printf("Comparison summary created at %s\n", summaryFile)
+	}
+
+	return nil
+}
+
+// changedEntries returns entries of reaches whose flow or control stage differ between a and b,
+// including reaches that are only in one of them. Order of the controls files is kept.
+func changedEntries(a, b []library.Entry) (changedA, changedB []library.Entry) {
+	key := func(e library.Entry) string { return e.Flow + "|" + e.ControlStage }
+
+	keysA, keysB := map[string]string{}, map[string]string{}
+	for _, e := range a {
+		keysA[e.ReachID] = key(e)
+	}
+	for _, e := range b {
+		keysB[e.ReachID] = key(e)
+	}
+
+	for _, e := range a {
+		if k, ok := keysB[e.ReachID]; !ok || k != keysA[e.ReachID] {
+			changedA = append(changedA, e)
+		}
+	}
+	for _, e := range b {
+		if k, ok := keysA[e.ReachID]; !ok || k != keysB[e.ReachID] {
+			changedB = append(changedB, e)
+		}
+	}
+	return changedA, changedB
+}
+
+// checkNotInterpolated returns an error if entries of a controls file interpolate between two library flows.
+// Compare reads the FIM of the lower flow of each reach, which is not the depth of interpolated controls.
+func checkNotInterpolated(controlsFile string, entries []library.Entry) error {
+	for _, e := range entries {
+		if e.Interpolated() {
+			return fmt.Errorf("controls file %s interpolates reach %s between flows %s and %s, compare does not support interpolated controls, compare composite FIMs built with 'fim' instead",
+				controlsFile, e.ReachID, e.Flow, e.UpperFlow)
+		}
+	}
+	return nil
+}
+
+// compareMosaic compares the composite of rasters idxB against the composite of rasters idxA one row at a time.
+// write is called with each row of the difference and the classes, and the pixel count of each class by index
+// of the raster the pixel is attributed to is returned.
+func compareMosaic(mosaic *utils.Mosaic, idxA, idxB []int, tolerance float64, write func(diff, classes []float32) error) (map[int]*[classCount]int64, error) {
+	grid := mosaic.Grid
+	pixels := map[int]*[classCount]int64{}
+
+	rowA, rowB := make([]float32, grid.Width), make([]float32, grid.Width)
+	srcA, srcB := make([]int, grid.Width), make([]int, grid.Width)
+	diff, classes := make([]float32, grid.Width), make([]float32, grid.Width)
+	for y := 0; y < grid.Height; y++ {
+		for x := range rowA {
+			rowA[x], rowB[x], srcA[x], srcB[x] = 0, 0, -1, -1
+			diff[x], classes[x] = diffNoData, classNone
+		}
+		if err := mosaic.CompositeRow(y, idxA, rowA, srcA); err != nil {
+			return nil, err
+		}
+		if err := mosaic.CompositeRow(y, idxB, rowB, srcB); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < grid.Width; x++ {
+			a, b := math.Max(float64(rowA[x]), 0), math.Max(float64(rowB[x]), 0)
+			if a == 0 && b == 0 {
+				continue
+			}
+
+			d := b - a
+			class := classUnchanged
+			switch {
+			case a == 0:
+				class = classNewlyWet
+			case b == 0:
+				class = classNewlyDry
+			case d > tolerance:
+				class = classDeeper
+			case d < -tolerance:
+				class = classShallower
+			}
+
+			diff[x] = float32(d)
+			classes[x] = float32(class)
+
+			src := srcB[x]
+			if b == 0 {
+				src = srcA[x]
+			}
+			if pixels[src] == nil {
+				pixels[src] = &[classCount]int64{}
+			}
+			pixels[src][class]++
+		}
+		if err := write(diff, classes); err != nil {
+			return nil, err
+		}
+	}
+	return pixels, nil
+}
+
+// writeSummary writes area of each class per reach and for all reaches as the last row with reach_id 'all'.
+// Without reachIDs only the row for all reaches is written.
+func writeSummary(pixels map[int]*[classCount]int64, reachIDs []string, pixelArea float64, filePath string) error {
+	var total [classCount]int64
+	perReach := map[string]*[classCount]int64{}
+	for src, counts := range pixels {
+		for class, n := range counts {
+			total[class] += n
+		}
+		if src < 0 || src >= len(reachIDs) {
+			continue
+		}
+		r := reachIDs[src]
+		if perReach[r] == nil {
+			perReach[r] = &[classCount]int64{}
+		}
+		for class, n := range counts {
+			perReach[r][class] += n
+		}
+	}
+
+	reaches := make([]string, 0, len(perReach))
+	for r := range perReach {
+		reaches = append(reaches, r)
+	}
+	sort.Strings(reaches)
+
+	header := []string{"reach_id"}
+	for _, name := range classNames[1:] {
+		header = append(header, strings.ReplaceAll(name, " ", "_")+"_area")
+	}
+	records := [][]string{header}
+
+	row := func(reachID string, counts [classCount]int64) []string {
+		record := []string{reachID}
+		for _, n := range counts[1:] {
+			record = append(record, strconv.FormatFloat(float64(n)*pixelArea, 'f', -1, 64))
+		}
+		return record
+	}
+	for _, r := range reaches {
+		records = append(records, row(r, *perReach[r]))
+	}
+	records = append(records, row("all", total))
+	return utils.WriteCSV(filePath, records)
+}
@@ -0,0 +1,81 @@
+package compare
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestChangedEntries(t *testing.T) {
+	a := []library.Entry{
+		{ReachID: "1", Flow: "100", ControlStage: "nd"},
+		{ReachID: "2", Flow: "200", ControlStage: "nd"},
+		{ReachID: "3", Flow: "300", ControlStage: "5_0"},
+	}
+	b := []library.Entry{
+		{ReachID: "1", Flow: "100", ControlStage: "nd"},
+		{ReachID: "2", Flow: "250", ControlStage: "nd"},
+		{ReachID: "3", Flow: "300", ControlStage: "6_0"},
+		{ReachID: "4", Flow: "400", ControlStage: "nd"},
+	}
+
+	changedA, changedB := changedEntries(a, b)
+	if want := a[1:]; !reflect.DeepEqual(changedA, want) {
+		t.Errorf("changedEntries() A = %v, want %v", changedA, want)
+	}
+	if want := b[1:]; !reflect.DeepEqual(changedB, want) {
+		t.Errorf("changedEntries() B = %v, want %v", changedB, want)
+	}
+}
+
+func TestCheckNotInterpolated(t *testing.T) {
+	entries := []library.Entry{{ReachID: "1", Flow: "100"}}
+	if err := checkNotInterpolated("a.csv", entries); err != nil {
+		t.Errorf("checkNotInterpolated() error = %v", err)
+	}
+	entries = append(entries, library.Entry{ReachID: "2", Flow: "100", UpperFlow: "200", UpperPath: "f_200.tif", Weight: 0.5})
+	if err := checkNotInterpolated("a.csv", entries); err == nil {
+		t.Error("checkNotInterpolated() with interpolated reach: expected error")
+	}
+}
+
+func TestCompareMosaic(t *testing.T) {
+	const nd = -9999
+	gt := [6]float64{0, 1, 0, 1, 0, -1}
+	a := &utils.Raster{Width: 5, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{nd, 1, 1, 2, nd}}
+	b := &utils.Raster{Width: 5, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{1, nd, 2, 1, nd}}
+
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+
+	var diff, classes []float32
+	collect := func(d, c []float32) error {
+		diff, classes = append(diff, d...), append(classes, c...)
+		return nil
+	}
+	pixels, err := compareMosaic(mosaic, []int{0}, []int{1}, 0, collect)
+	if err != nil {
+		t.Fatalf("compareMosaic() error = %v", err)
+	}
+	if want := []float32{1, -1, 1, -1, nd}; !reflect.DeepEqual(diff, want) {
+		t.Errorf("diff = %v, want %v", diff, want)
+	}
+	if want := []float32{classNewlyWet, classNewlyDry, classDeeper, classShallower, classNone}; !reflect.DeepEqual(classes, want) {
+		t.Errorf("classes = %v, want %v", classes, want)
+	}
+	if got, want := *pixels[0], [classCount]int64{classNewlyDry: 1}; got != want {
+		t.Errorf("pixels attributed to A = %v, want %v", got, want)
+	}
+
+	diff, classes = nil, nil
+	if _, err = compareMosaic(mosaic, []int{0}, []int{1}, 1, collect); err != nil {
+		t.Fatalf("compareMosaic() error = %v", err)
+	}
+	if classes[2] != classUnchanged {
+		t.Errorf("class with tolerance = %v, want %v", classes[2], classUnchanged)
+	}
+}
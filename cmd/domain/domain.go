@@ -1,20 +1,29 @@
 package domain
 
 import (
-	"encoding/csv"
 	"flag"
+	"flows2fim/internal/library"
 	"flows2fim/pkg/utils"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 var usage string = `Usage of domain:
 Given a reach_id list (or a control table) and a fim library folder, create a composite domain map for the given reaches.
-GDAL VSI paths can be used (only for library and not for output), given GDAL must have access to cloud creds.
+Instead of a list, reaches can be selected with -sids and -db, every reach upstream of the outlets (outlets included)
+in the 'network' table as in 'controls', or with -aoi, every reach whose domain has data inside a polygon of a GeoJSON file
+in WGS84. The data pixels of domains are traced to polygons and tested exactly against the AOI.
+With -index, -aoi is matched against the domain footprints of a 'flows2fim library index' file instead, no raster is opened.
+GDAL VSI paths can be used for library and output, given GDAL must have access to cloud creds.
+VSI outputs are written locally and uploaded with gdal_cp once complete, XYZ output can not be written to a VSI path.
+GPKG and GeoJSON outputs have one dissolved polygon per reach with reach_id, pixels and area (squared CRS units) attributes,
+GeoJSON is written in WGS84. The total area covered by the domains is printed, overlaps between reaches are counted once.
+Reaches without a domain.tif are left out of vector outputs and listed in -o_missing.
+XYZ output is a directory of Web Mercator PNG tiles ({z}/{x}/{y}.png), or an MBTiles file if output ends with .mbtiles.
 
 FIM Library Specifications:
 - All maps should have same CRS, Resolution, data type, vertical units (if any), and nodata value
@@ -38,6 +47,7 @@ FIM Library Specifications:
 ├── 2821867
 │   ├── z_nd
 ...
+Missing domain.tif files can be written with 'flows2fim library build-domain'.
 
 Arguments:` // Usage should be always followed by PrintDefaults()
 
@@ -48,13 +58,24 @@ func Run(args []string) (gdalArgs []string, err error) {
 		flags.PrintDefaults()
 	}
 
-	var reachesFile, fimLibDir, outputFormat, outputFile string
+	var reachesFile, dbPath, sids, aoiFile, indexFile, fimLibDir, outputFormat, outputFile, missingReport string
+	var concurrent int
+	var creationOpts utils.CreationOptions
+	var tileOpts utils.TileOptions
 
 	// Define flags using flags.StringVar
 	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
 	flags.StringVar(&reachesFile, "r", "", "Path to the reaches list CSV file (control file can also be used as long as first column is reach_id)")
-	flags.StringVar(&outputFormat, "fmt", "VRT", "Output format: 'VRT', 'COG' or 'GTIFF'") // follows GDAL format names, case insensitive
+	flags.StringVar(&sids, "sids", "", "Comma separated outlet reach IDs, selects them and every reach upstream of them, needs -db")
+	flags.StringVar(&dbPath, "db", "", "Path to the database file with the 'network' table, used with -sids")
+	flags.StringVar(&aoiFile, "aoi", "", "GeoJSON file with Polygon or MultiPolygon features in WGS84, selects every reach whose domain intersects them")
+	flags.StringVar(&indexFile, "index", "", "Optional library index (.gpkg or .fgb) written by 'flows2fim library index', used by -aoi instead of reading every domain")
+	flags.StringVar(&outputFormat, "fmt", "VRT", "Output format: 'VRT', 'COG', 'GTIFF', 'XYZ', or 'GPKG' and 'GeoJSON' for domain polygons per reach") // follows GDAL format names, case insensitive
 	flags.StringVar(&outputFile, "o", "", "Output domain file path")
+	flags.StringVar(&missingReport, "o_missing", "", "Optional output CSV listing requested reach_ids without a domain.tif in the library")
+	flags.IntVar(&concurrent, "cc", 25, "Concurrent Count, number of reach folders to check or domains to read concurrently")
+	creationOpts.RegisterFlags(flags)
+	tileOpts.RegisterFlags(flags)
 
 	// Parse flags from the arguments
 	if err := flags.Parse(args); err != nil {
@@ -64,17 +85,62 @@ func Run(args []string) (gdalArgs []string, err error) {
 	outputFormat = strings.ToUpper(outputFormat) // COG, cog, VRT, vrt all okay
 
 	// Validate required flags
-	if reachesFile == "" || fimLibDir == "" || outputFile == "" {
+	if fimLibDir == "" || outputFile == "" {
 		fmt.Println(reachesFile, fimLibDir, outputFile)
 		fmt.Println("Missing required flags")
 		flags.PrintDefaults()
 		return []string{}, fmt.Errorf("missing required flags")
 	}
 
+	selections := 0
+	for _, s := range []string{reachesFile, sids, aoiFile} {
+		if s != "" {
+			selections++
+		}
+	}
+	if selections != 1 {
+		return []string{}, fmt.Errorf("exactly one of -r, -sids or -aoi is required")
+	}
+	if (sids != "") != (dbPath != "") {
+		return []string{}, fmt.Errorf("-sids and -db must be used together")
+	}
+	if indexFile != "" && aoiFile == "" {
+		return []string{}, fmt.Errorf("-index can only be used with -aoi")
+	}
+
+	if err := creationOpts.Validate(); err != nil {
+		return []string{}, err
+	}
+
+	if outputFormat == "XYZ" {
+		if err := tileOpts.Validate(); err != nil {
+			return []string{}, err
+		}
+		if utils.IsVSI(outputFile) {
+			return []string{}, fmt.Errorf("XYZ output can not be written to a VSI path")
+		}
+	}
+
+	vectorFormat, isVector := vectorFormats[outputFormat]
+
 	// Check if required GDAL tools are available
-	requiredTools := []string{"gdalbuildvrt"}
-	if outputFormat != "VRT" {
-		requiredTools = append(requiredTools, "gdal_translate")
+	requiredTools := append([]string{"gdalbuildvrt"}, creationOpts.RequiredTools(outputFormat)...)
+	if isVector {
+		requiredTools = []string{"gdalinfo", "gdal_translate", utils.GDALPolygonizeName, "ogr2ogr"}
+	}
+	if indexFile != "" {
+		requiredTools = append(requiredTools, "ogr2ogr")
+	} else if aoiFile != "" {
+		requiredTools = append(requiredTools, "gdalinfo", utils.GDALPolygonizeName, "gdaltransform")
+	}
+	if (isVector || missingReport != "" || (aoiFile != "" && indexFile == "")) && strings.HasPrefix(fimLibDir, "/vsi") {
+		requiredTools = append(requiredTools, utils.GDALLSName)
+	}
+	if outputFormat == "XYZ" {
+		requiredTools = append(requiredTools, utils.TileRequiredTools(outputFile)...)
+	}
+	if utils.IsVSI(outputFile) || utils.IsVSI(missingReport) {
+		requiredTools = append(requiredTools, utils.GDALCPName)
 	}
 
 	for _, tool := range requiredTools {
@@ -84,16 +150,7 @@ func Run(args []string) (gdalArgs []string, err error) {
 		}
 	}
 
-	var absOutputPath, absFimLibPath string
-	if strings.HasPrefix(outputFile, "/vsi") {
-		absOutputPath = outputFile
-	} else {
-		absOutputPath, err = filepath.Abs(outputFile)
-		if err != nil {
-			return []string{}, fmt.Errorf("error getting absolute path for output file: %v", err)
-		}
-	}
-
+	var absFimLibPath string
 	if strings.HasPrefix(fimLibDir, "/vsi") {
 		absFimLibPath = fimLibDir
 	} else {
@@ -103,39 +160,91 @@ func Run(args []string) (gdalArgs []string, err error) {
 		}
 	}
 
-	// Processing CSV
-	file, err := os.Open(reachesFile)
-	if err != nil {
-		return []string{}, fmt.Errorf("error opening reaches file: %v", err)
+	var reachIDs []string
+	switch {
+	case sids != "":
+		if reachIDs, err = upstreamReaches(dbPath, sids); err != nil {
+			return []string{}, err
+		}
+		fmt.Printf("Selected %d reaches upstream of %s\n", len(reachIDs), sids)
+	case aoiFile != "":
+		aoi, err := utils.ReadGeoJSON(aoiFile)
+		if err != nil {
+			return []string{}, err
+		}
+		for _, f := range aoi {
+			if f.Geometry.Type == "Point" {
+				return []string{}, fmt.Errorf("AOI feature %s is a Point, only Polygon and MultiPolygon features are supported", f.ID)
+			}
+		}
+		if indexFile != "" {
+			entries, err := library.ReadIndex(indexFile)
+			if err != nil {
+				return []string{}, err
+			}
+			var geometries []utils.Geometry
+			for _, f := range aoi {
+				geometries = append(geometries, f.Geometry)
+			}
+			reachIDs = library.IntersectingReaches(entries, geometries)
+		} else if reachIDs, err = aoiReaches(absFimLibPath, aoi, concurrent); err != nil {
+			return []string{}, err
+		}
+		if len(reachIDs) == 0 {
+			return []string{}, fmt.Errorf("no reach domain intersects the AOI")
+		}
+		fmt.Printf("Selected %d reaches intersecting the AOI\n", len(reachIDs))
+	default:
+		if reachIDs, err = readReachesFile(reachesFile); err != nil {
+			return []string{}, err
+		}
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return []string{}, fmt.Errorf("error reading CSV file: %v", err)
+	// Coverage gaps, reaches without a domain are left out of the outputs
+	if isVector || missingReport != "" {
+		missing := missingDomains(absFimLibPath, reachIDs, concurrent)
+		if len(missing) > 0 {
+			slog.Warn("Some requested reaches have no domain", "missing_count", len(missing), "requested_count", len(reachIDs))
+		}
+		if missingReport != "" {
+			if err := writeMissingDomains(missing, missingReport); err != nil {
+				return []string{}, fmt.Errorf("error writing missing domains report: %v", err)
+			}
+			fmt.Printf("Missing domains report created at %s with %d of %d reaches\n", missingReport, len(missing), len(reachIDs))
+		}
+		var found []string
+		for _, reachID := range reachIDs {
+			if !utils.SliceContains(missing, reachID) {
+				found = append(found, reachID)
+			}
+		}
+		if len(found) == 0 {
+			return []string{}, fmt.Errorf("none of the requested reaches have a domain")
+		}
+		reachIDs = found
 	}
 
-	if len(records) < 2 {
-		return []string{}, fmt.Errorf("no records in reaches file")
+	var domainFiles []string
+	for _, reachID := range reachIDs {
+		domainFiles = append(domainFiles, library.JoinPath(absFimLibPath, reachID, "domain.tif"))
 	}
 
-	if records[0][0] != "reach_id" {
-		return []string{}, fmt.Errorf("first column of reaches file should be reach_id")
+	if isVector {
+		coveredArea, err := writeDomainVectors(reachIDs, domainFiles, outputFile, vectorFormat, concurrent)
+		if err != nil {
+			return []string{}, err
+		}
+		fmt.Printf("Domain polygons created at %s for %d reaches, covered area %s squared CRS units\n", outputFile, len(reachIDs), strconv.FormatFloat(coveredArea, 'f', 2, 64))
+		return gdalArgs, nil
 	}
 
-	var domainFiles []string
-	for _, record := range records[1:] { // Skip header row
-		reachID := record[0]
-
-		absDomainPath := filepath.Join(absFimLibPath, reachID, "domain.tif")
-
-		// join on windows may cause \vsi
-		if strings.HasPrefix(absDomainPath, `\vsi`) {
-			absDomainPath = strings.ReplaceAll(absDomainPath, `\`, "/")
-		}
-		domainFiles = append(domainFiles, absDomainPath)
+	// Outputs to VSI paths are written locally and uploaded once complete
+	stage, err := utils.NewOutputStage(outputFile)
+	if err != nil {
+		return []string{}, err
 	}
+	defer stage.Cleanup()
+	absOutputPath := stage.Path
 
 	// Write file paths to a temporary file
 	inputFileListPath, err := utils.WriteListToTempFile(domainFiles)
@@ -160,31 +269,21 @@ func Run(args []string) (gdalArgs []string, err error) {
 			return []string{}, fmt.Errorf("error renaming temp file %s to %s: %v", tempVRTPath, absOutputPath, err)
 		}
 
-	} else {
-		// For TIF or COG, use gdal_translate to convert the VRT
-		translateArgs := []string{
-			"-co", "COMPRESS=LZW",
-			"-co", "NUM_THREADS=ALL_CPUS",
-			"-of", outputFormat,
-			tempVRTPath,
-			absOutputPath,
+	} else if outputFormat == "XYZ" {
+		if err := utils.RenderTiles(tempVRTPath, absOutputPath, tileOpts, utils.DomainRamp, false); err != nil {
+			return []string{}, err
 		}
 
-		translateCmd := exec.Command("gdal_translate", translateArgs...)
-		translateCmd.Stdout = os.Stdout
-		translateCmd.Stderr = os.Stderr
-
-		slog.Debug(fmt.Sprintf("Converting VRT to %s", outputFormat),
-			"command", fmt.Sprintf("gdal_translate %s", strings.Join(translateArgs, " ")),
-			"format", outputFormat,
-		)
-
-		if err := translateCmd.Run(); err != nil {
-			return []string{}, fmt.Errorf("error converting VRT to %s: %v", outputFormat, err)
+	} else {
+		// For TIF or COG, use gdal_translate to convert the VRT
+		if err := utils.Translate(tempVRTPath, absOutputPath, outputFormat, creationOpts); err != nil {
+			return []string{}, err
 		}
-
 	}
 
+	if absOutputPath, err = stage.Commit(); err != nil {
+		return []string{}, err
+	}
 	fmt.Printf("Composite domain created at %s\n", absOutputPath)
 
 	return gdalArgs, nil
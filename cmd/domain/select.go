@@ -0,0 +1,206 @@
+package domain
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"flows2fim/cmd/controls"
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// readReachesFile returns the first column of a CSV whose first header is reach_id
+func readReachesFile(reachesFile string) ([]string, error) {
+	file, err := os.Open(reachesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening reaches file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV file: %v", err)
+	}
+
+	if len(records) < 2 {
+		return nil, fmt.Errorf("no records in reaches file")
+	}
+
+	if records[0][0] != "reach_id" {
+		return nil, fmt.Errorf("first column of reaches file should be reach_id")
+	}
+
+	var reachIDs []string
+	for _, record := range records[1:] { // Skip header row
+		reachIDs = append(reachIDs, record[0])
+	}
+	return reachIDs, nil
+}
+
+// upstreamReaches returns the outlets and every reach upstream of them in the 'network' table, the same traversal as controls
+func upstreamReaches(dbPath, sidsStr string) ([]string, error) {
+	var queue []int
+	for _, s := range strings.Split(sidsStr, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid reach ID in -sids: %v", err)
+		}
+		queue = append(queue, id)
+	}
+
+	db, err := controls.ConnectDB(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	defer db.Close()
+
+	visited := map[int]bool{}
+	var reachIDs []string
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		reachIDs = append(reachIDs, strconv.Itoa(current))
+
+		upstream, err := controls.FetchUpstreamReaches(db, current)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching upstream reaches for %d: %v", current, err)
+		}
+		queue = append(queue, upstream...)
+	}
+	return reachIDs, nil
+}
+
+// aoiReaches returns the reaches of the library whose domain has data inside any polygon of the AOI, sorted by reach_id.
+// Domains are tested with their WGS84 bounds first, then their traced data polygons are tested against the AOI.
+// Reaches without a readable domain are skipped with a warning.
+func aoiReaches(absFimLibPath string, aoi []utils.Feature, concurrent int) ([]string, error) {
+	libEntries, err := utils.ReadDir(absFimLibPath, false)
+	if err != nil {
+		return nil, fmt.Errorf("error reading fim library directory: %v", err)
+	}
+
+	if concurrent < 1 {
+		concurrent = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var reachIDs []string
+	sem := make(chan struct{}, concurrent)
+	for _, de := range libEntries {
+		if !de.IsDir {
+			continue
+		}
+		reachID := lastElem(de.Path)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(reachID, domainPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ok, err := domainIntersects(domainPath, aoi)
+			if err != nil {
+				slog.Warn("Skipping reach without readable domain", "reach_id", reachID, "error", err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				reachIDs = append(reachIDs, reachID)
+				mu.Unlock()
+			}
+		}(reachID, library.JoinPath(absFimLibPath, reachID, "domain.tif"))
+	}
+	wg.Wait()
+
+	sort.Strings(reachIDs)
+	return reachIDs, nil
+}
+
+// lastElem returns the last element of a local or VSI directory path
+func lastElem(p string) string {
+	p = strings.TrimRight(strings.ReplaceAll(p, `\`, "/"), "/")
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+// domainIntersects reports whether a domain raster has data inside any polygon of the AOI.
+// The data pixels of the domain are traced to polygons and tested exactly against the AOI in WGS84,
+// domains whose bounds miss the AOI are not traced.
+func domainIntersects(domainPath string, aoi []utils.Feature) (bool, error) {
+	info, err := utils.GDALInfo(domainPath)
+	if err != nil {
+		return false, err
+	}
+	bounds, err := info.WGS84Bounds()
+	if err != nil {
+		return false, err
+	}
+	var candidates []utils.Feature
+	for _, f := range aoi {
+		if f.Geometry.Type == "Point" {
+			continue
+		}
+		b := f.Geometry.Bounds()
+		if b[0] <= bounds[2] && bounds[0] <= b[2] && b[1] <= bounds[3] && bounds[1] <= b[3] {
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) == 0 {
+		return false, nil
+	}
+
+	polygons, err := utils.Polygonize(domainPath)
+	if err != nil {
+		return false, fmt.Errorf("error tracing domain: %v", err)
+	}
+	if len(polygons) == 0 {
+		return false, nil
+	}
+	domain, err := polygonsGeometry(polygons, func(coords [][2]float64) ([][2]float64, error) {
+		return utils.TransformToWGS84(coords, info.CoordinateSystem.WKT)
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, f := range candidates {
+		if f.Geometry.Intersects(domain) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// polygonsGeometry returns polygons as one MultiPolygon geometry with the coordinates of every ring transformed at once.
+// Rings of all polygons are kept together, holes are handled by the even-odd rule of Geometry.Contains.
+func polygonsGeometry(polygons [][][][2]float64, transform func([][2]float64) ([][2]float64, error)) (utils.Geometry, error) {
+	var coords [][2]float64
+	for _, polygon := range polygons {
+		for _, ring := range polygon {
+			coords = append(coords, ring...)
+		}
+	}
+	transformed, err := transform(coords)
+	if err != nil {
+		return utils.Geometry{}, err
+	}
+	if len(transformed) != len(coords) {
+		return utils.Geometry{}, fmt.Errorf("transformed %d of %d coordinates", len(transformed), len(coords))
+	}
+
+	g := utils.Geometry{Type: "MultiPolygon"}
+	for _, polygon := range polygons {
+		for _, ring := range polygon {
+			g.Rings = append(g.Rings, transformed[:len(ring):len(ring)])
+			transformed = transformed[len(ring):]
+		}
+	}
+	return g, nil
+}
@@ -0,0 +1,87 @@
+package domain
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestUpstreamReaches(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "network.gpkg")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 <- 2 <- 4, 1 <- 3, 5 is on another network
+	for _, q := range []string{
+		"CREATE TABLE network (reach_id INTEGER, updated_to_id INTEGER)",
+		"INSERT INTO network VALUES (2, 1), (3, 1), (4, 2), (5, 6)",
+	} {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	got, err := upstreamReaches(dbPath, "1, 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "4", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstreamReaches() = %v, want %v", got, want)
+	}
+
+	if _, err := upstreamReaches(dbPath, "1,a"); err == nil {
+		t.Error("upstreamReaches() with invalid ID: expected error")
+	}
+}
+
+func TestPolygonsGeometry(t *testing.T) {
+	// A square domain with a square hole, and a shifted copy of it
+	shift := func(cs [][2]float64) ([][2]float64, error) {
+		out := make([][2]float64, len(cs))
+		for i, c := range cs {
+			out[i] = [2]float64{c[0] + 10, c[1]}
+		}
+		return out, nil
+	}
+	polygons := [][][][2]float64{{
+		{{0, 0}, {6, 0}, {6, 6}, {0, 6}, {0, 0}},
+		{{2, 2}, {4, 2}, {4, 4}, {2, 4}, {2, 2}},
+	}}
+	domain, err := polygonsGeometry(polygons, shift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domain.Rings) != 2 || domain.Rings[1][0] != [2]float64{12, 2} {
+		t.Fatalf("polygonsGeometry() = %v, want two shifted rings", domain.Rings)
+	}
+
+	aoi := func(x0, y0, x1, y1 float64) utils.Geometry {
+		return utils.Geometry{Type: "Polygon", Rings: [][][2]float64{{{x0, y0}, {x1, y0}, {x1, y1}, {x0, y1}, {x0, y0}}}}
+	}
+	for _, tt := range []struct {
+		name string
+		aoi  utils.Geometry
+		want bool
+	}{
+		{"inside hole", aoi(12.5, 2.5, 13.5, 3.5), false},
+		{"across hole edge", aoi(13.5, 3.5, 14.5, 4.5), true},
+		{"inside data", aoi(10.5, 0.5, 11.5, 1.5), true},
+		{"outside", aoi(0, 0, 6, 6), false},
+	} {
+		if got := tt.aoi.Intersects(domain); got != tt.want {
+			t.Errorf("%s: Intersects() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	short := func(cs [][2]float64) ([][2]float64, error) { return cs[1:], nil }
+	if _, err := polygonsGeometry(polygons, short); err == nil {
+		t.Error("polygonsGeometry() with missing coordinates: expected error")
+	}
+}
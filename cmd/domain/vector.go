@@ -0,0 +1,232 @@
+package domain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// vectorFormats are output formats written as domain polygons instead of a raster mosaic
+var vectorFormats = map[string]string{"GPKG": "GPKG", "GEOJSON": "GeoJSON"}
+
+// vectorLayerName is the name of the polygon layer in vector outputs
+const vectorLayerName = "domains"
+
+// reachDomain is the dissolved domain of a reach
+type reachDomain struct {
+	reachID  string
+	pixels   int64
+	area     float64          // squared CRS units
+	polygons [][][][2]float64 // rings in the library coordinate system
+}
+
+// missingDomains returns the reach_ids without a domain.tif in the library, with at most concurrent checks at a time.
+// VSI libraries are listed with gdal_ls one reach folder at a time.
+func missingDomains(absFimLibPath string, reachIDs []string, concurrent int) []string {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+	missing := make([]bool, len(reachIDs))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i, reachID := range reachIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, reachID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			domainPath := library.JoinPath(absFimLibPath, reachID, "domain.tif")
+			if !strings.HasPrefix(absFimLibPath, "/vsi") {
+				_, err := os.Stat(domainPath)
+				missing[i] = err != nil
+				return
+			}
+			entries, err := utils.ReadDir(library.JoinPath(absFimLibPath, reachID), false)
+			missing[i] = true
+			if err != nil {
+				return
+			}
+			for _, e := range entries {
+				if strings.TrimSuffix(e.Path, "/") == domainPath {
+					missing[i] = false
+				}
+			}
+		}(i, reachID)
+	}
+	wg.Wait()
+
+	var ids []string
+	for i, m := range missing {
+		if m {
+			ids = append(ids, reachIDs[i])
+		}
+	}
+	return ids
+}
+
+// writeMissingDomains writes the reach_ids without a domain to a CSV, VSI destinations are uploaded once complete
+func writeMissingDomains(reachIDs []string, dstPath string) error {
+	data := "reach_id\n" + strings.Join(reachIDs, "\n")
+	if len(reachIDs) > 0 {
+		data += "\n"
+	}
+	return utils.WriteStaged(dstPath, func(local string) error {
+		return os.WriteFile(local, []byte(data), 0644)
+	})
+}
+
+// writeDomainVectors writes one dissolved MultiPolygon per reach with reach_id, pixels and area attributes to dstPath.
+// GeoJSON is written in WGS84 (RFC 7946), GPKG keeps the library coordinate system.
+// It returns the area covered by the union of all domains in squared CRS units, overlaps between reaches are counted once.
+func writeDomainVectors(reachIDs, domainFiles []string, dstPath, format string, concurrent int) (coveredArea float64, err error) {
+	// Domains are read from disk one row at a time, each one is masked and traced on its own
+	mosaic, err := utils.OpenMosaic(domainFiles, concurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer mosaic.Close()
+	info, err := utils.GDALInfo(domainFiles[0])
+	if err != nil {
+		return 0, err
+	}
+
+	tempDir, err := os.MkdirTemp("", "f2f_domain_vector_*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	domains := make([]reachDomain, len(mosaic.Rasters))
+	for i, r := range mosaic.Rasters {
+		maskPath := filepath.Join(tempDir, fmt.Sprintf("mask_%d.tif", i))
+		pixels, err := writeDomainMask(r, info.CoordinateSystem.WKT, maskPath)
+		if err != nil {
+			return 0, fmt.Errorf("error masking domain of reach %s: %v", reachIDs[i], err)
+		}
+		polygons, err := utils.Polygonize(maskPath)
+		os.Remove(maskPath)
+		if err != nil {
+			return 0, fmt.Errorf("error tracing domain of reach %s: %v", reachIDs[i], err)
+		}
+		domains[i] = reachDomain{reachID: reachIDs[i], pixels: pixels, area: float64(pixels) * r.Header().PixelArea(), polygons: polygons}
+	}
+
+	covered, err := coveredPixels(mosaic)
+	if err != nil {
+		return 0, err
+	}
+	coveredArea = float64(covered) * mosaic.Grid.PixelArea()
+
+	featuresPath := filepath.Join(tempDir, "domains.geojson")
+	if err := writeDomainFeatures(domains, featuresPath); err != nil {
+		return 0, err
+	}
+
+	if err := utils.WriteStaged(dstPath, func(local string) error {
+		return utils.TranslateVector(featuresPath, local, format, info.CoordinateSystem.WKT, vectorLayerName)
+	}); err != nil {
+		return 0, err
+	}
+	return coveredArea, nil
+}
+
+// writeDomainMask writes a Byte mask of a domain raster to maskPath one row at a time and returns the number of pixels with data
+func writeDomainMask(r utils.RasterRows, srsWKT, maskPath string) (int64, error) {
+	h := r.Header()
+	maskHeader := h
+	maskHeader.NoData, maskHeader.HasNoData = 0, true
+	w, err := utils.NewRasterWriter(maskHeader)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Cleanup()
+
+	mask := make([]float32, h.Width)
+	var pixels int64
+	for y := 0; y < h.Height; y++ {
+		row, err := r.Row(y)
+		if err != nil {
+			return 0, err
+		}
+		pixels += maskRow(h, row, mask)
+		if err := w.WriteRow(mask); err != nil {
+			return 0, err
+		}
+	}
+	return pixels, w.Close(srsWKT, maskPath, "GTIFF", utils.CreationOptions{Compress: "LZW", DataType: "Byte"})
+}
+
+// maskRow sets dst to 1 where a domain row has data and 0 (nodata) elsewhere, and returns the number of pixels with data
+func maskRow(h utils.RasterHeader, row, dst []float32) (pixels int64) {
+	for x, v := range row {
+		dst[x] = 0
+		if !h.IsNoData(v) {
+			dst[x] = 1
+			pixels++
+		}
+	}
+	return pixels
+}
+
+// coveredPixels counts pixels of the mosaic grid where any raster has data
+func coveredPixels(mosaic *utils.Mosaic) (int64, error) {
+	grid := mosaic.Grid
+	idxs := make([]int, len(mosaic.Rasters))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	row, src := make([]float32, grid.Width), make([]int, grid.Width)
+	var count int64
+	for y := 0; y < grid.Height; y++ {
+		for x := range src {
+			src[x] = -1
+		}
+		if err := mosaic.CompositeRow(y, idxs, row, src); err != nil {
+			return 0, err
+		}
+		for _, s := range src {
+			if s != -1 {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// writeDomainFeatures writes domains as a GeoJSON FeatureCollection of MultiPolygons in the library coordinate system
+func writeDomainFeatures(domains []reachDomain, dstPath string) error {
+	type feature struct {
+		Type       string                 `json:"type"`
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string           `json:"type"`
+			Coordinates [][][][2]float64 `json:"coordinates"`
+		} `json:"geometry"`
+	}
+	fc := struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{Type: "FeatureCollection", Features: []feature{}}
+
+	for _, d := range domains {
+		if len(d.polygons) == 0 {
+			continue
+		}
+		f := feature{Type: "Feature", Properties: map[string]interface{}{"reach_id": d.reachID, "pixels": d.pixels, "area": d.area}}
+		f.Geometry.Type = "MultiPolygon"
+		f.Geometry.Coordinates = d.polygons
+		fc.Features = append(fc.Features, f)
+	}
+
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return fmt.Errorf("error encoding domain polygons: %v", err)
+	}
+	return os.WriteFile(dstPath, data, 0644)
+}
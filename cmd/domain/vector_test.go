@@ -0,0 +1,47 @@
+package domain
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestMissingDomains(t *testing.T) {
+	libDir := t.TempDir()
+	for _, f := range []string{"100/domain.tif", "200/z_nd/f_50.tif"} {
+		p := filepath.Join(libDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := missingDomains(libDir, []string{"100", "200", "300"}, 2), []string{"200", "300"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missingDomains() = %v, want %v", got, want)
+	}
+}
+
+func TestDomainCoverage(t *testing.T) {
+	const nd = -9999
+	a := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{0, 2, 0, 0, 0, -2}, NoData: nd, HasNoData: true, Data: []float32{0, 0}}
+	b := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{2, 2, 0, 0, 0, -2}, NoData: nd, HasNoData: true, Data: []float32{0, nd}}
+
+	mask := []float32{nd, nd}
+	if pixels := maskRow(b.Header(), b.Data, mask); pixels != 1 || !reflect.DeepEqual(mask, []float32{1, 0}) {
+		t.Errorf("maskRow() = %v, %d, want [1 0], 1", mask, pixels)
+	}
+
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	// The second pixel of a overlaps the first pixel of b and is counted once
+	if got, err := coveredPixels(mosaic); err != nil || got != 2 {
+		t.Errorf("coveredPixels() = %d, %v, want 2", got, err)
+	}
+}
@@ -0,0 +1,119 @@
+package fim
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// attributionBands are descriptions of the bands of attribution rasters
+var attributionBands = []string{"reach_id", "fim_index"}
+
+// attributionLookupPath returns the path of the lookup CSV of an attribution raster
+func attributionLookupPath(attributionPath string) string {
+	return strings.TrimSuffix(attributionPath, filepath.Ext(attributionPath)) + "_lookup.csv"
+}
+
+// writeAttribution writes an Int32 raster with the reach_id (band 1) and the 1 based index of the FIM (band 2)
+// that provides each pixel of the composite c of entries, and a lookup CSV from FIM index to reach, flow, control stage and FIM path.
+// Pixels without FIM data, and pixels removed or filled by cleanup, are 0 (nodata). domainFiles are only used so the grid
+// matches composites with domain. There is no depth band: bands of a GeoTIFF share one data type and nodata value,
+// and the composite has the depth of each pixel on the same grid.
+func writeAttribution(c compositeRows, entries []library.Entry, domainFiles []string, srsWKT, dstPath string, opts options) error {
+	headers := []utils.RasterHeader{c.Header()}
+	for _, d := range domainFiles {
+		info, err := utils.GDALInfo(d)
+		if err != nil {
+			return err
+		}
+		headers = append(headers, info.Header())
+	}
+	grid, offsets, err := utils.MosaicGrid(headers)
+	if err != nil {
+		return err
+	}
+
+	w, err := utils.NewInt32RasterWriter(grid, attributionBands)
+	if err != nil {
+		return err
+	}
+	defer w.Cleanup()
+	if err := attributeRows(c, entries, grid, offsets[0], w.WriteInt32Row); err != nil {
+		return err
+	}
+
+	format := "COG"
+	if opts.outputFormat == "GTIFF" {
+		format = "GTIFF"
+	}
+	creation := opts.creation
+	creation.DataType, creation.Scale, creation.NoData = "", 0, ""
+	if err := w.Close(srsWKT, dstPath, format, creation); err != nil {
+		return err
+	}
+
+	lookupPath := attributionLookupPath(dstPath)
+	if err := writeAttributionLookup(entries, lookupPath); err != nil {
+		return fmt.Errorf("error writing attribution lookup: %v", err)
+	}
+	fmt.Printf("Attribution raster created at %s with lookup %s\n", dstPath, lookupPath)
+	return nil
+}
+
+// attributeRows calls write with each row of reach_id and 1 based FIM index of the entry providing each pixel of the composite c,
+// whose rasters are entries, on grid where the composite is at offset. reach_ids that are not 32 bit integers are written as 0,
+// their pixels are still attributed by FIM index.
+func attributeRows(c compositeRows, entries []library.Entry, grid utils.RasterHeader, offset [2]int, write func(bands ...[]int32) error) error {
+	entryReach := make([]int32, len(entries))
+	for i, e := range entries {
+		id, err := strconv.ParseInt(strings.TrimSpace(e.ReachID), 10, 32)
+		if err != nil {
+			slog.Warn("reach_id is not a 32 bit integer, written as 0 in attribution raster", "reach_id", e.ReachID)
+			id = 0
+		}
+		entryReach[i] = int32(id)
+	}
+
+	h := c.Header()
+	row, src := make([]float32, h.Width), make([]int, h.Width)
+	reachIDs, fimIndexes := make([]int32, grid.Width), make([]int32, grid.Width)
+	for y := 0; y < grid.Height; y++ {
+		for x := range reachIDs {
+			reachIDs[x], fimIndexes[x] = 0, 0
+		}
+		if cy := y - offset[1]; cy >= 0 && cy < h.Height {
+			if err := c.read(cy, row, src); err != nil {
+				return err
+			}
+			for x, s := range src {
+				if s == -1 {
+					continue
+				}
+				reachIDs[offset[0]+x] = entryReach[s]
+				fimIndexes[offset[0]+x] = int32(s + 1)
+			}
+		}
+		if err := write(reachIDs, fimIndexes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAttributionLookup writes the lookup CSV of FIM index to entry, VSI destinations are uploaded once complete
+func writeAttributionLookup(entries []library.Entry, dstPath string) error {
+	records := [][]string{{"fim_index", "reach_id", "flow", "control_stage", "flow_upper", "weight", "path"}}
+	for i, e := range entries {
+		weight := ""
+		if e.Interpolated() {
+			weight = strconv.FormatFloat(e.Weight, 'f', -1, 64)
+		}
+		records = append(records, []string{strconv.Itoa(i + 1), e.ReachID, e.Flow, e.ControlStage, e.UpperFlow, weight, e.Path})
+	}
+	return utils.WriteCSV(dstPath, records)
+}
@@ -0,0 +1,57 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// attribute returns the bands written by attributeRows
+func attribute(t *testing.T, c compositeRows, entries []library.Entry, grid utils.RasterHeader, offset [2]int) (reachIDs, fimIndexes []int32) {
+	t.Helper()
+	err := attributeRows(c, entries, grid, offset, func(bands ...[]int32) error {
+		reachIDs, fimIndexes = append(reachIDs, bands[0]...), append(fimIndexes, bands[1]...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("attributeRows() error = %v", err)
+	}
+	return reachIDs, fimIndexes
+}
+
+func TestAttributeRows(t *testing.T) {
+	const nd = -9999
+	gt := [6]float64{0, 1, 0, 1, 0, -1}
+	a := &utils.Raster{Width: 3, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{1, 1, nd}}
+	b := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{1, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{2, 2}}
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	// A domain extends the grid one pixel to the right of the FIMs
+	grid := utils.RasterHeader{Width: 4, Height: 1, GeoTransform: gt}
+	entries := []library.Entry{{ReachID: "2821866"}, {ReachID: "not_a_number"}}
+
+	reachIDs, fimIndexes := attribute(t, newComposite(mosaic, false), entries, grid, [2]int{0, 0})
+	if want := []int32{2821866, 0, 0, 0}; !reflect.DeepEqual(reachIDs, want) {
+		t.Errorf("reach_ids = %v, want %v", reachIDs, want)
+	}
+	if want := []int32{1, 2, 2, 0}; !reflect.DeepEqual(fimIndexes, want) {
+		t.Errorf("fim indexes = %v, want %v", fimIndexes, want)
+	}
+
+	if _, fimIndexes = attribute(t, newComposite(mosaic, true), entries, grid, [2]int{1, 0}); !reflect.DeepEqual(fimIndexes, []int32{0, 1, 2, 2}) {
+		t.Errorf("fim indexes with deeper at offset 1 = %v, want [0 1 2 2]", fimIndexes)
+	}
+
+	// Pixels removed by cleanup are not attributed
+	cleaned, err := cleanComposite(newComposite(mosaic, false), cleanupOptions{minDepth: 1.5})
+	if err != nil {
+		t.Fatalf("cleanComposite() error = %v", err)
+	}
+	if _, fimIndexes = attribute(t, cleaned, entries, grid, [2]int{0, 0}); !reflect.DeepEqual(fimIndexes, []int32{0, 2, 2, 0}) {
+		t.Errorf("fim indexes after cleanup = %v, want [0 2 2 0]", fimIndexes)
+	}
+}
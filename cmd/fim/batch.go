@@ -0,0 +1,232 @@
+package fim
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// batchJob is a single (controls, output) pair of a batch run
+type batchJob struct {
+	Controls string `json:"controls"`
+	Output   string `json:"output"`
+}
+
+// batchResult is the outcome of a batch job, it is a row of the batch summary
+type batchResult struct {
+	job          batchJob
+	err          error
+	missingCount int
+	duration     time.Duration
+}
+
+// readManifest returns batch jobs from a CSV or JSON manifest, or from a directory or glob of controls files.
+// Relative paths in manifests are resolved against the manifest folder.
+// For directories and globs, outputs are written to outputDir with the controls file name and format extension (no extension for XYZ tile directories).
+func readManifest(manifest, outputDir, outputFormat string) ([]batchJob, error) {
+	var jobs []batchJob
+	var err error
+
+	info, statErr := os.Stat(manifest)
+	switch {
+	case statErr == nil && info.IsDir():
+		jobs, err = globJobs(filepath.Join(manifest, "*.csv"), outputDir, outputFormat)
+	case statErr != nil && strings.ContainsAny(manifest, "*?["):
+		jobs, err = globJobs(manifest, outputDir, outputFormat)
+	case strings.EqualFold(filepath.Ext(manifest), ".json"):
+		jobs, err = readJSONManifest(manifest)
+	default:
+		jobs, err = readCSVManifest(manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs found in batch manifest %s", manifest)
+	}
+
+	slog.Debug("Loaded batch manifest", "manifest", manifest, "jobs_count", len(jobs))
+	return jobs, nil
+}
+
+func globJobs(pattern, outputDir, outputFormat string) ([]batchJob, error) {
+	if outputDir == "" {
+		return nil, fmt.Errorf("-o output directory is required when batch is a directory or glob")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid batch glob %s: %v", pattern, err)
+	}
+
+	ext := ".tif"
+	switch outputFormat {
+	case "VRT":
+		ext = ".vrt"
+	case "XYZ":
+		ext = "" // tile directory
+	}
+
+	var jobs []batchJob
+	for _, m := range matches {
+		name := strings.TrimSuffix(filepath.Base(m), filepath.Ext(m))
+		jobs = append(jobs, batchJob{Controls: m, Output: library.JoinPath(outputDir, name+ext)})
+	}
+	return jobs, nil
+}
+
+func readCSVManifest(manifest string) ([]batchJob, error) {
+	file, err := os.Open(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error opening batch manifest: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading batch manifest: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("no records in batch manifest")
+	}
+
+	controlsCol, outputCol := -1, -1
+	for i, h := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "controls":
+			controlsCol = i
+		case "output":
+			outputCol = i
+		}
+	}
+	if controlsCol == -1 || outputCol == -1 {
+		return nil, fmt.Errorf("batch manifest must have 'controls' and 'output' columns")
+	}
+
+	var jobs []batchJob
+	for _, record := range records[1:] {
+		jobs = append(jobs, batchJob{
+			Controls: manifestPath(manifest, record[controlsCol]),
+			Output:   manifestPath(manifest, record[outputCol]),
+		})
+	}
+	return jobs, nil
+}
+
+func readJSONManifest(manifest string) ([]batchJob, error) {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error opening batch manifest: %v", err)
+	}
+
+	var jobs []batchJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("error reading batch manifest: %v", err)
+	}
+
+	for i, j := range jobs {
+		if j.Controls == "" || j.Output == "" {
+			return nil, fmt.Errorf("batch manifest entry %d must have 'controls' and 'output'", i)
+		}
+		jobs[i].Controls = manifestPath(manifest, j.Controls)
+		jobs[i].Output = manifestPath(manifest, j.Output)
+	}
+	return jobs, nil
+}
+
+// manifestPath resolves a path relative to the manifest folder, absolute and /vsi paths are kept as is
+func manifestPath(manifest, p string) string {
+	p = strings.TrimSpace(p)
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "/vsi") {
+		return p
+	}
+	return filepath.Join(filepath.Dir(manifest), p)
+}
+
+// runBatch builds composites for all jobs with a bounded worker pool.
+// Library listings are shared between jobs so each z_ folder is listed once.
+func runBatch(jobs []batchJob, opts options, workers int, summaryFile string) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	listing := library.NewListing()
+	results := make([]batchResult, len(jobs))
+
+	var wg sync.WaitGroup
+	jobIdx := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobIdx {
+				jobOpts := opts
+				jobOpts.controlsFile = jobs[i].Controls
+				jobOpts.outputFile = jobs[i].Output
+
+				start := time.Now()
+				report, err := build(jobOpts, listing)
+				results[i] = batchResult{job: jobs[i], err: err, missingCount: len(report), duration: time.Since(start)}
+				if err != nil {
+					slog.Error("Batch job failed", "controls", jobs[i].Controls, "output", jobs[i].Output, "error", err)
+				}
+			}
+		}()
+	}
+
+	for i := range jobs {
+		jobIdx <- i
+	}
+	close(jobIdx)
+	wg.Wait()
+
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+		}
+	}
+
+	if summaryFile != "" {
+		if err := writeBatchSummary(results, summaryFile); err != nil {
+			return fmt.Errorf("error writing batch summary: %v", err)
+		}
+		fmt.Printf("Batch summary created at %s\n", summaryFile)
+	}
+
+	fmt.Printf("Batch complete: %d succeeded, %d failed\n", len(results)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d batch jobs failed", failed, len(results))
+	}
+	return nil
+}
+
+func writeBatchSummary(results []batchResult, filePath string) error {
+	records := [][]string{{"controls", "output", "status", "missing_count", "duration_s", "error"}}
+	for _, r := range results {
+		status, errStr := "success", ""
+		if r.err != nil {
+			status, errStr = "failed", r.err.Error()
+		}
+		records = append(records, []string{
+			r.job.Controls,
+			r.job.Output,
+			status,
+			strconv.Itoa(r.missingCount),
+			fmt.Sprintf("%.1f", r.duration.Seconds()),
+			errStr,
+		})
+	}
+	return utils.WriteCSV(filePath, records)
+}
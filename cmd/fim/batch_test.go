@@ -0,0 +1,71 @@
+package fim
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	csvManifest := write("manifest.csv", "output,controls\nout/a.tif,controls/a.csv\n/abs/b.tif,/abs/b.csv\n")
+	jsonManifest := write("manifest.json", `[{"controls": "controls/a.csv", "output": "out/a.tif"}]`)
+	badManifest := write("bad.csv", "reach_id,flow\n1,2\n")
+	controlsDir := filepath.Join(dir, "controls")
+	if err := os.MkdirAll(controlsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"2yr.csv", "100yr.csv", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(controlsDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		manifest  string
+		outputDir string
+		format    string
+		want      []batchJob
+		wantErr   bool
+	}{
+		{"csv manifest", csvManifest, "", "COG", []batchJob{
+			{Controls: filepath.Join(dir, "controls/a.csv"), Output: filepath.Join(dir, "out/a.tif")},
+			{Controls: "/abs/b.csv", Output: "/abs/b.tif"},
+		}, false},
+		{"json manifest", jsonManifest, "", "COG", []batchJob{
+			{Controls: filepath.Join(dir, "controls/a.csv"), Output: filepath.Join(dir, "out/a.tif")},
+		}, false},
+		{"directory", controlsDir, "/out", "VRT", []batchJob{
+			{Controls: filepath.Join(controlsDir, "100yr.csv"), Output: "/out/100yr.vrt"},
+			{Controls: filepath.Join(controlsDir, "2yr.csv"), Output: "/out/2yr.vrt"},
+		}, false},
+		{"glob", filepath.Join(controlsDir, "2*.csv"), "/out", "GTIFF", []batchJob{
+			{Controls: filepath.Join(controlsDir, "2yr.csv"), Output: "/out/2yr.tif"},
+		}, false},
+		{"glob without output dir", filepath.Join(controlsDir, "*.csv"), "", "VRT", nil, true},
+		{"csv manifest without columns", badManifest, "", "VRT", nil, true},
+		{"no matches", filepath.Join(dir, "*.none"), "/out", "VRT", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readManifest(tt.manifest, tt.outputDir, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readManifest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package fim
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flows2fim/pkg/utils"
+)
+
+// bundleManifestName is the name of the manifest at the root of a bundle
+const bundleManifestName = "manifest.json"
+
+// bundleManifest describes the contents of a bundle, paths are relative to the bundle root
+type bundleManifest struct {
+	Created  string       `json:"created"`
+	Library  string       `json:"library"`
+	Controls string       `json:"controls"`
+	VRT      string       `json:"vrt"`
+	Files    []bundleFile `json:"files"`
+}
+
+// bundleFile is a file referenced by the bundled VRT
+type bundleFile struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// isZip reports whether a bundle path is a zip file rather than a directory
+func isZip(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".zip")
+}
+
+// writeBundle copies every file referenced by a VRT into a self-contained directory or zip (by extension) with the VRT,
+// the controls file and a manifest. Library files keep their library layout under 'library/', other files
+// (e.g. interpolated FIMs) are put under 'files/'. The bundled VRT references them with paths relative to it.
+// At most concurrent files are copied at a time.
+func writeBundle(vrtPath, controlsFile, absFimLibPath, bundlePath string, concurrent int) error {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	root := bundlePath
+	if isZip(bundlePath) {
+		tempDir, err := os.MkdirTemp("", "f2f_bundle_*")
+		if err != nil {
+			return fmt.Errorf("error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(tempDir)
+		root = tempDir
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("could not create bundle directory %s: %v", root, err)
+	}
+
+	ds, err := utils.ReadVRT(vrtPath)
+	if err != nil {
+		return err
+	}
+
+	// Rewrite sources relative to the bundle root, each file is copied once
+	vrtDir := filepath.Dir(vrtPath)
+	relPaths := map[string]string{}
+	used := map[string]bool{}
+	var files []bundleFile
+	for b := range ds.Bands {
+		for i := range ds.Bands[b].Sources {
+			src := &ds.Bands[b].Sources[i]
+			if !src.IsSource() {
+				continue
+			}
+			absPath := src.AbsPath(vrtDir)
+			rel, ok := relPaths[absPath]
+			if !ok {
+				rel = bundleRelPath(absPath, absFimLibPath, used)
+				relPaths[absPath] = rel
+				files = append(files, bundleFile{Path: rel, Source: absPath})
+			}
+			src.SourceFilename.Path = rel
+			src.SourceFilename.RelativeToVRT = "1"
+		}
+	}
+
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i := range files {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(f *bundleFile, i int) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+
+			dst := filepath.Join(root, filepath.FromSlash(f.Path))
+			if err := utils.CopyFile(f.Source, dst); err != nil {
+				errs[i] = fmt.Errorf("error copying %s to bundle: %v", f.Source, err)
+				return
+			}
+			f.Size, f.SHA256, errs[i] = hashFile(dst)
+		}(&files[i], i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	manifest := bundleManifest{
+		Created:  time.Now().UTC().Format(time.RFC3339),
+		Library:  absFimLibPath,
+		Controls: filepath.Base(controlsFile),
+		VRT:      filepath.Base(vrtPath),
+		Files:    files,
+	}
+	if err := utils.WriteVRT(filepath.Join(root, manifest.VRT), ds); err != nil {
+		return err
+	}
+	if err := utils.CopyFile(controlsFile, filepath.Join(root, manifest.Controls)); err != nil {
+		return fmt.Errorf("error copying controls file to bundle: %v", err)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding bundle manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, bundleManifestName), data, 0644); err != nil {
+		return fmt.Errorf("error writing bundle manifest: %v", err)
+	}
+
+	if isZip(bundlePath) {
+		return zipDir(root, bundlePath)
+	}
+	return nil
+}
+
+// bundleRelPath returns the path of a file in a bundle. Files in the library keep their path relative to the library
+// under 'library/', other files are put under 'files/' with a numeric suffix if their name is already used.
+func bundleRelPath(absPath, absFimLibPath string, used map[string]bool) string {
+	p, lib := filepath.ToSlash(absPath), strings.TrimSuffix(filepath.ToSlash(absFimLibPath), "/")
+	if strings.HasPrefix(p, lib+"/") {
+		rel := "library/" + strings.TrimPrefix(p, lib+"/")
+		used[rel] = true
+		return rel
+	}
+
+	base := path.Base(p)
+	ext := path.Ext(base)
+	rel := "files/" + base
+	for n := 1; used[rel]; n++ {
+		rel = fmt.Sprintf("files/%s_%d%s", strings.TrimSuffix(base, ext), n, ext)
+	}
+	used[rel] = true
+	return rel
+}
+
+// hashFile returns size and hex encoded SHA-256 of a file
+func hashFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", fmt.Errorf("error reading %s: %v", p, err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// zipDir writes every file in dir to a zip file, VSI destinations are uploaded once complete
+func zipDir(dir, zipPath string) error {
+	return utils.WriteStaged(zipPath, func(local string) error {
+		out, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		zw := zip.NewWriter(out)
+		err = filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			w, err := zw.Create(filepath.ToSlash(rel))
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error writing zip %s: %v", zipPath, err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("error writing zip %s: %v", zipPath, err)
+		}
+		return out.Close()
+	})
+}
@@ -0,0 +1,131 @@
+package fim
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestBundleRelPath(t *testing.T) {
+	used := map[string]bool{}
+	tests := []struct {
+		path, lib, want string
+	}{
+		{"/data/lib/1/z_nd/f_100.tif", "/data/lib", "library/1/z_nd/f_100.tif"},
+		{"/data/lib/1/domain.tif", "/data/lib/", "library/1/domain.tif"},
+		{"/vsis3/bucket/lib/2/z_5_0/f_200.tif", "/vsis3/bucket/lib", "library/2/z_5_0/f_200.tif"},
+		{"/data/out_interp/1_blend.tif", "/data/lib", "files/1_blend.tif"},
+		{"/other/1_blend.tif", "/data/lib", "files/1_blend_1.tif"},
+		{"/data/library_old/f_1.tif", "/data/lib", "files/f_1.tif"},
+	}
+	for _, tt := range tests {
+		if got := bundleRelPath(tt.path, tt.lib, used); got != tt.want {
+			t.Errorf("bundleRelPath(%q, %q) = %q, want %q", tt.path, tt.lib, got, tt.want)
+		}
+	}
+}
+
+func TestWriteBundle(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	for _, p := range []string{"1/z_nd/f_100.tif", "2/z_nd/f_200.tif"} {
+		full := filepath.Join(lib, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	controls := filepath.Join(dir, "controls.csv")
+	if err := os.WriteFile(controls, []byte("reach_id,flow,control_stage\n1,100,nd\n2,200,nd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Output VRT in another folder with one relative and one absolute source
+	outDir := filepath.Join(dir, "out")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	vrtPath := filepath.Join(outDir, "fim.vrt")
+	vrt := `<VRTDataset rasterXSize="1" rasterYSize="1">
+  <VRTRasterBand dataType="Float32" band="1">
+    <ComplexSource>
+      <SourceFilename relativeToVRT="1">../lib/1/z_nd/f_100.tif</SourceFilename>
+      <SourceBand>1</SourceBand>
+    </ComplexSource>
+    <ComplexSource>
+      <SourceFilename relativeToVRT="0">` + filepath.Join(lib, "2", "z_nd", "f_200.tif") + `</SourceFilename>
+      <SourceBand>1</SourceBand>
+    </ComplexSource>
+  </VRTRasterBand>
+</VRTDataset>
+`
+	if err := os.WriteFile(vrtPath, []byte(vrt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bundleDir := filepath.Join(dir, "bundle")
+	if err := writeBundle(vrtPath, controls, lib, bundleDir, 2); err != nil {
+		t.Fatalf("writeBundle() error = %v", err)
+	}
+
+	ds, err := utils.ReadVRT(filepath.Join(bundleDir, "fim.vrt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range ds.Bands[0].Sources {
+		if src.SourceFilename.RelativeToVRT != "1" {
+			t.Errorf("bundled source %s is not relative to VRT", src.SourceFilename.Path)
+		}
+		data, err := os.ReadFile(src.AbsPath(bundleDir))
+		if err != nil {
+			t.Errorf("bundled source missing: %v", err)
+		} else if want := src.SourceFilename.Path[len("library/"):]; string(data) != want {
+			t.Errorf("bundled source %s content = %q, want %q", src.SourceFilename.Path, data, want)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(bundleDir, bundleManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatalf("manifest is not valid JSON: %v", err)
+	}
+	if manifest.Controls != "controls.csv" || manifest.VRT != "fim.vrt" || len(manifest.Files) != 2 {
+		t.Errorf("manifest = %+v, want controls.csv, fim.vrt and 2 files", manifest)
+	}
+	if f := manifest.Files[0]; f.Path != "library/1/z_nd/f_100.tif" || f.Size != int64(len("1/z_nd/f_100.tif")) || len(f.SHA256) != 64 {
+		t.Errorf("manifest file = %+v", f)
+	}
+	if _, err := os.Stat(filepath.Join(bundleDir, "controls.csv")); err != nil {
+		t.Errorf("controls file missing from bundle: %v", err)
+	}
+
+	zipPath := filepath.Join(dir, "bundle.zip")
+	if err := writeBundle(vrtPath, controls, lib, zipPath, 2); err != nil {
+		t.Fatalf("writeBundle() zip error = %v", err)
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	want := []string{"controls.csv", "fim.vrt", "library/1/z_nd/f_100.tif", "library/2/z_nd/f_200.tif", "manifest.json"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("zip entries = %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,123 @@
+package fim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"flows2fim/pkg/utils"
+)
+
+// classEpsilon separates LUT points at a class break, so values equal to a break fall in the lower class.
+const classEpsilon = 1e-4
+
+// Color ramp end points for depth classes, light blue for shallow to dark blue for deep
+var (
+	shallowColor = [3]int{189, 215, 231}
+	deepColor    = [3]int{8, 48, 107}
+)
+
+// parseClasses parses comma separated ascending positive class breaks e.g. "1,3,6"
+func parseClasses(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var breaks []float64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid class break '%s': %v", part, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("invalid class break '%s', must be greater than 0", part)
+		}
+		breaks = append(breaks, v)
+	}
+
+	if !sort.Float64sAreSorted(breaks) {
+		return nil, fmt.Errorf("class breaks must be in ascending order")
+	}
+	for i := 1; i < len(breaks); i++ {
+		if breaks[i] == breaks[i-1] {
+			return nil, fmt.Errorf("class breaks must be unique")
+		}
+	}
+	if len(breaks) > 254 {
+		return nil, fmt.Errorf("too many class breaks, maximum is 254")
+	}
+
+	return breaks, nil
+}
+
+// classLUT returns a VRT LUT that maps values to classes.
+// Class 0 is values <= 0, class 1 is (0, b1], class i is (b(i-1), bi] and the last class is > bn.
+func classLUT(breaks []float64) string {
+	points := []string{"0:0", fmt.Sprintf("%g:1", classEpsilon)}
+	for i, b := range breaks {
+		points = append(points,
+			fmt.Sprintf("%g:%d", b, i+1),
+			fmt.Sprintf("%g:%d", b+classEpsilon, i+2),
+		)
+	}
+	return strings.Join(points, ",")
+}
+
+// classNames returns category names of the classes, class 0 has no name as it is nodata
+func classNames(breaks []float64) []string {
+	names := []string{""}
+	lower := 0.0
+	for _, b := range breaks {
+		names = append(names, fmt.Sprintf("%g - %g", lower, b))
+		lower = b
+	}
+	return append(names, fmt.Sprintf("> %g", lower))
+}
+
+// classColors returns a palette with transparent class 0 and a blue ramp for the other classes
+func classColors(classCount int) []utils.VRTColorEntry {
+	entries := []utils.VRTColorEntry{{C1: 0, C2: 0, C3: 0, C4: 0}}
+	for i := 0; i < classCount; i++ {
+		t := 1.0
+		if classCount > 1 {
+			t = float64(i) / float64(classCount-1)
+		}
+		entry := utils.VRTColorEntry{C4: 255}
+		entry.C1 = shallowColor[0] + int(t*float64(deepColor[0]-shallowColor[0]))
+		entry.C2 = shallowColor[1] + int(t*float64(deepColor[1]-shallowColor[1]))
+		entry.C3 = shallowColor[2] + int(t*float64(deepColor[2]-shallowColor[2]))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// classifyVRT converts a composite VRT in place to a Byte VRT of depth classes with a color table and category names.
+// Every source is converted to a ComplexSource with a LUT, so source order and precedence are unchanged.
+// Domain sources would map to nodata, so classes are not used with -with_domain.
+func classifyVRT(ds *utils.VRTDataset, breaks []float64) {
+	lut := classLUT(breaks)
+	names := classNames(breaks)
+
+	for b := range ds.Bands {
+		band := &ds.Bands[b]
+		band.DataType = "Byte"
+		band.NoDataValue = "0"
+		band.ColorInterp = "Palette"
+		band.ColorTable = &utils.VRTColorTable{Entries: classColors(len(names) - 1)}
+		band.CategoryNames = &utils.VRTCategoryNames{Categories: names}
+		band.Histograms = nil
+
+		for i := range band.Sources {
+			src := &band.Sources[i]
+			if !src.IsSource() {
+				continue
+			}
+			src.XMLName = xml.Name{Local: "ComplexSource"}
+			src.ScaleOffset = ""
+			src.ScaleRatio = ""
+			src.LUT = lut
+		}
+	}
+}
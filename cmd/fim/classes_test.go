@@ -0,0 +1,66 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestParseClasses(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []float64
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"valid", "1, 3,6", []float64{1, 3, 6}, false},
+		{"not ascending", "3,1", nil, true},
+		{"duplicate", "1,1", nil, true},
+		{"zero", "0,1", nil, true},
+		{"not a number", "1,a", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseClasses(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseClasses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseClasses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyVRT(t *testing.T) {
+	ds, err := utils.ReadVRT("../../testdata/reference_data/fim_output_formats/fim_2year.vrt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breaks := []float64{1, 3, 6}
+	classifyVRT(ds, breaks)
+
+	band := ds.Bands[0]
+	if band.DataType != "Byte" || band.NoDataValue != "0" || band.ColorInterp != "Palette" {
+		t.Errorf("classifyVRT() band = %s, nodata %s, %s", band.DataType, band.NoDataValue, band.ColorInterp)
+	}
+
+	wantNames := []string{"", "0 - 1", "1 - 3", "3 - 6", "> 6"}
+	if !reflect.DeepEqual(band.CategoryNames.Categories, wantNames) {
+		t.Errorf("classifyVRT() category names = %v, want %v", band.CategoryNames.Categories, wantNames)
+	}
+	if len(band.ColorTable.Entries) != len(wantNames) {
+		t.Errorf("classifyVRT() color table entries = %d, want %d", len(band.ColorTable.Entries), len(wantNames))
+	}
+
+	wantLUT := "0:0,0.0001:1,1:1,1.0001:2,3:2,3.0001:3,6:3,6.0001:4"
+	for _, src := range band.Sources {
+		if src.XMLName.Local != "ComplexSource" || src.LUT != wantLUT || src.NoData != "-9999" {
+			t.Errorf("classifyVRT() source = %s, LUT %s, NODATA %s", src.XMLName.Local, src.LUT, src.NoData)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package fim
+
+import (
+	"fmt"
+	"sort"
+
+	"flows2fim/pkg/utils"
+)
+
+// cleanupOptions holds the settings to clean the composite before it is written
+type cleanupOptions struct {
+	minDepth   float64 // depths below are dry
+	minCluster int     // wet clusters with fewer pixels are dry
+	fillHoles  int     // dry holes with at most this many pixels are wet
+}
+
+// active reports whether any cleanup is set
+func (c cleanupOptions) active() bool {
+	return c.minDepth > 0 || c.minCluster > 1 || c.fillHoles > 0
+}
+
+// validate checks cleanup values
+func (c cleanupOptions) validate() error {
+	if c.minDepth < 0 || c.minCluster < 0 || c.fillHoles < 0 {
+		return fmt.Errorf("-min_depth, -min_cluster and -fill_holes must be 0 or more")
+	}
+	return nil
+}
+
+// span is a run of pixels x0 to x1-1 of a row, label is its connected component
+type span struct {
+	x0, x1 int
+	label  int
+}
+
+// spanAt returns the span of spans (sorted by x0) that contains x, nil if none
+func spanAt(spans []span, x int) *span {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].x1 > x })
+	if i < len(spans) && spans[i].x0 <= x {
+		return &spans[i]
+	}
+	return nil
+}
+
+// components is a union-find of connected component labels with their pixel count and whether they touch the raster edge
+type components struct {
+	parent []int
+	size   []int
+	edge   []bool
+}
+
+// add returns a new component of a span
+func (c *components) add(s span, edge bool) int {
+	c.parent = append(c.parent, len(c.parent))
+	c.size = append(c.size, s.x1-s.x0)
+	c.edge = append(c.edge, edge)
+	return len(c.parent) - 1
+}
+
+// find returns the root label of a component
+func (c *components) find(i int) int {
+	for c.parent[i] != i {
+		c.parent[i] = c.parent[c.parent[i]]
+		i = c.parent[i]
+	}
+	return i
+}
+
+// union merges the components of a and b
+func (c *components) union(a, b int) {
+	a, b = c.find(a), c.find(b)
+	if a == b {
+		return
+	}
+	c.parent[b] = a
+	c.size[a] += c.size[b]
+	c.edge[a] = c.edge[a] || c.edge[b]
+}
+
+// connect labels spans of a row and merges them with overlapping spans of the previous row.
+// diagonal extends overlaps by one pixel for 8-connectivity.
+func (c *components) connect(row, prev []span, w, y, h int, diagonal bool) {
+	d := 0
+	if diagonal {
+		d = 1
+	}
+	j := 0
+	for i := range row {
+		s := &row[i]
+		s.label = c.add(*s, y == 0 || y == h-1 || s.x0 == 0 || s.x1 == w)
+		for j < len(prev) && prev[j].x1+d <= s.x0 {
+			j++
+		}
+		for k := j; k < len(prev) && prev[k].x0 < s.x1+d; k++ {
+			c.union(s.label, prev[k].label)
+		}
+	}
+}
+
+// cleanedComposite is a composite after cleanup, computed one row at a time like the composite.
+// Cleanup is planned with passes over the composite rows that keep runs of wet and dry pixels per row, not pixel values.
+type cleanedComposite struct {
+	c      compositeRows
+	copts  cleanupOptions
+	wet    [][]span // runs of wet pixels after -min_depth, labeled by cluster
+	dry    [][]span // runs of dry pixels after -min_cluster, labeled by hole
+	keep   []bool   // by cluster label
+	fill   map[int]float32
+	grid   utils.RasterHeader
+	row    []float32
+	src    []int
+	values []float32
+}
+
+// cleanComposite returns the composite c after cleanup. Pixels shallower than minDepth and wet clusters (8-connected)
+// smaller than minCluster pixels are nodata so a domain behind the FIMs shows through, then dry holes (4-connected,
+// not touching the raster edge) of at most fillHoles pixels get the mean of the wet pixels around them.
+// Pixels are wet if they have data above 0. Removed and filled pixels are not provided by any FIM.
+func cleanComposite(c compositeRows, copts cleanupOptions) (compositeRows, error) {
+	grid := c.Header()
+	w, h := grid.Width, grid.Height
+	cc := &cleanedComposite{c: c, copts: copts, wet: make([][]span, h), grid: grid, row: make([]float32, w), src: make([]int, w), values: make([]float32, w)}
+	removed, filled := 0, 0
+
+	// Wet runs and clusters
+	var clusters components
+	for y := 0; y < h; y++ {
+		if err := c.read(y, cc.values, cc.src); err != nil {
+			return nil, err
+		}
+		var spans []span
+		for x, v := range cc.values {
+			if !cc.isWet(v) {
+				continue
+			}
+			if cc.isShallow(v) {
+				removed++
+				continue
+			}
+			if n := len(spans); n > 0 && spans[n-1].x1 == x {
+				spans[n-1].x1++
+			} else {
+				spans = append(spans, span{x0: x, x1: x + 1})
+			}
+		}
+		var prev []span
+		if y > 0 {
+			prev = cc.wet[y-1]
+		}
+		clusters.connect(spans, prev, w, y, h, true)
+		cc.wet[y] = spans
+	}
+	cc.keep = make([]bool, len(clusters.parent))
+	for l := range cc.keep {
+		root := clusters.find(l)
+		cc.keep[l] = copts.minCluster <= 1 || clusters.size[root] >= copts.minCluster
+		if !cc.keep[l] && root == l {
+			removed += clusters.size[root]
+		}
+	}
+
+	if copts.fillHoles > 0 {
+		// Dry runs, the gaps between kept wet runs, and holes
+		cc.dry = make([][]span, h)
+		var holes components
+		for y := 0; y < h; y++ {
+			var spans []span
+			x := 0
+			for _, s := range cc.wet[y] {
+				if !cc.keep[s.label] {
+					continue
+				}
+				if s.x0 > x {
+					spans = append(spans, span{x0: x, x1: s.x0})
+				}
+				x = s.x1
+			}
+			if x < w {
+				spans = append(spans, span{x0: x, x1: w})
+			}
+			var prev []span
+			if y > 0 {
+				prev = cc.dry[y-1]
+			}
+			holes.connect(spans, prev, w, y, h, false)
+			cc.dry[y] = spans
+		}
+
+		// Sum of the wet pixels around each hole to fill, each wet pixel counts once per hole
+		sums, counts := map[int]float64{}, map[int]int{}
+		for l := range holes.parent {
+			if root := holes.find(l); root == l && !holes.edge[root] && holes.size[root] <= copts.fillHoles {
+				sums[root] = 0
+				filled += holes.size[root]
+			}
+		}
+		for y := 0; y < h && len(sums) > 0; y++ {
+			if err := c.read(y, cc.values, cc.src); err != nil {
+				return nil, err
+			}
+			for _, s := range cc.wet[y] {
+				if !cc.keep[s.label] {
+					continue
+				}
+				for x := s.x0; x < s.x1; x++ {
+					var around [4]int
+					n := 0
+					for _, q := range [][2]int{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+						if q[0] < 0 || q[0] >= w || q[1] < 0 || q[1] >= h {
+							continue
+						}
+						d := spanAt(cc.dry[q[1]], q[0])
+						if d == nil {
+							continue
+						}
+						root := holes.find(d.label)
+						if _, ok := sums[root]; !ok {
+							continue
+						}
+						seen := false
+						for _, r := range around[:n] {
+							seen = seen || r == root
+						}
+						if !seen {
+							around[n] = root
+							n++
+							sums[root] += float64(cc.values[x])
+							counts[root]++
+						}
+					}
+				}
+			}
+		}
+
+		// Holes are filled after all of them are found so filled pixels don't count as wet pixels around other holes
+		cc.fill = map[int]float32{}
+		for l := range holes.parent {
+			root := holes.find(l)
+			if _, ok := sums[root]; ok {
+				cc.fill[l] = float32(sums[root] / float64(counts[root]))
+			}
+		}
+	}
+
+	fmt.Printf("Cleanup removed %d and filled %d pixels\n", removed, filled)
+	return cc, nil
+}
+
+// isWet reports whether a composite value has data above 0
+func (cc *cleanedComposite) isWet(v float32) bool {
+	return !cc.grid.IsNoData(v) && v > 0
+}
+
+// isShallow reports whether a wet value is below -min_depth
+func (cc *cleanedComposite) isShallow(v float32) bool {
+	return cc.copts.minDepth > 0 && float64(v) < cc.copts.minDepth
+}
+
+// Header returns the grid and nodata of the composite
+func (cc *cleanedComposite) Header() utils.RasterHeader {
+	return cc.grid
+}
+
+// Row returns row y after cleanup, the values are overwritten by the next call to Row
+func (cc *cleanedComposite) Row(y int) ([]float32, error) {
+	return cc.row, cc.read(y, cc.row, cc.src)
+}
+
+// read writes row y after cleanup into dst, removed and filled pixels are not provided by any FIM
+func (cc *cleanedComposite) read(y int, dst []float32, src []int) error {
+	if err := cc.c.read(y, dst, src); err != nil {
+		return err
+	}
+	noData := float32(cc.grid.NoData)
+	for x, v := range dst {
+		if cc.isWet(v) && cc.isShallow(v) {
+			dst[x], src[x] = noData, -1
+		}
+	}
+	for _, s := range cc.wet[y] {
+		if cc.keep[s.label] {
+			continue
+		}
+		for x := s.x0; x < s.x1; x++ {
+			dst[x], src[x] = noData, -1
+		}
+	}
+	if cc.dry != nil {
+		for _, s := range cc.dry[y] {
+			if v, ok := cc.fill[s.label]; ok {
+				for x := s.x0; x < s.x1; x++ {
+					dst[x], src[x] = v, -1
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+// cleanRows returns the rows of a raster after cleanup and the FIM providing each pixel
+func cleanRows(t *testing.T, r *utils.Raster, copts cleanupOptions) ([]float32, []int) {
+	t.Helper()
+	mosaic, err := utils.NewMosaic([]*utils.Raster{r})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	cleaned, err := cleanComposite(newComposite(mosaic, false), copts)
+	if err != nil {
+		t.Fatalf("cleanComposite() error = %v", err)
+	}
+	values, srcs := make([]float32, 0, len(r.Data)), make([]int, 0, len(r.Data))
+	row, src := make([]float32, r.Width), make([]int, r.Width)
+	for y := 0; y < r.Height; y++ {
+		if err := cleaned.read(y, row, src); err != nil {
+			t.Fatalf("read() error = %v", err)
+		}
+		values, srcs = append(values, row...), append(srcs, src...)
+	}
+	return values, srcs
+}
+
+func TestCleanComposite(t *testing.T) {
+	const nd = -9999
+	data := []float32{
+		0.1, nd, nd, nd, nd, nd,
+		nd, nd, 2, 2, 2, nd,
+		nd, nd, 2, nd, 4, nd,
+		nd, nd, 2, 2, 2, nd,
+		5, nd, nd, nd, nd, nd,
+	}
+	r := &utils.Raster{Width: 6, Height: 5, GeoTransform: [6]float64{0, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: data}
+
+	values, src := cleanRows(t, r, cleanupOptions{minDepth: 0.5, minCluster: 2, fillHoles: 1})
+	want := []float32{
+		nd, nd, nd, nd, nd, nd,
+		nd, nd, 2, 2, 2, nd,
+		nd, nd, 2, 2.5, 4, nd,
+		nd, nd, 2, 2, 2, nd,
+		nd, nd, nd, nd, nd, nd,
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("cleanComposite() = %v, want %v", values, want)
+	}
+	// Removed and filled pixels are not provided by the FIM
+	for _, i := range []int{0, 15, 24} {
+		if src[i] != -1 {
+			t.Errorf("pixel %d is provided by FIM %d, want -1", i, src[i])
+		}
+	}
+	if src[8] != 0 {
+		t.Errorf("pixel 8 is provided by FIM %d, want 0", src[8])
+	}
+
+	// The hole has two dry runs in its first row that join below, the wet pixel between them counts once
+	data = []float32{
+		nd, nd, nd, nd, nd, nd, nd,
+		nd, 1, 1, 1, 1, 1, nd,
+		nd, 1, nd, 4, nd, 1, nd,
+		nd, 1, 0, nd, nd, 1, nd,
+		nd, 1, 1, 1, 1, 1, nd,
+		nd, nd, nd, nd, nd, nd, nd,
+	}
+	r = &utils.Raster{Width: 7, Height: 6, GeoTransform: [6]float64{0, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: data}
+	if values, _ = cleanRows(t, r, cleanupOptions{fillHoles: 4}); !reflect.DeepEqual(values, data) {
+		t.Errorf("cleanComposite() filled a hole larger than -fill_holes: %v", values)
+	}
+	values, _ = cleanRows(t, r, cleanupOptions{fillHoles: 5})
+	fill := float32(13.0 / 10)
+	for _, i := range []int{16, 18, 23, 24, 25} {
+		if values[i] != fill {
+			t.Errorf("hole pixel %d = %v, want %v", i, values[i], fill)
+		}
+	}
+	if values[0] != nd {
+		t.Errorf("dry pixel on the edge = %v, want nodata", values[0])
+	}
+}
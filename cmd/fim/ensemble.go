@@ -0,0 +1,222 @@
+package fim
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// ensembleNoData is nodata of ensemble outputs, pixels not flooded by any member are nodata
+const ensembleNoData = -9999
+
+// ensembleOptions holds the outputs of an ensemble run
+type ensembleOptions struct {
+	count      bool
+	maxFile    string
+	medianFile string
+}
+
+// ensembleMembers returns controls files from a directory (all CSV files) or a glob, sorted by name.
+// It lists ensemble members and time series steps.
+func ensembleMembers(pattern string) ([]string, error) {
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*.csv")
+	}
+
+	members, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid controls glob %s: %v", pattern, err)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no controls files found for %s", pattern)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// runEnsemble writes the fraction (or count) of members that flood each pixel, and optionally max and median depth.
+// Each library FIM is read once even if it is used by many members. Each member follows the same precedence as its composite.
+// Dry members count as 0 depth for median.
+func runEnsemble(members []string, opts options, eopts ensembleOptions) error {
+	absOutputPath, err := library.AbsPath(opts.outputFile)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for output file: %v", err)
+	}
+	absFimLibPath, err := library.AbsPath(opts.fimLibDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+	}
+
+	// Member FIMs as indexes into unique library FIMs
+	listing := library.NewListing()
+	var paths []string
+	pathIdx := map[string]int{}
+	memberFIMs := make([][]int, len(members))
+	for m, controlsFile := range members {
+		entries, err := library.ReadControls(controlsFile, absFimLibPath)
+		if err != nil {
+			return err
+		}
+		if opts.missingPolicy != library.MissingNone {
+			if entries, _, err = library.ResolveMissing(entries, opts.missingPolicy, listing, opts.concurrent); err != nil {
+				return fmt.Errorf("member %s: %v", controlsFile, err)
+			}
+		}
+		if countInterpolated(entries) > 0 {
+			slog.Warn("Interpolation columns are ignored in ensemble mode, lower flow FIMs are used", "controls", controlsFile)
+		}
+		for _, e := range entries {
+			i, ok := pathIdx[e.Path]
+			if !ok {
+				i = len(paths)
+				pathIdx[e.Path] = i
+				paths = append(paths, e.Path)
+			}
+			memberFIMs[m] = append(memberFIMs[m], i)
+		}
+	}
+	slog.Debug("Loaded ensemble members", "members_count", len(members), "unique_fims_count", len(paths))
+	if len(paths) == 0 {
+		return fmt.Errorf("none of the FIMs referenced in ensemble controls are available in library")
+	}
+
+	info, err := utils.GDALInfo(paths[0])
+	if err != nil {
+		return err
+	}
+	mosaic, err := utils.OpenMosaic(paths, opts.concurrent)
+	if err != nil {
+		return err
+	}
+	defer mosaic.Close()
+
+	// Only requested outputs are written, one row at a time
+	grid := mosaic.Grid
+	grid.NoData, grid.HasNoData = ensembleNoData, true
+	outputPaths := []string{absOutputPath, eopts.maxFile, eopts.medianFile}
+	writers := make([]*utils.RasterWriter, len(outputPaths))
+	rows := make([][]float32, len(outputPaths))
+	for i, p := range outputPaths {
+		if p == "" {
+			continue
+		}
+		if writers[i], err = utils.NewRasterWriter(grid); err != nil {
+			return err
+		}
+		defer writers[i].Cleanup()
+		rows[i] = make([]float32, grid.Width)
+	}
+
+	stats := newEnsembleStats(mosaic, memberFIMs, eopts.count)
+	for y := 0; y < grid.Height; y++ {
+		if err := stats.row(y, rows[0], rows[1], rows[2]); err != nil {
+			return err
+		}
+		for i, w := range writers {
+			if w == nil {
+				continue
+			}
+			if err := w.WriteRow(rows[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, w := range writers {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(info.CoordinateSystem.WKT, outputPaths[i], opts.outputFormat, opts.creation); err != nil {
+			return err
+		}
+		fmt.Printf("Ensemble raster created at %s\n", outputPaths[i])
+	}
+
+	return nil
+}
+
+// ensembleStats computes frequency, max depth and median depth of ensemble members on the mosaic grid one row at a time.
+// A member's value at a pixel is the value of its last FIM with data at the pixel, same as its composite.
+type ensembleStats struct {
+	mosaic      *utils.Mosaic
+	memberFIMs  [][]int
+	count       bool
+	depths      [][]float32 // depth of each member in current row
+	pixelDepths []float64
+}
+
+// newEnsembleStats returns the statistics of members given as indexes into mosaic rasters.
+// Frequency is the fraction of members that flood a pixel, or their number if count is set.
+func newEnsembleStats(mosaic *utils.Mosaic, memberFIMs [][]int, count bool) *ensembleStats {
+	depths := make([][]float32, len(memberFIMs))
+	for m := range depths {
+		depths[m] = make([]float32, mosaic.Grid.Width)
+	}
+	return &ensembleStats{mosaic: mosaic, memberFIMs: memberFIMs, count: count, depths: depths, pixelDepths: make([]float64, len(memberFIMs))}
+}
+
+// row writes row y of frequency, max depth and median depth, outputs that are nil are not computed.
+// Pixels not flooded by any member are nodata.
+func (e *ensembleStats) row(y int, frequency, maxDepth, medianDepth []float32) error {
+	for m, fimIdxs := range e.memberFIMs {
+		row := e.depths[m]
+		for x := range row {
+			row[x] = 0
+		}
+		if err := e.mosaic.CompositeRow(y, fimIdxs, row, nil); err != nil {
+			return err
+		}
+	}
+
+	n := len(e.memberFIMs)
+	for x := 0; x < e.mosaic.Grid.Width; x++ {
+		wet := 0
+		for m := range e.depths {
+			d := math.Max(float64(e.depths[m][x]), 0)
+			if d > 0 {
+				wet++
+			}
+			e.pixelDepths[m] = d
+		}
+
+		for _, out := range [][]float32{frequency, maxDepth, medianDepth} {
+			if out != nil {
+				out[x] = ensembleNoData
+			}
+		}
+		if wet == 0 {
+			continue
+		}
+
+		if frequency != nil {
+			frequency[x] = float32(wet)
+			if !e.count {
+				frequency[x] = float32(float64(wet) / float64(n))
+			}
+		}
+		if maxDepth == nil && medianDepth == nil {
+			continue
+		}
+
+		sort.Float64s(e.pixelDepths)
+		if maxDepth != nil {
+			maxDepth[x] = float32(e.pixelDepths[n-1])
+		}
+		if medianDepth != nil {
+			median := e.pixelDepths[n/2]
+			if n%2 == 0 {
+				median = (e.pixelDepths[n/2-1] + e.pixelDepths[n/2]) / 2
+			}
+			if median > 0 {
+				medianDepth[x] = float32(median)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestEnsembleStats(t *testing.T) {
+	const nd = -9999
+	// Two 2x1 FIMs side by side with one overlapping column, res 1
+	left := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{1, 2}}
+	leftDry := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{nd, 0}}
+	right := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{1, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{4, nd}}
+
+	mosaic, err := utils.NewMosaic([]*utils.Raster{left, leftDry, right})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	if mosaic.Grid.Width != 3 || mosaic.Grid.Height != 1 || mosaic.Offsets[2] != [2]int{1, 0} {
+		t.Fatalf("NewMosaic() grid %dx%d right offset %v, want 3x1 offset [1 0]", mosaic.Grid.Width, mosaic.Grid.Height, mosaic.Offsets[2])
+	}
+
+	// Member 0 has right on top of left, member 1 has only leftDry, member 2 has left on top of right
+	members := [][]int{{0, 2}, {1}, {2, 0}}
+
+	frequency, maxDepth, medianDepth := make([]float32, 3), make([]float32, 3), make([]float32, 3)
+	if err := newEnsembleStats(mosaic, members, false).row(0, frequency, maxDepth, medianDepth); err != nil {
+		t.Fatalf("row() error = %v", err)
+	}
+	if want := []float32{2.0 / 3, 2.0 / 3, nd}; !reflect.DeepEqual(frequency, want) {
+		t.Errorf("frequency = %v, want %v", frequency, want)
+	}
+	if want := []float32{1, 4, nd}; !reflect.DeepEqual(maxDepth, want) {
+		t.Errorf("max depth = %v, want %v", maxDepth, want)
+	}
+	if want := []float32{1, 2, nd}; !reflect.DeepEqual(medianDepth, want) {
+		t.Errorf("median depth = %v, want %v", medianDepth, want)
+	}
+
+	// Outputs that are not requested are skipped
+	count := make([]float32, 3)
+	if err := newEnsembleStats(mosaic, members, true).row(0, count, nil, nil); err != nil {
+		t.Fatalf("row() error = %v", err)
+	}
+	if want := []float32{2, 2, nd}; !reflect.DeepEqual(count, want) {
+		t.Errorf("count = %v, want %v", count, want)
+	}
+}
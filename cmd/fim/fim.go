@@ -1,20 +1,25 @@
 package fim
 
 import (
-	"encoding/csv"
 	"flag"
+	"flows2fim/internal/library"
 	"flows2fim/pkg/utils"
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 var usage string = `Usage of fim:
 Given a control table and a fim library folder, create a composite flood inundation map for the control conditions.
-GDAL VSI paths can be used (only for library and not for output), given GDAL must have access to cloud creds.
+GDAL VSI paths can be used for library and output, given GDAL must have access to cloud creds.
+VSI outputs are written locally and uploaded with gdal_cp once complete, XYZ output can not be written to a VSI path.
+Missing FIMs are checked by default in local libraries only. Checking a VSI library with -missing needs gdal_ls.
+Ensemble mode (-ensemble) converts every library FIM used by any member to a temporary file once and reads it
+one row at a time, only requested outputs are written. Time series mode (-timeseries) does the same for every step and writes a NetCDF or Zarr cube with a CF time dimension,
+and optionally rasters of max depth, arrival time and wet duration in hours, all in one pass.
+XYZ output is a directory of Web Mercator PNG tiles ({z}/{x}/{y}.png), or an MBTiles file if output ends with .mbtiles.
 
 FIM Library Specifications:
 - All maps should have same CRS, Resolution, data type, vertical units (if any), and nodata value
@@ -38,9 +43,109 @@ FIM Library Specifications:
 ├── 2821867
 │   ├── z_nd
 ...
+Missing domain.tif files can be written with 'flows2fim library build-domain'.
+
+Interpolation:
+Controls file can have optional 'flow_upper' and 'weight' columns. For rows with both set, depth of the reach is
+(1 - weight) * depth at flow + weight * depth at flow_upper, where dry pixels count as 0 depth.
+Blended FIMs are written to '<output name>_interp' folder next to VRT outputs and to a temporary folder for other formats.
+Interpolation is intended for depth libraries.
+
+Attribution:
+'-attribution' writes the reach_id and FIM index providing each pixel of the composite, after precedence and cleanup.
+Pixels removed or filled by cleanup are not attributed. It has no depth band since GeoTIFF bands share one data type
+and nodata value, the composite has the depth on the same grid.
+
+Precedence:
+Where FIMs of reaches overlap, later FIMs win. By default they follow the order of the controls file (-precedence controls).
+'downstream' and 'stream_order' order FIMs with the reach network (table 'network' of -db), so downstream reaches or
+reaches with higher Strahler stream order win. 'priority' uses the 'priority' column of the controls file, which must exist,
+higher wins. Ties keep the controls order. 'deeper' takes the deeper value at each pixel.
+Domains are always behind FIMs. With 'deeper', cleanup, WSE, statistics, attribution or QA the FIMs are converted once to temporary
+files that all of them read one row at a time.
+
+QA:
+'-qa' checks the composite for seams, where wet pixels of adjacent reaches differ in depth by more than -qa_threshold,
+and gaps, dry slivers of at most -qa_gap pixels between wet pixels of different reaches. Findings are written as
+MultiPoint features per kind and reach pair with a summary CSV. QA follows -precedence.
+
+WSE:
+'-product wse -dem <path>' writes water surface elevation, DEM + depth, for wet pixels. The DEM is resampled bilinearly
+to the library grid and can be a VSI path. Output metadata has PRODUCT=wse and VERTICAL_DATUM from -vdatum, or from the
+DEM coordinate system if it is compound. Statistics, attribution and QA still use depth.
+
+Cleanup:
+'-min_depth' makes shallower pixels dry, '-min_cluster' removes wet clusters smaller than the given number of pixels and
+'-fill_holes' fills enclosed dry holes up to the given number of pixels, in that order. Cleanup applies to the composite
+and its statistics, not to the library. It keeps runs of wet and dry pixels per row in memory, not the composite.
+Removed pixels show the domain if -with_domain is set.
+
+Bundle:
+VRT outputs reference FIMs in the library. '-bundle' copies (or fetches from VSI paths) every referenced FIM and domain
+into a directory or .zip with a VRT using relative paths, the controls file and manifest.json listing each file
+with its source, size and SHA-256, so the composite can be shared without the library.
 
 Arguments:` // Usage should be always followed by PrintDefaults()
 
+// options holds the settings of a single composite FIM run
+type options struct {
+	controlsFile  string
+	fimLibDir     string
+	outputFormat  string
+	outputFile    string
+	withDomain    bool
+	missingPolicy string
+	missingReport string
+	statsFile     string
+	bundle        string
+	attribution   string
+	precedence    string
+	qa            qaOptions
+	cleanup       cleanupOptions
+	product       string
+	dem           string
+	verticalDatum string
+	network       *library.Network
+	concurrent    int
+	classes       []float64
+	creation      utils.CreationOptions
+	tiles         utils.TileOptions
+}
+
+// unsupportedFlags lists the flags that can not be used in a mode or with a product
+var unsupportedFlags = map[string][]string{
+	"in time series mode": {"batch", "ensemble", "with_domain", "classes", "o_missing", "o_stats", "bundle", "attribution", "qa",
+		"count", "o_median", "product", "precedence", "min_depth", "min_cluster", "fill_holes"},
+	"in ensemble mode": {"batch", "with_domain", "classes", "o_missing", "o_stats", "bundle", "attribution", "qa",
+		"product", "precedence", "min_depth", "min_cluster", "fill_holes"},
+	"in batch mode":     {"o_missing", "o_stats", "bundle", "attribution", "qa"},
+	"with -product wse": {"with_domain", "classes"},
+}
+
+// checkUnsupported returns an error naming the flags of unsupportedFlags[mode] that are set to other than their default
+func checkUnsupported(flags *flag.FlagSet, mode string) error {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Value.String() != f.DefValue {
+			set[f.Name] = true
+		}
+	})
+
+	var used []string
+	for _, name := range unsupportedFlags[mode] {
+		if set[name] {
+			used = append(used, "-"+name)
+		}
+	}
+	switch len(used) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s is not supported %s", used[0], mode)
+	}
+	return fmt.Errorf("%s and %s are not supported %s", strings.Join(used[:len(used)-1], ", "), used[len(used)-1], mode)
+}
+
 func Run(args []string) (gdalArgs []string, err error) {
 	flags := flag.NewFlagSet("fim", flag.ExitOnError)
 	flags.Usage = func() {
@@ -48,37 +153,202 @@ func Run(args []string) (gdalArgs []string, err error) {
 		flags.PrintDefaults()
 	}
 
-	var controlsFile, fimLibDir, libType, outputFormat, outputFile string
-	var withDomain bool
+	var opts options
+	var libType, batchFile, summaryFile, classesStr, ensembleFiles, timeSeries, dbPath string
+	var eopts ensembleOptions
+	var topts timeSeriesOptions
+	var jobs int
 
 	// Define flags using flags.StringVar
-	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
-	flags.StringVar(&controlsFile, "c", "", "Path to the controls CSV file")
-	flags.StringVar(&outputFormat, "fmt", "VRT", "Output format: 'VRT', 'COG' or 'GTIFF'") // follows GDAL format names, case insensitive
-	flags.StringVar(&libType, "type", "", "Library type: 'depth' or 'extent'")             // was only required for v0.3.0, but keeping it for backward compatibility
-	flags.StringVar(&outputFile, "o", "", "Output FIM file path")
-	flags.BoolVar(&withDomain, "with_domain", false, "If true, domain is added behind FIMs")
+	flags.StringVar(&opts.fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&opts.controlsFile, "c", "", "Path to the controls CSV file")
+	flags.StringVar(&opts.outputFormat, "fmt", "VRT", "Output format: 'VRT', 'COG', 'GTIFF' or 'XYZ'") // follows GDAL format names, case insensitive
+	flags.StringVar(&libType, "type", "", "Library type: 'depth' or 'extent'")                         // was only required for v0.3.0, but keeping it for backward compatibility
+	flags.StringVar(&opts.outputFile, "o", "", "Output FIM file path (output directory in batch mode when -batch is a directory or glob)")
+	flags.BoolVar(&opts.withDomain, "with_domain", false, "If true, domain is added behind FIMs")
+	flags.StringVar(&opts.missingPolicy, "missing", "", "Action when a FIM referenced in controls file is not in library: 'fail', 'skip', 'nearest' (nearest available flow in same z_ folder) or 'none' (no check). Default is 'fail' for local libraries and 'none' for VSI libraries")
+	flags.StringVar(&opts.missingReport, "o_missing", "", "Optional output CSV listing FIMs missing from library and the action taken. In batch mode missing FIM counts are in -o_summary")
+	flags.StringVar(&opts.statsFile, "o_stats", "", "Optional output CSV or JSON (by extension) of flooded area, max depth and mean depth per reach_id (pixels the reach provides in the composite) and for the whole composite")
+	flags.StringVar(&opts.bundle, "bundle", "", "Optional output directory or .zip with the VRT, every FIM and domain it references, the controls file and a manifest. Only for VRT output")
+	flags.StringVar(&opts.attribution, "attribution", "", "Optional output Int32 raster of reach_id (band 1) and FIM index (band 2) providing each pixel, with a '<name>_lookup.csv' of FIM index to FIM path. COG unless -fmt is GTIFF")
+	flags.StringVar(&opts.precedence, "precedence", library.PrecedenceControls, "Which reach wins where FIMs overlap: 'controls' (later rows), 'downstream', 'stream_order' (higher Strahler order), 'deeper' (per pixel) or 'priority' (higher 'priority' column)")
+	flags.StringVar(&dbPath, "db", "", "Path to the reach database with table 'network', needed for -precedence downstream and stream_order")
+	flags.StringVar(&opts.product, "product", productDepth, "Output product: 'depth' (library values) or 'wse' (water surface elevation, DEM + depth, needs -dem)")
+	flags.StringVar(&opts.dem, "dem", "", "DEM for -product wse, resampled to the library grid. GDAL VSI paths can be used")
+	flags.StringVar(&opts.verticalDatum, "vdatum", "", "Vertical datum written to WSE output metadata e.g. 'NAVD88'. Defaults to the vertical datum of the DEM coordinate system")
+	flags.Float64Var(&opts.cleanup.minDepth, "min_depth", 0, "Depths below this value are dry in the output, the library is not changed")
+	flags.IntVar(&opts.cleanup.minCluster, "min_cluster", 0, "Wet clusters (8-connected) with fewer pixels than this are dry in the output")
+	flags.IntVar(&opts.cleanup.fillHoles, "fill_holes", 0, "Dry holes (4-connected, enclosed by wet pixels) with at most this many pixels are filled with the mean depth around them")
+	flags.StringVar(&opts.qa.file, "qa", "", "Optional output GeoJSON of seams and gaps between reaches, with a '<name>_summary.csv' of counts per reach pair")
+	flags.Float64Var(&opts.qa.threshold, "qa_threshold", 1, "Depth difference across a reach boundary above which -qa reports a seam")
+	flags.IntVar(&opts.qa.gap, "qa_gap", 2, "Widest dry sliver in pixels between wet pixels of different reaches that -qa reports as a gap")
+	flags.IntVar(&opts.concurrent, "cc", 25, "Concurrent Count, number of library folders to list or FIMs to read concurrently")
+	flags.StringVar(&batchFile, "batch", "", "Batch mode. Manifest CSV (columns controls,output) or JSON ([{\"controls\": ..., \"output\": ...}]), or a directory or glob of controls files. -c is ignored")
+	flags.IntVar(&jobs, "jobs", 4, "Number of composites to build concurrently in batch mode")
+	flags.StringVar(&summaryFile, "o_summary", "", "Optional output CSV with success or failure of each job in batch mode")
+	flags.StringVar(&classesStr, "classes", "", "Comma-separated ascending depth class breaks e.g. '1,3,6'. If given, output is a Byte raster of classes with a color table and category names")
+	flags.StringVar(&ensembleFiles, "ensemble", "", "Ensemble mode. Directory or glob of member controls files. -o is a raster of fraction of members flooding each pixel. -c is ignored")
+	flags.BoolVar(&eopts.count, "count", false, "If true, ensemble output is count of members flooding each pixel instead of fraction")
+	flags.StringVar(&eopts.maxFile, "o_max", "", "Optional output raster of max depth across ensemble members or time steps")
+	flags.StringVar(&eopts.medianFile, "o_median", "", "Optional output raster of median depth across ensemble members, dry members count as 0")
+	flags.StringVar(&timeSeries, "timeseries", "", "Time series mode. Long controls CSV with a 'time' column, or a directory or glob of controls files with the time in their names. -o is a NetCDF (.nc) or Zarr (.zarr) cube. -c is ignored")
+	flags.StringVar(&topts.arrivalFile, "o_arrival", "", "Optional output raster of hours from the first time step to the first step each pixel is wet, in time series mode")
+	flags.StringVar(&topts.durationFile, "o_duration", "", "Optional output raster of hours each pixel is wet, in time series mode. Each step lasts until the next one, the last step as long as the one before")
+	opts.creation.RegisterFlags(flags)
+	opts.tiles.RegisterFlags(flags)
 
 	// Parse flags from the arguments
 	if err := flags.Parse(args); err != nil {
 		return []string{}, fmt.Errorf("error parsing flags: %v", err)
 	}
 
-	outputFormat = strings.ToUpper(outputFormat) // COG, cog, VRT, vrt all okay
+	opts.outputFormat = strings.ToUpper(opts.outputFormat) // COG, cog, VRT, vrt all okay
 
 	// Validate required flags
-	if controlsFile == "" || fimLibDir == "" || outputFile == "" {
-		fmt.Println(controlsFile, fimLibDir, outputFile)
+	if batchFile == "" && ensembleFiles == "" && timeSeries == "" && (opts.controlsFile == "" || opts.fimLibDir == "" || opts.outputFile == "") ||
+		batchFile != "" && opts.fimLibDir == "" ||
+		ensembleFiles != "" && (opts.fimLibDir == "" || opts.outputFile == "") ||
+		timeSeries != "" && (opts.fimLibDir == "" || opts.outputFile == "" && eopts.maxFile == "" && topts.arrivalFile == "" && topts.durationFile == "") {
+		fmt.Println(opts.controlsFile, opts.fimLibDir, opts.outputFile)
 		fmt.Println("Missing required flags")
 		flags.PrintDefaults()
 		return []string{}, fmt.Errorf("missing required flags")
 	}
 
+	mode := ""
+	switch {
+	case timeSeries != "":
+		mode = "in time series mode"
+	case ensembleFiles != "":
+		mode = "in ensemble mode"
+	case batchFile != "":
+		mode = "in batch mode"
+	}
+	if err := checkUnsupported(flags, mode); err != nil {
+		return []string{}, err
+	}
+
+	opts.missingPolicy = strings.ToLower(opts.missingPolicy)
+	if opts.missingPolicy == "" {
+		opts.missingPolicy = defaultMissingPolicy(opts.fimLibDir)
+	}
+	if !utils.SliceContains([]string{library.MissingFail, library.MissingSkip, library.MissingNearest, library.MissingNone}, opts.missingPolicy) {
+		return []string{}, fmt.Errorf("invalid missing policy '%s', must be 'fail', 'skip', 'nearest' or 'none'", opts.missingPolicy)
+	}
+
+	if err := opts.creation.Validate(); err != nil {
+		return []string{}, err
+	}
+
+	opts.product = strings.ToLower(opts.product)
+	switch opts.product {
+	case productDepth:
+		if opts.dem != "" || opts.verticalDatum != "" {
+			return []string{}, fmt.Errorf("-dem and -vdatum are only used with -product wse")
+		}
+	case productWSE:
+		if opts.dem == "" {
+			return []string{}, fmt.Errorf("-product wse needs -dem")
+		}
+		if opts.outputFormat != "COG" && opts.outputFormat != "GTIFF" {
+			return []string{}, fmt.Errorf("-product wse computes the composite, use -fmt COG or GTIFF")
+		}
+		if strings.EqualFold(libType, "extent") {
+			return []string{}, fmt.Errorf("-product wse needs a depth library")
+		}
+		if err := checkUnsupported(flags, "with -product wse"); err != nil {
+			return []string{}, err
+		}
+	default:
+		return []string{}, fmt.Errorf("invalid product '%s', must be 'depth' or 'wse'", opts.product)
+	}
+
+	if err := opts.cleanup.validate(); err != nil {
+		return []string{}, err
+	}
+	if opts.cleanup.active() && opts.outputFormat == "VRT" {
+		return []string{}, fmt.Errorf("-min_depth, -min_cluster and -fill_holes compute the composite, use -fmt COG, GTIFF or XYZ")
+	}
+	if opts.qa.file != "" && (opts.qa.threshold < 0 || opts.qa.gap < 1) {
+		return []string{}, fmt.Errorf("-qa_threshold must be 0 or more and -qa_gap 1 or more")
+	}
+	if !utils.SliceContains(library.Precedences, opts.precedence) {
+		return []string{}, fmt.Errorf("invalid precedence '%s', must be one of %s", opts.precedence, strings.Join(library.Precedences, ", "))
+	}
+	if opts.precedence == library.PrecedenceDeeper && opts.outputFormat == "VRT" {
+		return []string{}, fmt.Errorf("-precedence deeper computes the composite, use -fmt COG, GTIFF or XYZ")
+	}
+	if library.NeedsNetwork(opts.precedence) {
+		if dbPath == "" {
+			return []string{}, fmt.Errorf("-precedence %s needs the reach database, set -db", opts.precedence)
+		}
+		if opts.network, err = library.ReadNetwork(dbPath); err != nil {
+			return []string{}, err
+		}
+	}
+
+	if opts.bundle != "" {
+		if opts.outputFormat != "VRT" {
+			return []string{}, fmt.Errorf("-bundle is only supported for VRT output")
+		}
+		if utils.IsVSI(opts.bundle) && !isZip(opts.bundle) {
+			return []string{}, fmt.Errorf("bundle directory can not be a VSI path, use a .zip bundle")
+		}
+	}
+
+	if opts.outputFormat == "XYZ" {
+		if err := opts.tiles.Validate(); err != nil {
+			return []string{}, err
+		}
+		if utils.IsVSI(opts.outputFile) {
+			return []string{}, fmt.Errorf("XYZ output can not be written to a VSI path")
+		}
+	}
+
+	if opts.classes, err = parseClasses(classesStr); err != nil {
+		return []string{}, err
+	}
+	if len(opts.classes) > 0 && (opts.creation.DataType != "" || opts.creation.Scale != 0) {
+		return []string{}, fmt.Errorf("-ot and -scale can not be used with -classes, classified output is always Byte")
+	}
+	if len(opts.classes) > 0 && opts.withDomain {
+		return []string{}, fmt.Errorf("-classes can not be used with -with_domain, domain pixels would be classified as nodata")
+	}
+
 	// Check if required GDAL tools are available
-	requiredTools := []string{"gdalbuildvrt"}
-	if outputFormat != "VRT" {
+	// In batch mode this is done once for all jobs
+	requiredTools := append([]string{"gdalbuildvrt"}, opts.creation.RequiredTools(opts.outputFormat)...)
+	computed := opts.precedence == library.PrecedenceDeeper || opts.cleanup.active() || opts.product == productWSE
+	if (opts.statsFile != "" || opts.attribution != "" || computed) && !utils.SliceContains(requiredTools, "gdal_translate") {
 		requiredTools = append(requiredTools, "gdal_translate")
 	}
+	if opts.attribution != "" || opts.qa.file != "" || computed {
+		requiredTools = append(requiredTools, "gdalinfo")
+	}
+	if opts.qa.file != "" {
+		requiredTools = append(requiredTools, "gdaltransform")
+	}
+	if opts.product == productWSE {
+		requiredTools = append(requiredTools, "gdalwarp")
+	}
+	if ensembleFiles != "" || timeSeries != "" {
+		requiredTools = append(requiredTools, "gdalinfo")
+	}
+	if timeSeries != "" && opts.outputFile != "" {
+		requiredTools = append(requiredTools, utils.CubeRequiredTools(opts.outputFile)...)
+	}
+	if opts.outputFormat == "XYZ" {
+		requiredTools = append(requiredTools, utils.TileRequiredTools(opts.outputFile)...)
+	}
+	if utils.IsVSI(opts.outputFile) || opts.bundle != "" && (utils.IsVSI(opts.bundle) || strings.HasPrefix(opts.fimLibDir, "/vsi")) {
+		requiredTools = append(requiredTools, utils.GDALCPName)
+	}
+	if strings.HasPrefix(opts.fimLibDir, "/vsi") && opts.missingPolicy != library.MissingNone {
+		if !utils.CheckGDALToolAvailable(utils.GDALLSName) {
+			return []string{}, fmt.Errorf(`%[1]s is not available. It is needed to check for missing FIMs in VSI libraries.
+		Please refer to docs for instructions on how to add it to Path or use '-missing none' to skip the check`, utils.GDALLSName)
+		}
+	}
 
 	for _, tool := range requiredTools {
 		if !utils.CheckGDALToolAvailable(tool) {
@@ -87,113 +357,283 @@ func Run(args []string) (gdalArgs []string, err error) {
 		}
 	}
 
-	var absOutputPath, absFimLibPath string
-	if strings.HasPrefix(outputFile, "/vsi") {
-		absOutputPath = outputFile
-	} else {
-		absOutputPath, err = filepath.Abs(outputFile)
+	if timeSeries != "" {
+		if opts.outputFile != "" {
+			if _, err := utils.CubeFormat(opts.outputFile); err != nil {
+				return []string{}, err
+			}
+		}
+		topts.maxFile = eopts.maxFile
+		if topts.hasRasters() && opts.outputFormat != "COG" && opts.outputFormat != "GTIFF" {
+			return []string{}, fmt.Errorf("time series max, arrival and duration outputs are computed rasters, use -fmt COG or GTiff")
+		}
+		steps, cleanup, err := timeSteps(timeSeries)
+		defer cleanup()
 		if err != nil {
-			return []string{}, fmt.Errorf("error getting absolute path for output file: %v", err)
+			return []string{}, err
 		}
+		return []string{}, runTimeSeries(steps, opts, topts)
 	}
 
+	if ensembleFiles != "" {
+		if opts.outputFormat != "COG" && opts.outputFormat != "GTIFF" {
+			return []string{}, fmt.Errorf("ensemble outputs are computed rasters, use -fmt COG or GTiff")
+		}
+		members, err := ensembleMembers(ensembleFiles)
+		if err != nil {
+			return []string{}, err
+		}
+		return []string{}, runEnsemble(members, opts, eopts)
+	}
+
+	if batchFile != "" {
+		batchJobs, err := readManifest(batchFile, opts.outputFile, opts.outputFormat)
+		if err != nil {
+			return []string{}, err
+		}
+		return []string{}, runBatch(batchJobs, opts, jobs, summaryFile)
+	}
+
+	if _, err := build(opts, library.NewListing()); err != nil {
+		return []string{}, err
+	}
+
+	return gdalArgs, nil
+}
+
+// defaultMissingPolicy returns the missing policy used when -missing is not given. VSI libraries are not checked,
+// listing them needs gdal_ls which earlier versions did not require.
+func defaultMissingPolicy(fimLibDir string) string {
 	if strings.HasPrefix(fimLibDir, "/vsi") {
-		absFimLibPath = fimLibDir
+		return library.MissingNone
+	}
+	return library.MissingFail
+}
+
+// build creates a single composite FIM. The library listing is shared between builds in batch mode.
+// It returns the missing FIM records, which are empty if missing policy is none.
+func build(opts options, listing *library.Listing) (report []library.MissingRecord, err error) {
+	// Outputs to VSI paths are written locally and uploaded once complete
+	stage, err := utils.NewOutputStage(opts.outputFile)
+	if err != nil {
+		return nil, err
+	}
+	defer stage.Cleanup()
+	absOutputPath := stage.Path
+
+	var absFimLibPath string
+	if strings.HasPrefix(opts.fimLibDir, "/vsi") {
+		absFimLibPath = opts.fimLibDir
 	} else {
-		absFimLibPath, err = filepath.Abs(fimLibDir)
+		absFimLibPath, err = filepath.Abs(opts.fimLibDir)
 		if err != nil {
-			return []string{}, fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+			return nil, fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
 		}
 	}
 
-	// Processing CSV
-	file, err := os.Open(controlsFile)
+	entries, err := library.ReadControls(opts.controlsFile, absFimLibPath)
 	if err != nil {
-		return []string{}, fmt.Errorf("error opening controls file: %v", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return []string{}, fmt.Errorf("error reading CSV file: %v", err)
+	if opts.missingPolicy != library.MissingNone {
+		entries, report, err = library.ResolveMissing(entries, opts.missingPolicy, listing, opts.concurrent)
+		if opts.missingReport != "" { // written even when empty to keep API consistent
+			if werr := library.WriteMissingReport(report, opts.missingReport); werr != nil {
+				return report, fmt.Errorf("error writing missing FIMs report: %v", werr)
+			}
+			fmt.Printf("Missing FIMs report created at %s\n", opts.missingReport)
+		}
+		if err != nil {
+			return report, err
+		}
+		if len(entries) == 0 {
+			return report, fmt.Errorf("none of the FIMs referenced in controls file are available in library")
+		}
 	}
 
-	if len(records) < 2 {
-		return []string{}, fmt.Errorf("no records in control file")
+	if interpolated := countInterpolated(entries); interpolated > 0 {
+		if stage.IsVSI() && opts.outputFormat == "VRT" {
+			return report, fmt.Errorf("VRT outputs to VSI paths can not reference interpolated FIMs, use -fmt COG or GTiff")
+		}
+		for _, tool := range []string{"gdal_translate", "gdalinfo"} {
+			if !utils.CheckGDALToolAvailable(tool) {
+				return report, fmt.Errorf("%[1]s is not available. It is needed to interpolate FIMs. Please install GDAL and ensure %[1]s is in your PATH", tool)
+			}
+		}
+		dir, temporary, err := interpolationDir(absOutputPath, opts.outputFormat)
+		if err != nil {
+			return report, fmt.Errorf("error creating folder for interpolated FIMs: %v", err)
+		}
+		if temporary {
+			defer os.RemoveAll(dir)
+		}
+		if err := blendEntries(entries, dir, opts.concurrent); err != nil {
+			return report, err
+		}
+		slog.Debug("Interpolated FIMs", "count", interpolated, "folder", dir)
+	}
+
+	if err := library.OrderEntries(entries, opts.precedence, opts.network); err != nil {
+		return report, err
 	}
 
 	var domainFiles, fimFiles []string
-	for _, record := range records[1:] { // Skip header row
-		reachID := record[0]
+	for _, e := range entries {
+		fimFiles = append(fimFiles, e.Path)
+		if opts.withDomain {
+			domainFiles = append(domainFiles, e.DomainPath)
+		}
+	}
+
+	// Outputs computed from the composite share one mosaic of the FIMs, which are read once
+	var comp *composite
+	var compRows compositeRows // composite after cleanup
+	var srsWKT string
+	deeper := opts.precedence == library.PrecedenceDeeper
+	if deeper || opts.cleanup.active() || opts.statsFile != "" || opts.attribution != "" || opts.qa.file != "" || opts.product == productWSE {
+		info, err := utils.GDALInfo(fimFiles[0])
+		if err != nil {
+			return report, err
+		}
+		srsWKT = info.CoordinateSystem.WKT
+		mosaic, err := utils.OpenMosaic(fimFiles, opts.concurrent)
+		if err != nil {
+			return report, err
+		}
+		defer mosaic.Close()
+		comp = newComposite(mosaic, deeper)
+		compRows = comp
+	}
 
-		record[2] = strings.Replace(record[2], ".", "_", -1) // Replace '.' with '_'
-		folderPath := filepath.Join(absFimLibPath, reachID, fmt.Sprintf("z_%s", record[2]))
-		fileName := fmt.Sprintf("f_%s.tif", record[1])
-		absFIMPath := filepath.Join(folderPath, fileName)
-		absDomainPath := filepath.Join(absFimLibPath, reachID, "domain.tif")
+	// With precedence deeper or cleanup the composite is computed and replaces the FIMs
+	if deeper || opts.cleanup.active() {
+		name := "deeper.tif"
+		if opts.cleanup.active() {
+			if compRows, err = cleanComposite(comp, opts.cleanup); err != nil {
+				return report, err
+			}
+			name = "clean.tif"
+		}
+		dir, err := os.MkdirTemp("", "f2f_composite_*")
+		if err != nil {
+			return report, fmt.Errorf("error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		compositePath := filepath.Join(dir, name)
+		if err := utils.WriteRows(compRows, srsWKT, compositePath, "GTiff", utils.CreationOptions{Compress: "LZW"}); err != nil {
+			return report, err
+		}
+		fimFiles = []string{compositePath}
+	}
 
-		// join on windows may cause \vsi
-		if strings.HasPrefix(absFIMPath, `\vsi`) {
-			absDomainPath = strings.ReplaceAll(absDomainPath, `\`, "/")
-			absFIMPath = strings.ReplaceAll(absFIMPath, `\`, "/")
+	if opts.statsFile != "" {
+		reachStats, compositeStats, err := computeStats(compRows, entries)
+		if err != nil {
+			return report, err
+		}
+		if err := writeStats(reachStats, compositeStats, opts.statsFile); err != nil {
+			return report, fmt.Errorf("error writing statistics: %v", err)
 		}
+		fmt.Printf("Inundation statistics created at %s\n", opts.statsFile)
+	}
 
-		fimFiles = append(fimFiles, absFIMPath)
-		if withDomain {
-			domainFiles = append(domainFiles, absDomainPath)
+	if opts.attribution != "" {
+		if err := writeAttribution(compRows, entries, domainFiles, srsWKT, opts.attribution, opts); err != nil {
+			return report, err
 		}
 	}
 
+	if opts.qa.file != "" {
+		if err := writeQA(comp, entries, srsWKT, opts); err != nil {
+			return report, err
+		}
+	}
+
+	// WSE replaces depth after statistics, attribution and QA which are about depth
+	creation := opts.creation
+	if opts.product == productWSE {
+		dir, err := os.MkdirTemp("", "f2f_wse_*")
+		if err != nil {
+			return report, fmt.Errorf("error creating temp directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		wsePath := filepath.Join(dir, "wse.tif")
+		demDatum, err := wseComposite(compRows, srsWKT, opts.dem, wsePath)
+		if err != nil {
+			return report, err
+		}
+		fimFiles = []string{wsePath}
+
+		verticalDatum := opts.verticalDatum
+		if verticalDatum == "" {
+			verticalDatum = demDatum
+		}
+		if verticalDatum == "" {
+			slog.Warn("DEM has no vertical datum, set -vdatum to tag WSE output")
+			verticalDatum = "unknown"
+		}
+		creation.Metadata = append(append([]string{}, creation.Metadata...), "PRODUCT=wse", "VERTICAL_DATUM="+verticalDatum)
+	}
+
 	// Write file paths to a temporary file
 	inputFileListPath, err := utils.WriteListToTempFile(append(domainFiles, fimFiles...))
 	if err != nil {
-		return []string{}, fmt.Errorf("error writing file list to temporary file: %v", err)
+		return report, fmt.Errorf("error writing file list to temporary file: %v", err)
 	}
 	defer os.Remove(inputFileListPath)
 
 	tempVRTPath, err := utils.CreateTempVRT(inputFileListPath, absOutputPath)
 	if err != nil {
-		return []string{}, fmt.Errorf("error creating temp vrt: %v", err)
+		return report, fmt.Errorf("error creating temp vrt: %v", err)
 	}
 	defer os.Remove(tempVRTPath)
 
-	if outputFormat == "VRT" {
+	if len(opts.classes) > 0 {
+		// Derived VRT, sources are kept and their values are mapped to classes
+		ds, err := utils.ReadVRT(tempVRTPath)
+		if err != nil {
+			return report, err
+		}
+		classifyVRT(ds, opts.classes)
+		if err := utils.WriteVRT(tempVRTPath, ds); err != nil {
+			return report, err
+		}
+	}
+
+	if opts.outputFormat == "VRT" {
 		// For VRT, simply move the temporary file to the final destination for atomicity
 		slog.Debug("Moving temporary VRT to final destination",
 			"from", tempVRTPath,
 			"to", absOutputPath)
 
 		if err := os.Rename(tempVRTPath, absOutputPath); err != nil {
-			return []string{}, fmt.Errorf("error renaming temp file %s to %s: %v", tempVRTPath, absOutputPath, err)
+			return report, fmt.Errorf("error renaming temp file %s to %s: %v", tempVRTPath, absOutputPath, err)
+		}
+
+	} else if opts.outputFormat == "XYZ" {
+		if err := utils.RenderTiles(tempVRTPath, absOutputPath, opts.tiles, utils.DepthRamp, len(opts.classes) > 0); err != nil {
+			return report, err
 		}
 
 	} else {
 		// For TIF or COG, use gdal_translate to convert the VRT
-		translateArgs := []string{
-			"-co", "COMPRESS=LZW",
-			"-co", "NUM_THREADS=ALL_CPUS",
-			"-of", outputFormat,
-			tempVRTPath,
-			absOutputPath,
+		if err := utils.Translate(tempVRTPath, absOutputPath, opts.outputFormat, creation); err != nil {
+			return report, err
 		}
+	}
 
-		translateCmd := exec.Command("gdal_translate", translateArgs...)
-		translateCmd.Stdout = os.Stdout
-		translateCmd.Stderr = os.Stderr
-
-		slog.Debug(fmt.Sprintf("Converting VRT to %s", outputFormat),
-			"command", fmt.Sprintf("gdal_translate %s", strings.Join(translateArgs, " ")),
-			"format", outputFormat,
-		)
-
-		if err := translateCmd.Run(); err != nil {
-			return []string{}, fmt.Errorf("error converting VRT to %s: %v", outputFormat, err)
+	if opts.bundle != "" {
+		if err := writeBundle(absOutputPath, opts.controlsFile, absFimLibPath, opts.bundle, opts.concurrent); err != nil {
+			return report, err
 		}
-
+		fmt.Printf("Bundle created at %s\n", opts.bundle)
 	}
 
+	if absOutputPath, err = stage.Commit(); err != nil {
+		return report, err
+	}
 	fmt.Printf("Composite FIM created at %s\n", absOutputPath)
 
-	return gdalArgs, nil
+	return report, nil
 }
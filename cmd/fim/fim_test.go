@@ -1,5 +1,49 @@
 package fim
 
+import (
+	"flag"
+	"testing"
+)
+
+func TestCheckUnsupported(t *testing.T) {
+	tests := []struct {
+		args    []string
+		mode    string
+		wantErr string
+	}{
+		{[]string{"-classes", "1,2", "-qa", "qa.geojson", "-o_max", "max.tif"}, "in ensemble mode", "-classes and -qa are not supported in ensemble mode"},
+		{[]string{"-with_domain", "-classes", "1", "-o_stats", "s.csv"}, "in time series mode", "-with_domain, -classes and -o_stats are not supported in time series mode"},
+		{[]string{"-classes", "1"}, "with -product wse", "-classes is not supported with -product wse"},
+		{[]string{"-with_domain=false", "-precedence", "controls", "-qa", "qa.geojson"}, "in ensemble mode", "-qa is not supported in ensemble mode"},
+		{[]string{"-with_domain=false", "-precedence", "controls"}, "in ensemble mode", ""},
+		{[]string{"-qa", "qa.geojson"}, "", ""},
+	}
+	for _, tt := range tests {
+		flags := flag.NewFlagSet("fim", flag.ContinueOnError)
+		flags.Bool("with_domain", false, "")
+		flags.String("classes", "", "")
+		flags.String("qa", "", "")
+		flags.String("o_max", "", "")
+		flags.String("o_stats", "", "")
+		flags.String("precedence", "controls", "")
+		if err := flags.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		err := checkUnsupported(flags, tt.mode)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("checkUnsupported(%v, %q) = %v, want %q", tt.args, tt.mode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDefaultMissingPolicy(t *testing.T) {
+	for dir, want := range map[string]string{"/data/library": "fail", "/vsis3/bucket/library": "none"} {
+		if got := defaultMissingPolicy(dir); got != want {
+			t.Errorf("defaultMissingPolicy(%s) = %s, want %s", dir, got, want)
+		}
+	}
+}
+
 // import (
 // 	"reflect"
 // 	"testing"
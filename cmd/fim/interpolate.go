@@ -0,0 +1,135 @@
+package fim
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// interpolationNoData is used for blended FIMs when the lower FIM has no nodata value
+const interpolationNoData = -9999
+
+// interpolationDir returns the folder of blended FIMs of an output.
+// VRT outputs reference blended FIMs so they are kept next to the output, other outputs use a temporary folder.
+func interpolationDir(absOutputPath, outputFormat string) (dir string, temporary bool, err error) {
+	if outputFormat == "VRT" {
+		base := strings.TrimSuffix(absOutputPath, filepath.Ext(absOutputPath))
+		return base + "_interp", false, os.MkdirAll(base+"_interp", 0755)
+	}
+	dir, err = os.MkdirTemp("", "f2f_interp_*")
+	return dir, true, err
+}
+
+// countInterpolated returns the number of entries that blend two bracketing FIMs
+func countInterpolated(entries []library.Entry) int {
+	n := 0
+	for _, e := range entries {
+		if e.Interpolated() {
+			n++
+		}
+	}
+	return n
+}
+
+// blendEntries writes a blended FIM for each interpolated entry into dir and points the entry to it.
+// At most concurrent entries are blended at a time.
+func blendEntries(entries []library.Entry, dir string, concurrent int) error {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i := range entries {
+		if !entries[i].Interpolated() {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(e *library.Entry, i int) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+
+			dst := filepath.Join(dir, fmt.Sprintf("%s_z_%s_f_%s_%s_w_%g.tif", e.ReachID, e.ControlStage, e.Flow, e.UpperFlow, e.Weight))
+			if err := blendFIM(*e, dst); err != nil {
+				errs[i] = fmt.Errorf("error interpolating reach %s: %v", e.ReachID, err)
+				return
+			}
+			e.Path = dst
+		}(&entries[i], i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blendFIM writes the weighted blend of the lower and upper FIMs of an entry as a GTiff
+func blendFIM(e library.Entry, dstPath string) error {
+	rasters, err := utils.ReadRasters([]string{e.Path, e.UpperPath}, 2)
+	if err != nil {
+		return err
+	}
+	info, err := utils.GDALInfo(e.Path)
+	if err != nil {
+		return err
+	}
+	mosaic, err := utils.NewMosaic(rasters)
+	if err != nil {
+		return err
+	}
+
+	noData := float64(interpolationNoData)
+	if rasters[0].HasNoData {
+		noData = rasters[0].NoData
+	}
+
+	blended, err := blendMosaic(mosaic, e.Weight, noData)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Blended FIMs", "reach_id", e.ReachID, "flow", e.Flow, "upper_flow", e.UpperFlow, "weight", e.Weight)
+	return utils.WriteRaster(blended, info.CoordinateSystem.WKT, dstPath, "GTiff", utils.CreationOptions{Compress: "LZW"})
+}
+
+// blendMosaic blends raster 0 (lower) and raster 1 (upper) of a mosaic as (1 - weight) * lower + weight * upper.
+// Where only one of them has data the other counts as dry (0 depth), pixels without data in both are nodata.
+func blendMosaic(mosaic *utils.Mosaic, weight, noData float64) (*utils.Raster, error) {
+	grid := mosaic.Grid
+	blended := mosaic.NewRaster(noData)
+
+	lower, upper := make([]float32, grid.Width), make([]float32, grid.Width)
+	srcLower, srcUpper := make([]int, grid.Width), make([]int, grid.Width)
+	for y := 0; y < grid.Height; y++ {
+		for x := range lower {
+			lower[x], upper[x], srcLower[x], srcUpper[x] = 0, 0, -1, -1
+		}
+		if err := mosaic.CompositeRow(y, []int{0}, lower, srcLower); err != nil {
+			return nil, err
+		}
+		if err := mosaic.CompositeRow(y, []int{1}, upper, srcUpper); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < grid.Width; x++ {
+			if srcLower[x] == -1 && srcUpper[x] == -1 {
+				continue
+			}
+			l, u := math.Max(float64(lower[x]), 0), math.Max(float64(upper[x]), 0)
+			blended.Data[y*grid.Width+x] = float32((1-weight)*l + weight*u)
+		}
+	}
+	return blended, nil
+}
@@ -0,0 +1,29 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestBlendMosaic(t *testing.T) {
+	const nd = -9999
+	gt := [6]float64{0, 1, 0, 1, 0, -1}
+	lower := &utils.Raster{Width: 3, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{2, nd, nd}}
+	// Upper FIM is one pixel wider, as higher flows usually flood more
+	upper := &utils.Raster{Width: 4, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{4, 2, nd, 1}}
+
+	mosaic, err := utils.NewMosaic([]*utils.Raster{lower, upper})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+
+	got, err := blendMosaic(mosaic, 0.25, nd)
+	if err != nil {
+		t.Fatalf("blendMosaic() error = %v", err)
+	}
+	if want := []float32{2.5, 0.5, nd, 0.25}; !reflect.DeepEqual(got.Data, want) {
+		t.Errorf("blendMosaic() = %v, want %v", got.Data, want)
+	}
+}
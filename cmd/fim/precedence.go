@@ -0,0 +1,64 @@
+package fim
+
+import (
+	"flows2fim/pkg/utils"
+)
+
+// deeperNoData is used for computed composites when the first FIM has no nodata value
+const deeperNoData = -9999
+
+// compositeRows is a composite computed one row at a time that knows the FIM providing each pixel
+type compositeRows interface {
+	utils.RasterRows
+	// read writes row y into dst, src receives the mosaic raster that provides each pixel, -1 where none does
+	read(y int, dst []float32, src []int) error
+}
+
+// composite computes the composite of library FIMs one row at a time from a mosaic of the FIMs in precedence order.
+// The FIMs are read once into the mosaic and shared by every output computed from the composite.
+// With deeper set a pixel is the deepest value of all FIMs, otherwise the value of the last FIM with data, the same as a VRT.
+// It is not safe for concurrent use.
+type composite struct {
+	mosaic *utils.Mosaic
+	idxs   []int // all mosaic rasters
+	deeper bool
+	grid   utils.RasterHeader
+
+	row []float32
+	src []int
+}
+
+// newComposite returns the composite of all rasters of mosaic, with the nodata of the first raster
+func newComposite(mosaic *utils.Mosaic, deeper bool) *composite {
+	idxs := make([]int, len(mosaic.Rasters))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	grid := mosaic.Grid
+	grid.NoData, grid.HasNoData = mosaic.NoData(deeperNoData), true
+	return &composite{mosaic: mosaic, idxs: idxs, deeper: deeper, grid: grid, row: make([]float32, grid.Width), src: make([]int, grid.Width)}
+}
+
+// Header returns the grid and nodata of the composite
+func (c *composite) Header() utils.RasterHeader {
+	return c.grid
+}
+
+// Row returns row y of the composite, the values are overwritten by the next call to Row
+func (c *composite) Row(y int) ([]float32, error) {
+	return c.row, c.read(y, c.row, c.src)
+}
+
+// read writes row y of the composite into dst, nodata where no FIM has data.
+// src receives the mosaic raster that provides each pixel, -1 where no FIM has data.
+func (c *composite) read(y int, dst []float32, src []int) error {
+	noData := float32(c.grid.NoData)
+	for x := range dst {
+		dst[x] = noData
+		src[x] = -1
+	}
+	if c.deeper {
+		return c.mosaic.MaxRow(y, c.idxs, dst, src)
+	}
+	return c.mosaic.CompositeRow(y, c.idxs, dst, src)
+}
@@ -0,0 +1,40 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestComposite(t *testing.T) {
+	const nd = -9999
+	gt := [6]float64{0, 1, 0, 1, 0, -1}
+	a := &utils.Raster{Width: 3, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{1, 3, nd}}
+	b := &utils.Raster{Width: 3, Height: 1, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{2, 1, nd}}
+
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	for _, tt := range []struct {
+		deeper  bool
+		want    []float32
+		wantSrc []int
+	}{
+		{false, []float32{2, 1, nd}, []int{1, 1, -1}},
+		{true, []float32{2, 3, nd}, []int{1, 0, -1}},
+	} {
+		c := newComposite(mosaic, tt.deeper)
+		if h := c.Header(); !h.HasNoData || h.NoData != nd {
+			t.Errorf("Header() nodata = %v, want %v", h.NoData, nd)
+		}
+		row, src := make([]float32, 3), make([]int, 3)
+		if err := c.read(0, row, src); err != nil {
+			t.Fatalf("read() error = %v", err)
+		}
+		if !reflect.DeepEqual(row, tt.want) || !reflect.DeepEqual(src, tt.wantSrc) {
+			t.Errorf("read() with deeper %v = %v from %v, want %v from %v", tt.deeper, row, src, tt.want, tt.wantSrc)
+		}
+	}
+}
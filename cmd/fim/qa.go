@@ -0,0 +1,269 @@
+package fim
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// Kinds of QA findings
+const (
+	qaSeam = "seam" // depth discontinuity between wet pixels of adjacent reaches
+	qaGap  = "gap"  // dry sliver between wet pixels of adjacent reaches
+)
+
+// qaMaxPoints caps the number of pixel locations kept per finding, counts are not capped
+const qaMaxPoints = 1000
+
+// qaOptions holds the settings of the composite QA
+type qaOptions struct {
+	file      string
+	threshold float64
+	gap       int
+}
+
+// qaFinding is a seam or gap between a pair of reaches, reachA sorts before reachB
+type qaFinding struct {
+	kind          string
+	reachA        string
+	reachB        string
+	pixels        int
+	maxDifference float64      // largest depth difference across the boundary, seams only
+	maxWidth      int          // widest dry sliver in pixels, gaps only
+	points        [][2]float64 // pixel locations in the coordinate system of the FIMs
+}
+
+// qaSummaryPath returns the path of the summary CSV of a QA findings layer
+func qaSummaryPath(qaPath string) string {
+	return strings.TrimSuffix(qaPath, filepath.Ext(qaPath)) + "_summary.csv"
+}
+
+// writeQA checks the composite c of entries for seams and gaps between reaches, and writes the findings
+// as a GeoJSON layer of MultiPoints (one feature per kind and reach pair) and a summary CSV.
+// srsWKT is the coordinate system of the FIMs.
+func writeQA(c *composite, entries []library.Entry, srsWKT string, opts options) error {
+	if srsWKT == "" {
+		return fmt.Errorf("QA needs FIMs with a coordinate system")
+	}
+
+	findings, err := detectQA(c, entries, opts.qa.threshold, opts.qa.gap)
+	if err != nil {
+		return err
+	}
+
+	// Locations of all findings are transformed in one call
+	var coords [][2]float64
+	for _, f := range findings {
+		coords = append(coords, f.points...)
+	}
+	lonLats, err := utils.TransformToWGS84(coords, srsWKT)
+	if err != nil {
+		return err
+	}
+
+	features := make([]utils.Feature, 0, len(findings))
+	for i, f := range findings {
+		n := len(f.points)
+		features = append(features, utils.Feature{
+			ID:         strconv.Itoa(i + 1),
+			Properties: f.properties(),
+			Geometry:   utils.Geometry{Type: "MultiPoint", Rings: [][][2]float64{lonLats[:n]}},
+		})
+		lonLats = lonLats[n:]
+	}
+	if err := utils.WriteGeoJSON(opts.qa.file, features); err != nil {
+		return fmt.Errorf("error writing QA findings: %v", err)
+	}
+
+	summaryPath := qaSummaryPath(opts.qa.file)
+	if err := writeQASummary(findings, summaryPath); err != nil {
+		return fmt.Errorf("error writing QA summary: %v", err)
+	}
+
+	seams, gaps := 0, 0
+	for _, f := range findings {
+		if f.kind == qaSeam {
+			seams += f.pixels
+		} else {
+			gaps += f.pixels
+		}
+	}
+	fmt.Printf("QA found %d seam pixel edges and %d gap pixels between %d reach pairs, findings at %s with summary %s\n",
+		seams, gaps, len(findings), opts.qa.file, summaryPath)
+	return nil
+}
+
+// properties returns the GeoJSON properties of a finding
+func (f qaFinding) properties() map[string]interface{} {
+	props := map[string]interface{}{"kind": f.kind, "reach_a": f.reachA, "reach_b": f.reachB, "pixels": f.pixels}
+	if f.kind == qaSeam {
+		props["max_difference"], _ = strconv.ParseFloat(strconv.FormatFloat(f.maxDifference, 'f', -1, 32), 64) // drop float32 noise
+	} else {
+		props["max_width"] = f.maxWidth
+	}
+	return props
+}
+
+// detectQA finds seams and gaps in the composite c, whose rasters are entries.
+// A seam is a pair of 4-neighbour wet pixels from different reaches whose values differ by more than threshold,
+// located at the middle of the shared pixel edge. A gap is a run of at most maxGap dry pixels in a row or column
+// with wet pixels of different reaches at both ends, each dry pixel is counted once and gaps along rows are counted first.
+// Pixels are wet if they have data above 0. Findings are sorted by kind and reach pair.
+// Rows are read one at a time, only the previous row and the last maxGap rows of counted gap pixels are kept.
+func detectQA(c *composite, entries []library.Entry, threshold float64, maxGap int) ([]qaFinding, error) {
+	grid := c.Header()
+	w, h := grid.Width, grid.Height
+
+	byKey := map[string]*qaFinding{}
+	finding := func(kind, a, b string) *qaFinding {
+		if b < a {
+			a, b = b, a
+		}
+		key := kind + "\x00" + a + "\x00" + b
+		f, ok := byKey[key]
+		if !ok {
+			f = &qaFinding{kind: kind, reachA: a, reachB: b}
+			byKey[key] = f
+		}
+		return f
+	}
+	center := func(x, y float64) [2]float64 {
+		gt := grid.GeoTransform
+		return [2]float64{gt[0] + x*gt[1] + y*gt[2], gt[3] + x*gt[4] + y*gt[5]}
+	}
+	seam := func(a, b string, va, vb float32, x, y float64) {
+		if a == "" || b == "" || a == b {
+			return
+		}
+		diff := math.Abs(float64(va) - float64(vb))
+		if diff <= threshold {
+			return
+		}
+		f := finding(qaSeam, a, b)
+		f.pixels++
+		f.maxDifference = math.Max(f.maxDifference, diff)
+		if len(f.points) < qaMaxPoints {
+			f.points = append(f.points, center(x, y))
+		}
+	}
+
+	// counted holds whether gap pixels of the last maxGap+1 rows are counted, by row modulo its length
+	counted := make([][]bool, maxGap+1)
+	for i := range counted {
+		counted[i] = make([]bool, w)
+	}
+	gap := func(a, b string, width, x, y, dx, dy int) {
+		f := finding(qaGap, a, b)
+		if width > f.maxWidth {
+			f.maxWidth = width
+		}
+		for g := 0; g < width; g++ {
+			px, py := x+g*dx, y+g*dy
+			if row := counted[py%len(counted)]; !row[px] {
+				row[px] = true
+				f.pixels++
+				if len(f.points) < qaMaxPoints {
+					f.points = append(f.points, center(float64(px)+0.5, float64(py)+0.5))
+				}
+			}
+		}
+	}
+
+	// Composite values and the reach providing each wet pixel, "" if dry, of the current and previous row
+	values, prevValues := make([]float32, w), make([]float32, w)
+	reaches, prevReaches := make([]string, w), make([]string, w)
+	src := make([]int, w)
+	// Row and reach of the last wet pixel of each column
+	lastWet, lastReach := make([]int, w), make([]string, w)
+	for x := range lastWet {
+		lastWet[x] = -1
+	}
+
+	for y := 0; y < h; y++ {
+		if err := c.read(y, values, src); err != nil {
+			return nil, err
+		}
+		for x, s := range src {
+			reaches[x] = ""
+			if s != -1 && values[x] > 0 {
+				reaches[x] = entries[s].ReachID
+			}
+		}
+		for x := range counted[y%len(counted)] {
+			counted[y%len(counted)][x] = false
+		}
+
+		// Seams with the right and upper neighbours
+		for x := 0; x < w; x++ {
+			if x+1 < w {
+				seam(reaches[x], reaches[x+1], values[x], values[x+1], float64(x)+1, float64(y)+0.5)
+			}
+			if y > 0 {
+				seam(prevReaches[x], reaches[x], prevValues[x], values[x], float64(x)+0.5, float64(y))
+			}
+		}
+
+		// Gaps along the row, then along columns ending in the row
+		last := -1
+		for x := 0; x < w; x++ {
+			if reaches[x] == "" {
+				continue
+			}
+			if width := x - last - 1; last >= 0 && width > 0 && width <= maxGap && reaches[last] != reaches[x] {
+				gap(reaches[last], reaches[x], width, last+1, y, 1, 0)
+			}
+			last = x
+		}
+		for x := 0; x < w; x++ {
+			if reaches[x] == "" {
+				continue
+			}
+			if width := y - lastWet[x] - 1; lastWet[x] >= 0 && width > 0 && width <= maxGap && lastReach[x] != reaches[x] {
+				gap(lastReach[x], reaches[x], width, x, lastWet[x]+1, 0, 1)
+			}
+			lastWet[x], lastReach[x] = y, reaches[x]
+		}
+
+		values, prevValues = prevValues, values
+		reaches, prevReaches = prevReaches, reaches
+	}
+
+	findings := make([]qaFinding, 0, len(byKey))
+	for _, f := range byKey {
+		if f.pixels > 0 {
+			findings = append(findings, *f)
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.kind != b.kind {
+			return a.kind > b.kind // seams first
+		}
+		if a.reachA != b.reachA {
+			return a.reachA < b.reachA
+		}
+		return a.reachB < b.reachB
+	})
+	return findings, nil
+}
+
+// writeQASummary writes one row per finding, VSI destinations are uploaded once complete
+func writeQASummary(findings []qaFinding, dstPath string) error {
+	records := [][]string{{"kind", "reach_a", "reach_b", "pixels", "max_difference", "max_width"}}
+	for _, f := range findings {
+		maxDifference, maxWidth := "", ""
+		if f.kind == qaSeam {
+			maxDifference = strconv.FormatFloat(f.maxDifference, 'f', -1, 32)
+		} else {
+			maxWidth = strconv.Itoa(f.maxWidth)
+		}
+		records = append(records, []string{f.kind, f.reachA, f.reachB, strconv.Itoa(f.pixels), maxDifference, maxWidth})
+	}
+	return utils.WriteCSV(dstPath, records)
+}
@@ -0,0 +1,89 @@
+package fim
+
+import (
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestDetectQA(t *testing.T) {
+	const nd = -9999
+	gt := [6]float64{0, 1, 0, 0, 0, -1}
+	// Reach 1 on the left, reach 2 on the right. Row 0 has a 1 pixel dry sliver, row 1 a seam of 3 - 1 = 2,
+	// row 2 a 3 pixel sliver which is wider than the allowed gap.
+	a := &utils.Raster{Width: 2, Height: 3, GeoTransform: gt, NoData: nd, HasNoData: true, Data: []float32{
+		1, nd,
+		1, 1,
+		1, nd,
+	}}
+	b := &utils.Raster{Width: 3, Height: 3, GeoTransform: [6]float64{2, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{
+		1, 1, 1,
+		3, 3, 3,
+		nd, nd, 1,
+	}}
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	entries := []library.Entry{{ReachID: "1"}, {ReachID: "2"}}
+
+	findings, err := detectQA(newComposite(mosaic, false), entries, 1, 2)
+	if err != nil {
+		t.Fatalf("detectQA() error = %v", err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("detectQA() returned %d findings, want 2: %+v", len(findings), findings)
+	}
+
+	seam := findings[0]
+	if seam.kind != qaSeam || seam.reachA != "1" || seam.reachB != "2" || seam.pixels != 1 || seam.maxDifference != 2 {
+		t.Errorf("seam = %+v, want 1 pixel edge between 1 and 2 with difference 2", seam)
+	}
+	if want := [2]float64{2, -1.5}; len(seam.points) != 1 || seam.points[0] != want {
+		t.Errorf("seam points = %v, want [%v]", seam.points, want)
+	}
+
+	gap := findings[1]
+	if gap.kind != qaGap || gap.reachA != "1" || gap.reachB != "2" || gap.pixels != 1 || gap.maxWidth != 1 {
+		t.Errorf("gap = %+v, want 1 pixel between 1 and 2", gap)
+	}
+	if want := [2]float64{1.5, -0.5}; len(gap.points) != 1 || gap.points[0] != want {
+		t.Errorf("gap points = %v, want [%v]", gap.points, want)
+	}
+
+	if findings, _ := detectQA(newComposite(mosaic, false), entries, 5, 3); len(findings) != 1 || findings[0].pixels != 4 || findings[0].maxWidth != 3 {
+		t.Errorf("detectQA() with gap 3 = %+v, want only a gap of 4 pixels", findings)
+	}
+}
+
+func TestDetectQAColumns(t *testing.T) {
+	const nd = -9999
+	// Reach 1 on top and reach 2 below, the middle pixel of row 1 is a dry sliver between them along its column
+	a := &utils.Raster{Width: 3, Height: 2, GeoTransform: [6]float64{0, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{
+		1, 1, 1,
+		nd, nd, nd,
+	}}
+	b := &utils.Raster{Width: 3, Height: 2, GeoTransform: [6]float64{0, 1, 0, -1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{
+		3, nd, 1,
+		1, 1, 1,
+	}}
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	findings, err := detectQA(newComposite(mosaic, false), []library.Entry{{ReachID: "1"}, {ReachID: "2"}}, 1, 1)
+	if err != nil {
+		t.Fatalf("detectQA() error = %v", err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("detectQA() returned %d findings, want 2: %+v", len(findings), findings)
+	}
+	// Seam between (0, 0) and (0, 1), gap at (1, 1) counted once
+	if seam := findings[0]; seam.kind != qaSeam || seam.pixels != 1 || seam.points[0] != [2]float64{0.5, -1} {
+		t.Errorf("seam = %+v, want 1 pixel edge at (0.5, -1)", seam)
+	}
+	if gap := findings[1]; gap.kind != qaGap || gap.pixels != 1 || gap.maxWidth != 1 || gap.points[0] != [2]float64{1.5, -1.5} {
+		t.Errorf("gap = %+v, want 1 pixel at (1.5, -1.5)", gap)
+	}
+}
@@ -0,0 +1,132 @@
+package fim
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// inundationStats holds flooded area and depth statistics of a reach FIM or of the whole composite.
+// Area is in squared CRS units and depths are in library units.
+type inundationStats struct {
+	ReachID      string  `json:"reach_id"`
+	Flow         string  `json:"flow,omitempty"`
+	ControlStage string  `json:"control_stage,omitempty"`
+	WetPixels    int64   `json:"wet_pixels"`
+	FloodedArea  float64 `json:"flooded_area"`
+	MaxDepth     float64 `json:"max_depth"`
+	MeanDepth    float64 `json:"mean_depth"`
+}
+
+// statsAccumulator accumulates wet pixels, pixels with value > 0 that are not nodata
+type statsAccumulator struct {
+	count     int64
+	sum       float64
+	max       float64
+	pixelArea float64
+}
+
+// add accumulates a value that is not nodata
+func (a *statsAccumulator) add(v float32) {
+	if v <= 0 {
+		return
+	}
+	if a.count == 0 || float64(v) > a.max {
+		a.max = float64(v)
+	}
+	a.count++
+	a.sum += float64(v)
+}
+
+func (a *statsAccumulator) stats() inundationStats {
+	s := inundationStats{WetPixels: a.count, FloodedArea: float64(a.count) * a.pixelArea, MaxDepth: a.max}
+	if a.count > 0 {
+		s.MeanDepth = a.sum / float64(a.count)
+	}
+	return s
+}
+
+// computeStats returns statistics of each reach and of the composite c of entries, one row at a time.
+// Reach statistics are of the pixels the reach provides in the composite, after precedence and cleanup.
+// Pixels filled by cleanup only count in the composite statistics. Domains are never included.
+func computeStats(c compositeRows, entries []library.Entry) ([]inundationStats, inundationStats, error) {
+	h := c.Header()
+	reachAccs := make([]statsAccumulator, len(entries))
+	for i := range reachAccs {
+		reachAccs[i].pixelArea = h.PixelArea()
+	}
+	compositeAcc := statsAccumulator{pixelArea: h.PixelArea()}
+
+	row, src := make([]float32, h.Width), make([]int, h.Width)
+	for y := 0; y < h.Height; y++ {
+		if err := c.read(y, row, src); err != nil {
+			return nil, inundationStats{}, fmt.Errorf("error computing statistics: %v", err)
+		}
+		for x, v := range row {
+			if h.IsNoData(v) {
+				continue
+			}
+			compositeAcc.add(v)
+			if src[x] != -1 {
+				reachAccs[src[x]].add(v)
+			}
+		}
+	}
+
+	reachStats := make([]inundationStats, len(entries))
+	for i, e := range entries {
+		s := reachAccs[i].stats()
+		s.ReachID = e.ReachID
+		s.Flow = e.Flow
+		s.ControlStage = strings.ReplaceAll(e.ControlStage, "_", ".")
+		reachStats[i] = s
+	}
+	composite := compositeAcc.stats()
+	composite.ReachID = "all"
+
+	slog.Debug("Computed inundation statistics", "reach_count", len(reachStats), "composite_wet_pixels", composite.WetPixels)
+	return reachStats, composite, nil
+}
+
+// writeStats writes statistics as JSON if file extension is .json, otherwise as CSV.
+// In CSV the composite is the last row with reach_id 'all'.
+func writeStats(reachStats []inundationStats, composite inundationStats, filePath string) error {
+	if strings.EqualFold(filepath.Ext(filePath), ".json") {
+		data, err := json.MarshalIndent(struct {
+			Reaches   []inundationStats `json:"reaches"`
+			Composite inundationStats   `json:"composite"`
+		}{reachStats, composite}, "", "  ")
+		if err != nil {
+			return err
+		}
+		return utils.WriteStaged(filePath, func(local string) error {
+			return os.WriteFile(local, append(data, '\n'), 0644)
+		})
+	}
+
+	records := [][]string{{"reach_id", "flow", "control_stage", "wet_pixels", "flooded_area", "max_depth", "mean_depth"}}
+	for _, s := range append(reachStats, composite) {
+		records = append(records, []string{
+			s.ReachID,
+			s.Flow,
+			s.ControlStage,
+			strconv.FormatInt(s.WetPixels, 10),
+			formatStat(s.FloodedArea),
+			formatStat(s.MaxDepth),
+			formatStat(s.MeanDepth),
+		})
+	}
+	return utils.WriteCSV(filePath, records)
+}
+
+func formatStat(v float64) string {
+	return strconv.FormatFloat(math.Round(v*1000)/1000, 'f', -1, 64)
+}
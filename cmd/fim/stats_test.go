@@ -0,0 +1,86 @@
+package fim
+
+import (
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestComputeStats(t *testing.T) {
+	const nd = -9999
+	// Reach 2 is one column right of reach 1, pixels are 2 x 3
+	a := &utils.Raster{Width: 3, Height: 2, GeoTransform: [6]float64{0, 2, 0, 0, 0, -3}, NoData: nd, HasNoData: true, Data: []float32{
+		1, 0, 4,
+		3, -1, nd,
+	}}
+	b := &utils.Raster{Width: 3, Height: 2, GeoTransform: [6]float64{2, 2, 0, 0, 0, -3}, NoData: nd, HasNoData: true, Data: []float32{
+		2, 3, 0.2,
+		nd, 5, nd,
+	}}
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []library.Entry{{ReachID: "1", Flow: "10", ControlStage: "1_5"}, {ReachID: "2", Flow: "20"}}
+
+	for _, tt := range []struct {
+		name      string
+		c         func() (compositeRows, error)
+		reach     [2]inundationStats
+		composite inundationStats
+	}{
+		{
+			// Reach 2 wins the overlap where it has data, reach 1 keeps column 1 of the second row
+			name:      "controls",
+			c:         func() (compositeRows, error) { return newComposite(mosaic, false), nil },
+			reach:     [2]inundationStats{{WetPixels: 2, FloodedArea: 12, MaxDepth: 3, MeanDepth: 2}, {WetPixels: 4, FloodedArea: 24, MaxDepth: 5, MeanDepth: 10.2 / 4}},
+			composite: inundationStats{WetPixels: 6, FloodedArea: 36, MaxDepth: 5, MeanDepth: 14.2 / 6},
+		},
+		{
+			// Reach 1 wins column 2 of the first row with a deeper value
+			name:      "deeper",
+			c:         func() (compositeRows, error) { return newComposite(mosaic, true), nil },
+			reach:     [2]inundationStats{{WetPixels: 3, FloodedArea: 18, MaxDepth: 4, MeanDepth: 8.0 / 3}, {WetPixels: 3, FloodedArea: 18, MaxDepth: 5, MeanDepth: 7.2 / 3}},
+			composite: inundationStats{WetPixels: 6, FloodedArea: 36, MaxDepth: 5, MeanDepth: 15.2 / 6},
+		},
+		{
+			// Depths below 1.5 are dry in the composite and in both reaches
+			name: "cleanup",
+			c: func() (compositeRows, error) {
+				return cleanComposite(newComposite(mosaic, false), cleanupOptions{minDepth: 1.5})
+			},
+			reach:     [2]inundationStats{{WetPixels: 1, FloodedArea: 6, MaxDepth: 3, MeanDepth: 3}, {WetPixels: 3, FloodedArea: 18, MaxDepth: 5, MeanDepth: 10.0 / 3}},
+			composite: inundationStats{WetPixels: 4, FloodedArea: 24, MaxDepth: 5, MeanDepth: 3.25},
+		},
+	} {
+		c, err := tt.c()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reachStats, composite, err := computeStats(c, entries)
+		if err != nil {
+			t.Fatalf("%s: computeStats() error = %v", tt.name, err)
+		}
+		for i, want := range tt.reach {
+			want.ReachID, want.Flow = entries[i].ReachID, entries[i].Flow
+			if i == 0 {
+				want.ControlStage = "1.5"
+			}
+			if !statsEqual(reachStats[i], want) {
+				t.Errorf("%s: reach stats %d = %+v, want %+v", tt.name, i, reachStats[i], want)
+			}
+		}
+		tt.composite.ReachID = "all"
+		if !statsEqual(composite, tt.composite) {
+			t.Errorf("%s: composite stats = %+v, want %+v", tt.name, composite, tt.composite)
+		}
+	}
+}
+
+// statsEqual compares statistics with a tolerance on the mean depth
+func statsEqual(a, b inundationStats) bool {
+	d := a.MeanDepth - b.MeanDepth
+	a.MeanDepth, b.MeanDepth = 0, 0
+	return a == b && d < 1e-6 && d > -1e-6
+}
@@ -0,0 +1,363 @@
+package fim
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+// timeSeriesNoData is used for cubes when the library FIMs have no nodata value
+const timeSeriesNoData = -9999
+
+// timeLayouts are accepted layouts of the time column of long controls tables, times without zone are UTC
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// nameTimeRe finds a time in a controls file name e.g. 2024-05-01T06, 20240501_0600 or 20240501
+var nameTimeRe = regexp.MustCompile(`\d{4}-?\d{2}-?\d{2}(?:[T_ -]?\d{2}(?::?\d{2}(?::?\d{2})?)?)?`)
+
+// timeSeriesOptions holds the derived raster outputs of a time series run
+type timeSeriesOptions struct {
+	maxFile      string
+	arrivalFile  string
+	durationFile string
+}
+
+// hasRasters reports whether any derived raster is requested
+func (o timeSeriesOptions) hasRasters() bool {
+	return o.maxFile != "" || o.arrivalFile != "" || o.durationFile != ""
+}
+
+// envelope holds one row of max depth, arrival time and wet duration of a time series
+type envelope struct {
+	max, arrival, duration []float32
+}
+
+// newEnvelope returns an envelope row of width pixels
+func newEnvelope(width int) *envelope {
+	e := &envelope{
+		max:      make([]float32, width),
+		arrival:  make([]float32, width),
+		duration: make([]float32, width),
+	}
+	e.reset()
+	return e
+}
+
+// reset sets every pixel of the row to nodata (never wet) before the steps of the next row are added
+func (e *envelope) reset() {
+	for x := range e.max {
+		e.max[x], e.arrival[x], e.duration[x] = timeSeriesNoData, timeSeriesNoData, timeSeriesNoData
+	}
+}
+
+// add updates the envelope row with the composite row of a step that starts offset hours after the first step
+// and lasts hours. Pixels are wet where the composite has data greater than 0.
+func (e *envelope) add(row []float32, grid utils.RasterHeader, offset, hours float64) {
+	for x, v := range row {
+		if grid.IsNoData(v) || v <= 0 {
+			continue
+		}
+		if e.duration[x] == timeSeriesNoData { // first wet step
+			e.max[x], e.arrival[x], e.duration[x] = v, float32(offset), 0
+		}
+		if v > e.max[x] {
+			e.max[x] = v
+		}
+		e.duration[x] += float32(hours)
+	}
+}
+
+// envelopeOutput is a requested envelope raster and the envelope row written to it
+type envelopeOutput struct {
+	path   string
+	row    []float32
+	writer *utils.RasterWriter
+}
+
+// stepHours returns the duration of each step in hours, a step lasts until the next one and the last step
+// as long as the one before. A single step lasts 0 hours.
+func stepHours(steps []timeStep) []float64 {
+	hours := make([]float64, len(steps))
+	for i := 0; i+1 < len(steps); i++ {
+		hours[i] = steps[i+1].time.Sub(steps[i].time).Hours()
+	}
+	if n := len(steps); n > 1 {
+		hours[n-1] = hours[n-2]
+	}
+	return hours
+}
+
+// timeStep is the controls file of one time step of a time series
+type timeStep struct {
+	time     time.Time
+	controls string
+}
+
+// timeSteps returns the time steps of a long controls table with a 'time' column, or of a directory or glob of
+// controls files with the time in their names, sorted by time. cleanup removes temporary controls files.
+func timeSteps(src string) (steps []timeStep, cleanup func(), err error) {
+	cleanup = func() {}
+	if info, err := os.Stat(src); err == nil && !info.IsDir() {
+		return splitLongTable(src)
+	}
+
+	files, err := ensembleMembers(src)
+	if err != nil {
+		return nil, cleanup, err
+	}
+	for _, f := range files {
+		t, err := timeFromName(filepath.Base(f))
+		if err != nil {
+			return nil, cleanup, err
+		}
+		steps = append(steps, timeStep{time: t, controls: f})
+	}
+	return steps, cleanup, sortTimeSteps(steps)
+}
+
+// splitLongTable writes the rows of each time of a long controls table to a temporary controls file
+func splitLongTable(tablePath string) ([]timeStep, func(), error) {
+	cleanup := func() {}
+	file, err := os.Open(tablePath)
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("error opening time series controls file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("error reading CSV file: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, cleanup, fmt.Errorf("no records in time series controls file")
+	}
+
+	timeCol := -1
+	for i, h := range records[0] {
+		if strings.ToLower(strings.TrimSpace(h)) == "time" {
+			timeCol = i
+		}
+	}
+	if timeCol == -1 {
+		return nil, cleanup, fmt.Errorf("time series controls file must have a 'time' column")
+	}
+	without := func(record []string) []string {
+		return append(append([]string{}, record[:timeCol]...), record[timeCol+1:]...)
+	}
+
+	// Rows grouped by time, keeping the order of rows within a time for precedence
+	groups := map[time.Time][][]string{}
+	for _, record := range records[1:] {
+		if len(record) <= timeCol {
+			return nil, cleanup, fmt.Errorf("invalid time series record %v, missing time", record)
+		}
+		t, err := parseTime(record[timeCol])
+		if err != nil {
+			return nil, cleanup, err
+		}
+		groups[t] = append(groups[t], without(record))
+	}
+
+	dir, err := os.MkdirTemp("", "f2f_timeseries_*")
+	if err != nil {
+		return nil, cleanup, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	var steps []timeStep
+	for t, rows := range groups {
+		p := filepath.Join(dir, fmt.Sprintf("controls_%d.csv", t.Unix()))
+		f, err := os.Create(p)
+		if err != nil {
+			return nil, cleanup, err
+		}
+		err = csv.NewWriter(f).WriteAll(append([][]string{without(records[0])}, rows...))
+		f.Close()
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("error writing controls of time %s: %v", t.Format(time.RFC3339), err)
+		}
+		steps = append(steps, timeStep{time: t, controls: p})
+	}
+	return steps, cleanup, sortTimeSteps(steps)
+}
+
+// sortTimeSteps sorts steps by time, two steps can not have the same time
+func sortTimeSteps(steps []timeStep) error {
+	sort.Slice(steps, func(i, j int) bool { return steps[i].time.Before(steps[j].time) })
+	for i := 1; i < len(steps); i++ {
+		if steps[i].time.Equal(steps[i-1].time) {
+			return fmt.Errorf("%s and %s have the same time %s", steps[i-1].controls, steps[i].controls, steps[i].time.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// parseTime parses a time of a long controls table
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s', must be RFC 3339 e.g. 2024-05-01T06:00:00Z or 'YYYY-MM-DD hh:mm:ss'", s)
+}
+
+// timeFromName returns the UTC time in a controls file name, given as date with optional hour, minute and second
+func timeFromName(name string) (time.Time, error) {
+	m := nameTimeRe.FindString(name)
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, m)
+
+	switch len(digits) {
+	case 8, 10, 12, 14:
+		t, err := time.ParseInLocation("20060102150405"[:len(digits)], digits, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no time found in controls file name %s, expected e.g. controls_2024-05-01T06.csv", name)
+}
+
+// runTimeSeries writes the composite of each time step as a time step of a NetCDF or Zarr cube, and max depth,
+// arrival time and wet duration rasters, in one pass over the rows of all steps.
+// Each library FIM is converted once even if it is used by many time steps, and only one row of each step is held in memory.
+func runTimeSeries(steps []timeStep, opts options, topts timeSeriesOptions) error {
+	absFimLibPath, err := library.AbsPath(opts.fimLibDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+	}
+
+	// Step FIMs as indexes into unique library FIMs
+	listing := library.NewListing()
+	var paths []string
+	pathIdx := map[string]int{}
+	stepFIMs := make([][]int, len(steps))
+	for s, step := range steps {
+		entries, err := library.ReadControls(step.controls, absFimLibPath)
+		if err != nil {
+			return fmt.Errorf("time %s: %v", step.time.Format(time.RFC3339), err)
+		}
+		if opts.missingPolicy != library.MissingNone {
+			if entries, _, err = library.ResolveMissing(entries, opts.missingPolicy, listing, opts.concurrent); err != nil {
+				return fmt.Errorf("time %s: %v", step.time.Format(time.RFC3339), err)
+			}
+		}
+		if countInterpolated(entries) > 0 {
+			slog.Warn("Interpolation columns are ignored in time series mode, lower flow FIMs are used", "time", step.time.Format(time.RFC3339))
+		}
+		for _, e := range entries {
+			i, ok := pathIdx[e.Path]
+			if !ok {
+				i = len(paths)
+				pathIdx[e.Path] = i
+				paths = append(paths, e.Path)
+			}
+			stepFIMs[s] = append(stepFIMs[s], i)
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("none of the FIMs referenced in time series controls are available in library")
+	}
+	slog.Debug("Loaded time series", "steps_count", len(steps), "unique_fims_count", len(paths))
+
+	info, err := utils.GDALInfo(paths[0])
+	if err != nil {
+		return err
+	}
+	mosaic, err := utils.OpenMosaic(paths, opts.concurrent)
+	if err != nil {
+		return err
+	}
+	defer mosaic.Close()
+
+	grid := mosaic.Grid
+	grid.NoData, grid.HasNoData = mosaic.NoData(timeSeriesNoData), true
+
+	var cube *utils.CubeWriter
+	if opts.outputFile != "" {
+		times := make([]time.Time, len(steps))
+		for s, step := range steps {
+			times[s] = step.time
+		}
+		if cube, err = utils.NewCubeWriter(grid, info.CoordinateSystem.WKT, "fim", "composite flood inundation map", times); err != nil {
+			return err
+		}
+		defer cube.Cleanup()
+	}
+	// Envelope rasters are written row by row as the steps of each row are added
+	envGrid := mosaic.Grid
+	envGrid.NoData, envGrid.HasNoData = timeSeriesNoData, true
+	env := newEnvelope(grid.Width)
+	var envOutputs []envelopeOutput
+	for _, o := range []envelopeOutput{{path: topts.maxFile, row: env.max}, {path: topts.arrivalFile, row: env.arrival}, {path: topts.durationFile, row: env.duration}} {
+		if o.path == "" {
+			continue
+		}
+		if o.writer, err = utils.NewRasterWriter(envGrid); err != nil {
+			return err
+		}
+		defer o.writer.Cleanup()
+		envOutputs = append(envOutputs, o)
+	}
+	hours := stepHours(steps)
+
+	// Steps are computed row by row so each FIM row is read once for all steps that use it
+	rows := make([][]float32, len(steps))
+	for s := range rows {
+		rows[s] = make([]float32, grid.Width)
+	}
+	for y := 0; y < grid.Height; y++ {
+		env.reset()
+		for s, step := range steps {
+			for x := range rows[s] {
+				rows[s][x] = float32(grid.NoData)
+			}
+			if err := mosaic.CompositeRow(y, stepFIMs[s], rows[s], nil); err != nil {
+				return err
+			}
+			env.add(rows[s], grid, step.time.Sub(steps[0].time).Hours(), hours[s])
+		}
+		if cube != nil {
+			if err := cube.WriteRow(rows...); err != nil {
+				return err
+			}
+		}
+		for _, o := range envOutputs {
+			if err := o.writer.WriteRow(o.row); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cube != nil {
+		if err := cube.Close(opts.outputFile); err != nil {
+			return err
+		}
+		fmt.Printf("Time series cube created at %s\n", opts.outputFile)
+	}
+
+	for _, o := range envOutputs {
+		if err := o.writer.Close(info.CoordinateSystem.WKT, o.path, opts.outputFormat, opts.creation); err != nil {
+			return err
+		}
+		fmt.Printf("Time series raster created at %s\n", o.path)
+	}
+	if topts.arrivalFile != "" {
+		fmt.Printf("Arrival times are hours since %s\n", steps[0].time.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package fim
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestTimeFromName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    time.Time
+		wantErr bool
+	}{
+		{"controls_2024-05-01T06.csv", time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC), false},
+		{"controls_20240501_0630.csv", time.Date(2024, 5, 1, 6, 30, 0, 0, time.UTC), false},
+		{"2024-05-01.csv", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), false},
+		{"fcst_20240501T063015.csv", time.Date(2024, 5, 1, 6, 30, 15, 0, time.UTC), false},
+		{"controls.csv", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := timeFromName(tt.name)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("timeFromName(%q) = %v, %v, want %v, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSplitLongTable(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "timeseries.csv")
+	data := `reach_id,time,flow,control_stage
+1,2024-05-01T07:00:00Z,120,nd
+1,2024-05-01 06:00,100,nd
+2,2024-05-01T06:00:00Z,200,nd
+`
+	if err := os.WriteFile(table, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, cleanup, err := splitLongTable(table)
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("splitLongTable() error = %v", err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("splitLongTable() returned %d steps, want 2", len(steps))
+	}
+
+	wants := []struct {
+		time     time.Time
+		controls string
+	}{
+		{time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC), "reach_id,flow,control_stage\n1,100,nd\n2,200,nd\n"},
+		{time.Date(2024, 5, 1, 7, 0, 0, 0, time.UTC), "reach_id,flow,control_stage\n1,120,nd\n"},
+	}
+	for i, want := range wants {
+		if !steps[i].time.Equal(want.time) {
+			t.Errorf("step %d time = %v, want %v", i, steps[i].time, want.time)
+		}
+		got, err := os.ReadFile(steps[i].controls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want.controls {
+			t.Errorf("step %d controls = %q, want %q", i, got, want.controls)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	const nd = timeSeriesNoData
+	grid := utils.RasterHeader{Width: 3, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true}
+
+	t0 := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	steps := []timeStep{{time: t0}, {time: t0.Add(time.Hour)}, {time: t0.Add(3 * time.Hour)}}
+	hours := stepHours(steps)
+	if want := []float64{1, 2, 2}; !reflect.DeepEqual(hours, want) {
+		t.Errorf("stepHours() = %v, want %v", hours, want)
+	}
+
+	composites := [][]float32{
+		{1, nd, nd},
+		{2, 0.5, nd},
+		{nd, 3, 0},
+	}
+	env := newEnvelope(grid.Width)
+	for s, c := range composites {
+		env.add(c, grid, steps[s].time.Sub(t0).Hours(), hours[s])
+	}
+
+	if want := []float32{2, 3, nd}; !reflect.DeepEqual(env.max, want) {
+		t.Errorf("max = %v, want %v", env.max, want)
+	}
+	if want := []float32{0, 1, nd}; !reflect.DeepEqual(env.arrival, want) {
+		t.Errorf("arrival = %v, want %v", env.arrival, want)
+	}
+	if want := []float32{3, 4, nd}; !reflect.DeepEqual(env.duration, want) {
+		t.Errorf("duration = %v, want %v", env.duration, want)
+	}
+
+	env.reset()
+	if want := []float32{nd, nd, nd}; !reflect.DeepEqual(env.max, want) {
+		t.Errorf("max after reset = %v, want %v", env.max, want)
+	}
+}
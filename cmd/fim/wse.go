@@ -0,0 +1,91 @@
+package fim
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"flows2fim/pkg/utils"
+)
+
+// Output products of fim
+const (
+	productDepth = "depth" // library values as is
+	productWSE   = "wse"   // water surface elevation, DEM + depth
+)
+
+// wseComposite writes water surface elevation, DEM + depth, for wet pixels of the composite c as a GTiff
+// with the given WKT coordinate system. The DEM is resampled bilinearly to the composite grid.
+// Pixels where the composite is dry or the DEM has no data are nodata. The DEM and the composite are read one row at a time.
+// It returns the vertical datum of the DEM coordinate system, "" if it has none.
+func wseComposite(c utils.RasterRows, srsWKT, demPath, dstPath string) (verticalDatum string, err error) {
+	demInfo, err := utils.GDALInfo(demPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "f2f_dem_*")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	warpedPath := filepath.Join(dir, "dem.tif")
+	h := c.Header()
+	if err := utils.WarpToGrid(demPath, warpedPath, h, srsWKT, "bilinear"); err != nil {
+		return "", fmt.Errorf("error resampling DEM: %v", err)
+	}
+	dem, err := utils.OpenRaster(warpedPath)
+	if err != nil {
+		return "", err
+	}
+	defer dem.Close()
+
+	w, err := utils.NewRasterWriter(h)
+	if err != nil {
+		return "", err
+	}
+	defer w.Cleanup()
+	missing := 0
+	for y := 0; y < h.Height; y++ {
+		depth, err := c.Row(y)
+		if err != nil {
+			return "", err
+		}
+		demRow, err := dem.Row(y)
+		if err != nil {
+			return "", err
+		}
+		missing += wseRow(depth, demRow, h, dem.Header())
+		if err := w.WriteRow(depth); err != nil {
+			return "", err
+		}
+	}
+
+	if missing > 0 {
+		slog.Warn("DEM has no data at wet pixels, they are nodata in WSE output", "pixels", missing)
+	}
+	if err := w.Close(srsWKT, dstPath, "GTiff", utils.CreationOptions{Compress: "LZW"}); err != nil {
+		return "", err
+	}
+	return demInfo.VerticalDatum(), nil
+}
+
+// wseRow replaces depths of a row with DEM + depth in place, dem is the same row of the DEM on the depth grid.
+// Dry pixels and pixels without DEM data become nodata, it returns the number of wet pixels without DEM data.
+func wseRow(depth, dem []float32, depthHeader, demHeader utils.RasterHeader) (missing int) {
+	noData := float32(depthHeader.NoData)
+	for x, d := range depth {
+		if depthHeader.IsNoData(d) || d <= 0 {
+			depth[x] = noData
+			continue
+		}
+		if demHeader.IsNoData(dem[x]) {
+			depth[x] = noData
+			missing++
+			continue
+		}
+		depth[x] = dem[x] + d
+	}
+	return missing
+}
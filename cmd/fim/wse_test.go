@@ -0,0 +1,23 @@
+package fim
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestWSERow(t *testing.T) {
+	const nd = -9999
+	depth := []float32{1.5, 0, nd, 2}
+	dem := []float32{100, 101, 102, -32768}
+	depthHeader := utils.RasterHeader{Width: 4, Height: 1, NoData: nd, HasNoData: true}
+	demHeader := utils.RasterHeader{Width: 4, Height: 1, NoData: -32768, HasNoData: true}
+
+	if missing := wseRow(depth, dem, depthHeader, demHeader); missing != 1 {
+		t.Errorf("wseRow() missing = %d, want 1", missing)
+	}
+	if want := []float32{101.5, nd, nd, nd}; !reflect.DeepEqual(depth, want) {
+		t.Errorf("wseRow() = %v, want %v", depth, want)
+	}
+}
@@ -0,0 +1,269 @@
+package impact
+
+import (
+	"flag"
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var usage string = `Usage of impact:
+Given a structures file and a control table with a fim library folder (or an existing composite FIM),
+find inundated structures, their max depth and the reach_id that floods them.
+When a control table is given, the composite is not built, only library FIMs whose bounds contain a structure are read.
+Precedence is the same as in the composite FIM, later reaches in the control table win.
+Interpolated controls (flow_upper and weight columns) are blended at each sample location the same way as in 'fim'.
+GDAL VSI paths can be used for library and composite FIM, given GDAL must have access to cloud creds.
+
+Structures file can be:
+- A GeoJSON FeatureCollection of Point, Polygon or MultiPolygon features (building points or footprints)
+- A CSV of building points with 'lat' and 'lon' columns and an optional 'id' column
+Coordinates must be WGS84 longitude/latitude. Footprints are sampled on a grid at FIM resolution.
+
+Output CSV has columns id, inundated, max_depth, reach_id, flow, control_stage with one row per structure.
+Optional reach summary CSV has columns reach_id, inundated_count, max_depth and needs a control table.
+For extent libraries max_depth is the extent value.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+// structureImpact is the inundation of a single structure
+type structureImpact struct {
+	id        string
+	inundated bool
+	maxDepth  float64
+	entry     *library.Entry
+}
+
+func Run(args []string) error {
+	flags := flag.NewFlagSet("impact", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(usage)
+		flags.PrintDefaults()
+	}
+
+	var structuresFile, controlsFile, fimLibDir, fimFile, outputFile, reachFile string
+	var minDepth float64
+	var concurrent int
+
+	flags.StringVar(&structuresFile, "s", "", "Path to the structures GeoJSON (points or footprints) or CSV (points) file")
+	flags.StringVar(&controlsFile, "c", "", "Path to the controls CSV file, requires -lib")
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&fimFile, "fim", "", "Path to an existing composite FIM to use instead of -c and -lib")
+	flags.StringVar(&outputFile, "o", "", "Output CSV file path with one row per structure")
+	flags.StringVar(&reachFile, "o_reach", "", "Optional output CSV of inundated structure counts per reach_id, needs -c and -lib")
+	flags.Float64Var(&minDepth, "min_depth", 0, "A structure is inundated when its max depth is greater than this value")
+	flags.IntVar(&concurrent, "cc", 25, "Concurrent Count, number of FIMs to read concurrently")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	// Validate required flags
+	if structuresFile == "" || outputFile == "" || fimFile == "" && (controlsFile == "" || fimLibDir == "") {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	if fimFile != "" && (controlsFile != "" || fimLibDir != "") {
+		return fmt.Errorf("-fim can not be used with -c and -lib")
+	}
+	if fimFile != "" && reachFile != "" {
+		return fmt.Errorf("-o_reach needs -c and -lib, reaches are not known for a composite FIM")
+	}
+
+	for _, tool := range []string{"gdalinfo", "gdallocationinfo"} {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	features, err := readStructures(structuresFile)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Read structures", "structures_count", len(features))
+
+	var entries []library.Entry
+	if fimFile == "" {
+		absFimLibPath, err := library.AbsPath(fimLibDir)
+		if err != nil {
+			return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+		}
+		entries, err = library.ReadControls(controlsFile, absFimLibPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	impacts, err := sampleImpacts(features, fimFile, entries, minDepth, concurrent)
+	if err != nil {
+		return err
+	}
+
+	if err := writeImpacts(impacts, outputFile); err != nil {
+		return fmt.Errorf("error writing structure impacts: %v", err)
+	}
+	fmt.Printf("Structure impacts created at %s\n", outputFile)
+
+	if reachFile != "" {
+		if err := writeReachSummary(impacts, reachFile); err != nil {
+			return fmt.Errorf("error writing reach summary: %v", err)
+		}
+		fmt.Printf("Reach summary created at %s\n", reachFile)
+	}
+
+	return nil
+}
+
+// sampleImpacts samples structures on the composite FIM fimFile, or on the library FIMs of entries if fimFile is empty,
+// and returns the impact of each structure
+func sampleImpacts(features []utils.Feature, fimFile string, entries []library.Entry, minDepth float64, concurrent int) ([]structureImpact, error) {
+	// Footprints are sampled at FIM resolution, points need no resolution
+	var step float64
+	var err error
+	for _, f := range features {
+		if f.Geometry.Type != "Point" {
+			if step, err = pixelSize(fimFile, entries); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	points, owner := sampleLocations(features, step)
+	slog.Debug("Sampling structures", "locations_count", len(points))
+
+	var samples []library.Sample
+	if fimFile != "" {
+		samples, err = library.SampleRaster(fimFile, points)
+	} else {
+		samples, err = library.SampleEntries(entries, points, concurrent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return structureImpacts(features, owner, samples, minDepth), nil
+}
+
+// readStructures reads GeoJSON features, or CSV points as Point features
+func readStructures(path string) ([]utils.Feature, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".geojson" || ext == ".json" {
+		return utils.ReadGeoJSON(path)
+	}
+
+	points, err := utils.ReadPoints(path)
+	if err != nil {
+		return nil, err
+	}
+	features := make([]utils.Feature, len(points))
+	for i, p := range points {
+		features[i] = utils.Feature{ID: p.ID, Geometry: utils.Geometry{Type: "Point", Rings: [][][2]float64{{{p.Lon, p.Lat}}}}}
+	}
+	return features, nil
+}
+
+// sampleLocations returns the sample locations of all structures, owner maps a location back to its structure
+func sampleLocations(features []utils.Feature, step float64) (points []utils.Point, owner []int) {
+	for i, f := range features {
+		for _, ll := range f.Geometry.SampleLocations(step) {
+			points = append(points, utils.Point{ID: f.ID, Lon: ll[0], Lat: ll[1]})
+			owner = append(owner, i)
+		}
+	}
+	return points, owner
+}
+
+// structureImpacts returns the impact of each structure from the samples of its locations. A structure is inundated
+// when any sample is above minDepth, its max depth and reach are those of its deepest sample.
+func structureImpacts(features []utils.Feature, owner []int, samples []library.Sample, minDepth float64) []structureImpact {
+	impacts := make([]structureImpact, len(features))
+	for i, f := range features {
+		impacts[i].id = f.ID
+	}
+	for i, s := range samples {
+		if !s.OK || s.Value <= minDepth {
+			continue
+		}
+		im := &impacts[owner[i]]
+		if !im.inundated || s.Value > im.maxDepth {
+			im.inundated = true
+			im.maxDepth = s.Value
+			im.entry = s.Entry
+		}
+	}
+	return impacts
+}
+
+// pixelSize returns the pixel size in degrees of the composite FIM, or of the first readable library FIM
+func pixelSize(fimFile string, entries []library.Entry) (float64, error) {
+	paths := []string{fimFile}
+	if fimFile == "" {
+		paths = paths[:0]
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+		}
+	}
+
+	for _, p := range paths {
+		info, err := utils.GDALInfo(p)
+		if err != nil {
+			slog.Debug("Could not read FIM resolution", "path", p, "error", err)
+			continue
+		}
+		return info.WGS84PixelSize()
+	}
+	return 0, fmt.Errorf("could not read resolution of any FIM")
+}
+
+func writeImpacts(impacts []structureImpact, filePath string) error {
+	records := [][]string{{"id", "inundated", "max_depth", "reach_id", "flow", "control_stage"}}
+	for _, im := range impacts {
+		record := []string{im.id, strconv.FormatBool(im.inundated), "", "", "", ""}
+		if im.inundated {
+			record[2] = strconv.FormatFloat(im.maxDepth, 'f', -1, 64)
+			if im.entry != nil {
+				record[3] = im.entry.ReachID
+				record[4] = im.entry.Flow
+				record[5] = strings.ReplaceAll(im.entry.ControlStage, "_", ".")
+			}
+		}
+		records = append(records, record)
+	}
+	return utils.WriteCSV(filePath, records)
+}
+
+// writeReachSummary writes count and max depth of inundated structures per reach_id, reaches without
+// inundated structures are not listed
+func writeReachSummary(impacts []structureImpact, filePath string) error {
+	counts := map[string]int{}
+	maxDepths := map[string]float64{}
+	for _, im := range impacts {
+		if !im.inundated || im.entry == nil {
+			continue
+		}
+		r := im.entry.ReachID
+		if counts[r] == 0 || im.maxDepth > maxDepths[r] {
+			maxDepths[r] = im.maxDepth
+		}
+		counts[r]++
+	}
+
+	reachIDs := make([]string, 0, len(counts))
+	for r := range counts {
+		reachIDs = append(reachIDs, r)
+	}
+	sort.Strings(reachIDs)
+
+	records := [][]string{{"reach_id", "inundated_count", "max_depth"}}
+	for _, r := range reachIDs {
+		records = append(records, []string{r, strconv.Itoa(counts[r]), strconv.FormatFloat(maxDepths[r], 'f', -1, 64)})
+	}
+	return utils.WriteCSV(filePath, records)
+}
@@ -0,0 +1,88 @@
+package impact
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestSampleImpacts(t *testing.T) {
+	for _, tool := range []string{"gdal_translate", "gdalinfo", "gdallocationinfo"} {
+		if !utils.CheckGDALToolAvailable(tool) {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	const nd = -9999
+	// Reach 1 covers columns 0 to 2, reach 2 covers columns 1 to 3 and wins overlaps where it has data
+	dir := t.TempDir()
+	entries := []library.Entry{
+		{ReachID: "1", Flow: "100", ControlStage: "nd", Path: filepath.Join(dir, "1.tif")},
+		{ReachID: "2", Flow: "200", ControlStage: "1_5", Path: filepath.Join(dir, "2.tif")},
+	}
+	for i, r := range []*utils.Raster{
+		{Width: 3, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{1, 2, 0.5}},
+		{Width: 3, Height: 1, GeoTransform: [6]float64{1, 1, 0, 1, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{nd, 4, 3}},
+	} {
+		if err := utils.WriteRaster(r, "EPSG:4326", entries[i].Path, "GTiff", utils.CreationOptions{Compress: "LZW"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	point := func(id string, lon float64) utils.Feature {
+		return utils.Feature{ID: id, Geometry: utils.Geometry{Type: "Point", Rings: [][][2]float64{{{lon, 0.5}}}}}
+	}
+	features := []utils.Feature{
+		point("a", 0.5), // reach 1 only
+		point("b", 1.5), // reach 2 has nodata, reach 1 provides the depth
+		// footprint over columns 1 to 3, deepest sample is reach 2 in column 2
+		{ID: "c", Geometry: utils.Geometry{Type: "Polygon", Rings: [][][2]float64{{{1.2, 0.2}, {3.8, 0.2}, {3.8, 0.8}, {1.2, 0.8}, {1.2, 0.2}}}}},
+		point("d", 2.5), // reach 2 wins over reach 1 in column 2
+		point("e", 5),   // outside the FIMs
+	}
+
+	impacts, err := sampleImpacts(features, "", entries, 1, 2)
+	if err != nil {
+		t.Fatalf("sampleImpacts() error = %v", err)
+	}
+	want := []structureImpact{
+		{id: "a"}, // depth 1 is not above min depth
+		{id: "b", inundated: true, maxDepth: 2, entry: &entries[0]},
+		{id: "c", inundated: true, maxDepth: 4, entry: &entries[1]},
+		{id: "d", inundated: true, maxDepth: 4, entry: &entries[1]},
+		{id: "e"},
+	}
+	if len(impacts) != len(want) {
+		t.Fatalf("sampleImpacts() returned %d impacts, want %d", len(impacts), len(want))
+	}
+	for i, w := range want {
+		if impacts[i] != w {
+			t.Errorf("sampleImpacts()[%d] = %+v, want %+v", i, impacts[i], w)
+		}
+	}
+}
+
+func TestWriteReachSummary(t *testing.T) {
+	entries := []library.Entry{{ReachID: "1"}, {ReachID: "2"}}
+	impacts := []structureImpact{
+		{id: "a"},
+		{id: "b", inundated: true, maxDepth: 2, entry: &entries[0]},
+		{id: "c", inundated: true, maxDepth: 4, entry: &entries[1]},
+		{id: "d", inundated: true, maxDepth: 3, entry: &entries[1]},
+	}
+
+	reachFile := filepath.Join(t.TempDir(), "reaches.csv")
+	if err := writeReachSummary(impacts, reachFile); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(reachFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "reach_id,inundated_count,max_depth\n1,1,2\n2,2,4\n"; string(got) != want {
+		t.Errorf("writeReachSummary() wrote %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,268 @@
+package library
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+var domainUsage string = `Usage of library build-domain:
+Write '<reach>/domain.tif' for reaches of a FIM library that do not have one, so 'fim -with_domain' and 'domain'
+have a background for every reach. The domain is the union footprint of all FIMs of the reach, every pixel with data
+in any FIM is 0 and other pixels are nodata. With -db and -layer the domain is the model boundary polygon of the reach
+instead; reaches without a polygon fall back to the FIM footprint. Boundary polygons are reprojected to the library
+coordinate system and rasterized on the grid covering the FIMs of the reach, so the domain lines up with its FIMs.
+GDAL VSI paths can be used for the library, writing to it needs gdal_cp.
+The FIMs of -cc reaches are read into memory at a time.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+// domainNoData is used when library FIMs have no nodata value
+const domainNoData = -9999
+
+// identifierPattern matches column names that are safe in an OGR SQL WHERE clause
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reachFIMs are the FIMs of a reach and whether it already has a domain
+type reachFIMs struct {
+	reachID   string
+	fims      []string
+	hasDomain bool
+}
+
+func buildDomain(args []string) error {
+	flags := flag.NewFlagSet("library build-domain", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(domainUsage)
+		flags.PrintDefaults()
+	}
+
+	var fimLibDir, dbPath, layer, idColumn string
+	var overwrite bool
+	var concurrent int
+	var creation utils.CreationOptions
+
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&dbPath, "db", "", "Optional vector file (e.g. the reach GeoPackage) with model boundary polygons, needs -layer")
+	flags.StringVar(&layer, "layer", "", "Layer of -db with model boundary polygons")
+	flags.StringVar(&idColumn, "id_column", "reach_id", "Column of -layer with the reach_id of each polygon")
+	flags.BoolVar(&overwrite, "overwrite", false, "If true, existing domain.tif files are replaced")
+	flags.IntVar(&concurrent, "cc", 10, "Concurrent Count, number of reaches to process concurrently")
+	creation.RegisterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	if fimLibDir == "" {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	if (dbPath == "") != (layer == "") {
+		return fmt.Errorf("-db and -layer must be used together")
+	}
+	if !identifierPattern.MatchString(idColumn) {
+		return fmt.Errorf("invalid -id_column '%s'", idColumn)
+	}
+	if err := creation.Validate(); err != nil {
+		return err
+	}
+
+	absFimLibPath, err := library.AbsPath(fimLibDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+	}
+
+	requiredTools := append([]string{"gdalinfo"}, creation.RequiredTools("COG")...)
+	if dbPath != "" {
+		requiredTools = append(requiredTools, "ogr2ogr", "gdal_rasterize")
+	}
+	if strings.HasPrefix(absFimLibPath, "/vsi") {
+		requiredTools = append(requiredTools, utils.GDALLSName, utils.GDALCPName)
+	}
+	for _, tool := range requiredTools {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	files, reachErrs, err := library.Walk(absFimLibPath, concurrent)
+	if err != nil {
+		return err
+	}
+	reaches := groupReaches(files)
+
+	var todo []reachFIMs
+	for _, r := range reaches {
+		if (overwrite || !r.hasDomain) && len(r.fims) > 0 {
+			todo = append(todo, r)
+		}
+	}
+	if len(todo) == 0 {
+		if len(reachErrs) > 0 {
+			return fmt.Errorf("%d reach folders could not be read", len(reachErrs))
+		}
+		fmt.Println("Every reach already has a domain")
+		return nil
+	}
+
+	// Library rasters share one coordinate system, resolution and nodata value
+	info, err := utils.GDALInfo(todo[0].fims[0])
+	if err != nil {
+		return err
+	}
+	noData, ok := info.NoData()
+	if !ok {
+		noData = domainNoData
+	}
+
+	var fromBoundary atomic.Int64
+	failed := forEach(len(todo), concurrent, func(i int) error {
+		r := todo[i]
+		dstPath := library.JoinPath(absFimLibPath, r.reachID, "domain.tif")
+		if dbPath != "" {
+			err := boundaryDomain(dbPath, layer, whereReach(idColumn, r.reachID), r.fims, info.CoordinateSystem.WKT, noData, dstPath, creation)
+			if err == nil {
+				fromBoundary.Add(1)
+				return nil
+			}
+			if !errors.Is(err, utils.ErrNoFeatures) {
+				return fmt.Errorf("reach %s: %v", r.reachID, err)
+			}
+			slog.Info("No boundary polygon, using FIM footprint", "reach_id", r.reachID)
+		}
+		if err := footprintDomain(r.fims, info.CoordinateSystem.WKT, noData, dstPath, creation); err != nil {
+			return fmt.Errorf("reach %s: %v", r.reachID, err)
+		}
+		return nil
+	})
+
+	// Unreadable reach folders count as failed reaches
+	written := len(todo) - failed
+	failed += len(reachErrs)
+	fmt.Printf("Domains written for %d of %d reaches (%d from boundary polygons), %d failed\n",
+		written, len(reaches)+len(reachErrs), fromBoundary.Load(), failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d domains failed", failed, len(todo)+len(reachErrs))
+	}
+	return nil
+}
+
+// groupReaches groups library files by reach, sorted by reach_id
+func groupReaches(files []library.File) []reachFIMs {
+	byReach := map[string]*reachFIMs{}
+	var ids []string
+	for _, f := range files {
+		r, ok := byReach[f.ReachID]
+		if !ok {
+			r = &reachFIMs{reachID: f.ReachID}
+			byReach[f.ReachID] = r
+			ids = append(ids, f.ReachID)
+		}
+		if f.Domain {
+			r.hasDomain = true
+		} else {
+			r.fims = append(r.fims, f.Path)
+		}
+	}
+	sort.Strings(ids)
+
+	reaches := make([]reachFIMs, len(ids))
+	for i, id := range ids {
+		reaches[i] = *byReach[id]
+	}
+	return reaches
+}
+
+// whereReach returns the OGR SQL WHERE clause selecting a reach, numeric reach_ids are not quoted
+func whereReach(idColumn, reachID string) string {
+	if _, err := strconv.ParseInt(reachID, 10, 64); err == nil {
+		return fmt.Sprintf("%s = %s", idColumn, reachID)
+	}
+	return fmt.Sprintf("%s = '%s'", idColumn, strings.ReplaceAll(reachID, "'", "''"))
+}
+
+// footprintDomain writes the union footprint of FIMs as a COG
+func footprintDomain(fims []string, srsWKT string, noData float64, dstPath string, creation utils.CreationOptions) error {
+	rasters, err := utils.ReadRasters(fims, 1)
+	if err != nil {
+		return err
+	}
+	mosaic, err := utils.NewMosaic(rasters)
+	if err != nil {
+		return err
+	}
+	fp, err := footprint(mosaic, noData)
+	if err != nil {
+		return err
+	}
+	return utils.WriteRaster(fp, srsWKT, dstPath, "COG", creation)
+}
+
+// footprint returns a raster on the mosaic grid that is 0 where any raster has data and noData elsewhere
+func footprint(mosaic *utils.Mosaic, noData float64) (*utils.Raster, error) {
+	fp := mosaic.NewRaster(noData)
+	idxs := make([]int, len(mosaic.Rasters))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	row, src := make([]float32, fp.Width), make([]int, fp.Width)
+	for y := 0; y < fp.Height; y++ {
+		for x := range src {
+			src[x] = -1
+		}
+		if err := mosaic.CompositeRow(y, idxs, row, src); err != nil {
+			return nil, err
+		}
+		for x, s := range src {
+			if s != -1 {
+				fp.Data[y*fp.Width+x] = 0
+			}
+		}
+	}
+	return fp, nil
+}
+
+// boundaryDomain rasterizes the boundary polygon of a reach as 0 on the grid covering the reach FIMs and writes it as a COG
+func boundaryDomain(dbPath, layer, where string, fims []string, srsWKT string, noData float64, dstPath string, creation utils.CreationOptions) error {
+	headers := make([]utils.RasterHeader, len(fims))
+	for i, fim := range fims {
+		info, err := utils.GDALInfo(fim)
+		if err != nil {
+			return err
+		}
+		headers[i] = info.Header()
+	}
+	grid, _, err := utils.MosaicGrid(headers)
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := os.MkdirTemp("", "f2f_domain_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	rasterized := filepath.Join(tempDir, "domain.tif")
+	if err := utils.RasterizeLayer(dbPath, layer, where, srsWKT, grid, 0, noData, rasterized); err != nil {
+		return err
+	}
+
+	return utils.WriteStaged(dstPath, func(local string) error {
+		return utils.Translate(rasterized, local, "COG", creation)
+	})
+}
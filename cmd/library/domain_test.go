@@ -0,0 +1,50 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestFootprint(t *testing.T) {
+	const nd = -9999
+	a := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{0, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{1, nd}}
+	b := &utils.Raster{Width: 2, Height: 1, GeoTransform: [6]float64{2, 1, 0, 0, 0, -1}, NoData: nd, HasNoData: true, Data: []float32{nd, 0}}
+	mosaic, err := utils.NewMosaic([]*utils.Raster{a, b})
+	if err != nil {
+		t.Fatalf("NewMosaic() error = %v", err)
+	}
+	fp, err := footprint(mosaic, nd)
+	if err != nil {
+		t.Fatalf("footprint() error = %v", err)
+	}
+	if want := []float32{0, nd, nd, 0}; !reflect.DeepEqual(fp.Data, want) {
+		t.Errorf("footprint() = %v, want %v", fp.Data, want)
+	}
+}
+
+func TestGroupReaches(t *testing.T) {
+	files := []library.File{
+		{Path: "/lib/2/z_nd/f_1.tif", ReachID: "2"},
+		{Path: "/lib/1/domain.tif", ReachID: "1", Domain: true},
+		{Path: "/lib/1/z_nd/f_5.tif", ReachID: "1"},
+	}
+	want := []reachFIMs{
+		{reachID: "1", fims: []string{"/lib/1/z_nd/f_5.tif"}, hasDomain: true},
+		{reachID: "2", fims: []string{"/lib/2/z_nd/f_1.tif"}},
+	}
+	if got := groupReaches(files); !reflect.DeepEqual(got, want) {
+		t.Errorf("groupReaches() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWhereReach(t *testing.T) {
+	if got := whereReach("reach_id", "2821866"); got != "reach_id = 2821866" {
+		t.Errorf("whereReach() = %q", got)
+	}
+	if got := whereReach("model", "o'neil"); got != "model = 'o''neil'" {
+		t.Errorf("whereReach() = %q", got)
+	}
+}
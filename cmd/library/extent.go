@@ -0,0 +1,156 @@
+package library
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+var extentUsage string = `Usage of library derive-extent:
+Given a depth library, write a mirror extent library with the same '<reach>/z_*/f_*.tif' and '<reach>/domain.tif' structure.
+Extent rasters are Byte COGs: 1 where depth is above -min_depth, 0 where the depth raster has data but is not deeper,
+and 255 (nodata) elsewhere. Domains are converted the same way.
+GDAL VSI paths can be used for both libraries. Listing a VSI library needs gdal_ls and writing to a VSI library needs gdal_cp.
+Each raster is read into memory, -cc rasters at a time.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+// extentNoData is nodata of extent rasters
+const extentNoData = 255
+
+func deriveExtent(args []string) error {
+	flags := flag.NewFlagSet("library derive-extent", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(extentUsage)
+		flags.PrintDefaults()
+	}
+
+	var fimLibDir, outputDir string
+	var minDepth float64
+	var skipExisting bool
+	var concurrent int
+	var creation utils.CreationOptions
+
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing the depth FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&outputDir, "o", "", "Output directory of the extent library. GDAL VSI paths can be used")
+	flags.Float64Var(&minDepth, "min_depth", 0, "Pixels are wet when their depth is greater than this value")
+	flags.BoolVar(&skipExisting, "skip_existing", false, "If true, extent rasters that already exist in the output library are not written again")
+	flags.IntVar(&concurrent, "cc", 10, "Concurrent Count, number of rasters to convert concurrently")
+	creation.RegisterFlags(flags)
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	if fimLibDir == "" || outputDir == "" {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	if err := creation.Validate(); err != nil {
+		return err
+	}
+	if creation.DataType != "" || creation.Scale != 0 || creation.NoData != "" {
+		return fmt.Errorf("-ot, -scale and -nodata can not be used, extent rasters are always Byte with nodata %d", extentNoData)
+	}
+	creation.DataType = "Byte"
+
+	absFimLibPath, err := library.AbsPath(fimLibDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+	}
+	absOutputPath, err := library.AbsPath(outputDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for output directory: %v", err)
+	}
+	if absOutputPath == absFimLibPath {
+		return fmt.Errorf("output directory must not be the depth library")
+	}
+
+	requiredTools := append([]string{"gdalinfo"}, creation.RequiredTools("COG")...)
+	if strings.HasPrefix(absFimLibPath, "/vsi") {
+		requiredTools = append(requiredTools, utils.GDALLSName)
+	}
+	if utils.IsVSI(absOutputPath) {
+		requiredTools = append(requiredTools, utils.GDALCPName)
+	}
+	for _, tool := range requiredTools {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	files, reachErrs, err := library.Walk(absFimLibPath, concurrent)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no FIMs or domains found in %s", fimLibDir)
+	}
+
+	// Library rasters share one coordinate system
+	info, err := utils.GDALInfo(files[0].Path)
+	if err != nil {
+		return err
+	}
+
+	var existing map[string]bool
+	if skipExisting {
+		existing = map[string]bool{}
+		if outFiles, _, err := library.Walk(absOutputPath, concurrent); err == nil {
+			for _, f := range outFiles {
+				existing[f.Rel] = true
+			}
+		}
+	}
+
+	var written, skipped atomic.Int64
+	failed := forEach(len(files), concurrent, func(i int) error {
+		f := files[i]
+		if existing[f.Rel] {
+			skipped.Add(1)
+			return nil
+		}
+		r, err := utils.ReadRaster(f.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Rel, err)
+		}
+		dstPath := library.JoinPath(absOutputPath, filepath.FromSlash(f.Rel))
+		if err := utils.WriteRaster(extentRaster(r, minDepth), info.CoordinateSystem.WKT, dstPath, "COG", creation); err != nil {
+			return fmt.Errorf("%s: %v", f.Rel, err)
+		}
+		written.Add(1)
+		return nil
+	})
+
+	fmt.Printf("Extent library created at %s: %d written, %d skipped, %d failed, %d reach folders unreadable\n",
+		outputDir, written.Load(), skipped.Load(), failed, len(reachErrs))
+	if failed > 0 || len(reachErrs) > 0 {
+		return fmt.Errorf("%d of %d library rasters and %d reach folders failed", failed, len(files), len(reachErrs))
+	}
+	return nil
+}
+
+// extentRaster converts a depth raster to extent values in place: 1 where depth is greater than minDepth,
+// 0 where it has data and extentNoData elsewhere
+func extentRaster(r *utils.Raster, minDepth float64) *utils.Raster {
+	for i, v := range r.Data {
+		switch {
+		case r.IsNoData(v):
+			r.Data[i] = extentNoData
+		case float64(v) > minDepth:
+			r.Data[i] = 1
+		default:
+			r.Data[i] = 0
+		}
+	}
+	r.NoData, r.HasNoData = extentNoData, true
+	return r
+}
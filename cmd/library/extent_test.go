@@ -0,0 +1,19 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestExtentRaster(t *testing.T) {
+	r := &utils.Raster{Width: 4, Height: 1, NoData: -9999, HasNoData: true, Data: []float32{-9999, 0, 0.2, 3}}
+	extentRaster(r, 0.5)
+	if want := []float32{extentNoData, 0, 0, 1}; !reflect.DeepEqual(r.Data, want) {
+		t.Errorf("extentRaster() = %v, want %v", r.Data, want)
+	}
+	if r.NoData != extentNoData || !r.HasNoData {
+		t.Errorf("extentRaster() nodata = %v, %v, want %v", r.NoData, r.HasNoData, extentNoData)
+	}
+}
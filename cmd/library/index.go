@@ -0,0 +1,235 @@
+package library
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+var indexUsage string = `Usage of library index:
+Write a spatial index of a FIM library to a GeoPackage (.gpkg) or FlatGeobuf (.fgb) file, so reaches can be found by location
+without opening every raster, e.g. with 'flows2fim domain -aoi <path> -index <path>' or 'flows2fim sample -index <path>'.
+The index has one feature per reach in layer 'reaches' (FlatGeobuf names its only layer after the file),
+in the library coordinate system, with attributes:
+  reach_id, fim_count, footprint, min_x, min_y, max_x, max_y
+The geometry is the domain traced from '<reach>/domain.tif' (footprint 'domain'), or the bounding box of the reach FIMs
+for reaches without a domain (footprint 'bounds'). min_x to max_y is the bounding box of the domain and all FIMs of the reach.
+GDAL VSI paths can be used for library and output, given GDAL must have access to cloud creds.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+// reachIndex is a reach feature of a library index
+type reachIndex struct {
+	reachID   string
+	fimCount  int
+	footprint string
+	bounds    [4]float64       // minX, minY, maxX, maxY in the library coordinate system
+	polygons  [][][][2]float64 // footprint rings in the library coordinate system
+}
+
+func buildIndex(args []string) error {
+	flags := flag.NewFlagSet("library index", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(indexUsage)
+		flags.PrintDefaults()
+	}
+
+	var fimLibDir, outputFile string
+	var concurrent int
+
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&outputFile, "o", "", "Output index file path, .gpkg or .fgb")
+	flags.IntVar(&concurrent, "cc", 10, "Concurrent Count, number of reaches to process concurrently")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	if fimLibDir == "" || outputFile == "" {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	format, err := library.IndexFormat(outputFile)
+	if err != nil {
+		return err
+	}
+
+	absFimLibPath, err := library.AbsPath(fimLibDir)
+	if err != nil {
+		return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+	}
+
+	requiredTools := []string{"gdalinfo", utils.GDALPolygonizeName, "ogr2ogr"}
+	if strings.HasPrefix(absFimLibPath, "/vsi") {
+		requiredTools = append(requiredTools, utils.GDALLSName)
+	}
+	if utils.IsVSI(outputFile) {
+		requiredTools = append(requiredTools, utils.GDALCPName)
+	}
+	for _, tool := range requiredTools {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	files, reachErrs, err := library.Walk(absFimLibPath, concurrent)
+	if err != nil {
+		return err
+	}
+	reaches := groupReaches(files)
+	if len(reaches) == 0 {
+		return fmt.Errorf("no FIMs or domains found in library")
+	}
+
+	// Library rasters share one coordinate system
+	first := library.JoinPath(absFimLibPath, reaches[0].reachID, "domain.tif")
+	if !reaches[0].hasDomain {
+		first = reaches[0].fims[0]
+	}
+	info, err := utils.GDALInfo(first)
+	if err != nil {
+		return err
+	}
+
+	indexed := make([]*reachIndex, len(reaches))
+	failed := forEach(len(reaches), concurrent, func(i int) error {
+		r := reaches[i]
+		ri, err := indexReach(r, library.JoinPath(absFimLibPath, r.reachID, "domain.tif"))
+		if err != nil {
+			return fmt.Errorf("reach %s: %v", r.reachID, err)
+		}
+		indexed[i] = ri
+		return nil
+	})
+
+	tempDir, err := os.MkdirTemp("", "f2f_index_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	featuresPath := filepath.Join(tempDir, "reaches.geojson")
+	if err := writeIndexFeatures(indexed, featuresPath); err != nil {
+		return err
+	}
+
+	if err := utils.WriteStaged(outputFile, func(local string) error {
+		return utils.TranslateVector(featuresPath, local, format, info.CoordinateSystem.WKT, library.IndexLayer)
+	}); err != nil {
+		return err
+	}
+
+	// Unreadable reach folders count as failed reaches
+	total := len(reaches) + len(reachErrs)
+	failed += len(reachErrs)
+	fmt.Printf("Library index created at %s for %d of %d reaches, %d failed\n", outputFile, total-failed, total, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d reaches failed", failed, total)
+	}
+	return nil
+}
+
+// indexReach reads the bounds of every raster of a reach and traces its domain
+func indexReach(r reachFIMs, domainPath string) (*reachIndex, error) {
+	ri := &reachIndex{reachID: r.reachID, fimCount: len(r.fims), footprint: library.FootprintBounds}
+	rasters := r.fims
+	if r.hasDomain {
+		rasters = append([]string{domainPath}, r.fims...)
+	}
+
+	for i, path := range rasters {
+		info, err := utils.GDALInfo(path)
+		if err != nil {
+			return nil, err
+		}
+		b := rasterBounds(info)
+		if i == 0 {
+			ri.bounds = b
+		} else {
+			ri.bounds = unionBounds(ri.bounds, b)
+		}
+	}
+
+	if r.hasDomain {
+		polygons, err := utils.Polygonize(domainPath)
+		if err != nil {
+			return nil, fmt.Errorf("error tracing domain: %v", err)
+		}
+		if len(polygons) > 0 {
+			ri.polygons, ri.footprint = polygons, library.FootprintDomain
+			return ri, nil
+		}
+		slog.Warn("Domain has no data, using bounds as footprint", "reach_id", r.reachID)
+	}
+	ri.polygons = [][][][2]float64{boundsRing(ri.bounds)}
+	return ri, nil
+}
+
+// rasterBounds returns the bounding box of a raster as minX, minY, maxX, maxY in its coordinate system
+func rasterBounds(info *utils.RasterInfo) [4]float64 {
+	gt := info.GeoTransform
+	x0, x1 := gt[0], gt[0]+gt[1]*float64(info.Size[0])+gt[2]*float64(info.Size[1])
+	y0, y1 := gt[3], gt[3]+gt[4]*float64(info.Size[0])+gt[5]*float64(info.Size[1])
+	return [4]float64{math.Min(x0, x1), math.Min(y0, y1), math.Max(x0, x1), math.Max(y0, y1)}
+}
+
+// unionBounds returns the bounding box of two bounding boxes
+func unionBounds(a, b [4]float64) [4]float64 {
+	return [4]float64{math.Min(a[0], b[0]), math.Min(a[1], b[1]), math.Max(a[2], b[2]), math.Max(a[3], b[3])}
+}
+
+// boundsRing returns a bounding box as a closed counter clockwise polygon
+func boundsRing(b [4]float64) [][][2]float64 {
+	return [][][2]float64{{{b[0], b[1]}, {b[2], b[1]}, {b[2], b[3]}, {b[0], b[3]}, {b[0], b[1]}}}
+}
+
+// writeIndexFeatures writes reaches as a GeoJSON FeatureCollection of MultiPolygons in the library coordinate system,
+// nil reaches are skipped
+func writeIndexFeatures(reaches []*reachIndex, dstPath string) error {
+	type feature struct {
+		Type       string                 `json:"type"`
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string           `json:"type"`
+			Coordinates [][][][2]float64 `json:"coordinates"`
+		} `json:"geometry"`
+	}
+	fc := struct {
+		Type     string    `json:"type"`
+		Features []feature `json:"features"`
+	}{Type: "FeatureCollection", Features: []feature{}}
+
+	for _, r := range reaches {
+		if r == nil {
+			continue
+		}
+		f := feature{Type: "Feature", Properties: map[string]interface{}{
+			"reach_id":  r.reachID,
+			"fim_count": r.fimCount,
+			"footprint": r.footprint,
+			"min_x":     r.bounds[0],
+			"min_y":     r.bounds[1],
+			"max_x":     r.bounds[2],
+			"max_y":     r.bounds[3],
+		}}
+		f.Geometry.Type = "MultiPolygon"
+		f.Geometry.Coordinates = r.polygons
+		fc.Features = append(fc.Features, f)
+	}
+
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return fmt.Errorf("error encoding library index: %v", err)
+	}
+	return os.WriteFile(dstPath, data, 0644)
+}
@@ -0,0 +1,47 @@
+package library
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestRasterBounds(t *testing.T) {
+	info := &utils.RasterInfo{Size: [2]int{4, 2}, GeoTransform: [6]float64{100, 10, 0, 500, 0, -10}}
+	if got, want := rasterBounds(info), [4]float64{100, 480, 140, 500}; got != want {
+		t.Errorf("rasterBounds() = %v, want %v", got, want)
+	}
+	if got, want := unionBounds([4]float64{0, 0, 2, 2}, [4]float64{1, -1, 3, 1}), [4]float64{0, -1, 3, 2}; got != want {
+		t.Errorf("unionBounds() = %v, want %v", got, want)
+	}
+}
+
+func TestWriteIndexFeatures(t *testing.T) {
+	b := [4]float64{0, 0, 2, 1}
+	reaches := []*reachIndex{
+		{reachID: "100", fimCount: 3, footprint: "bounds", bounds: b, polygons: [][][][2]float64{boundsRing(b)}},
+		nil, // failed reach
+	}
+	path := filepath.Join(t.TempDir(), "reaches.geojson")
+	if err := writeIndexFeatures(reaches, path); err != nil {
+		t.Fatal(err)
+	}
+
+	features, err := utils.ReadGeoJSON(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 {
+		t.Fatalf("got %d features, want 1", len(features))
+	}
+	f := features[0]
+	wantProps := map[string]interface{}{"reach_id": "100", "fim_count": 3.0, "footprint": "bounds", "min_x": 0.0, "min_y": 0.0, "max_x": 2.0, "max_y": 1.0}
+	if !reflect.DeepEqual(f.Properties, wantProps) {
+		t.Errorf("properties = %v, want %v", f.Properties, wantProps)
+	}
+	if f.Geometry.Type != "MultiPolygon" || !reflect.DeepEqual(f.Geometry.Rings, boundsRing(b)) {
+		t.Errorf("geometry = %s %v, want MultiPolygon %v", f.Geometry.Type, f.Geometry.Rings, boundsRing(b))
+	}
+}
@@ -0,0 +1,72 @@
+package library
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+var usage string = `Usage of library:
+Tools to derive products from a FIM library.
+	flows2fim library SUBCOMMAND Args
+	flows2fim library SUBCOMMAND --help
+
+Available Subcommands:
+  - derive-extent: Given a depth library, write a mirror extent library of Byte COGs with the same structure.
+  - build-domain: Given a library, write domain.tif for reaches without one from their FIM footprints or model boundary polygons.
+  - index: Given a library, write a GeoPackage or FlatGeobuf with the footprint and bounding box of every reach.
+`
+
+func Run(args []string) error {
+	if len(args) < 1 {
+		fmt.Print(usage)
+		return fmt.Errorf("missing subcommand. See 'flows2fim library --help' for available subcommands")
+	}
+
+	switch args[0] {
+	case "-h", "--h", "-help", "--help":
+		fmt.Print(usage)
+		return nil
+	case "derive-extent":
+		return deriveExtent(args[1:])
+	case "build-domain":
+		return buildDomain(args[1:])
+	case "index":
+		return buildIndex(args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand '%s' see 'flows2fim library --help' for available subcommands", args[0])
+	}
+}
+
+// forEach calls fn for indexes 0 to n-1 with at most concurrent calls at a time.
+// Failures are logged and counted so one bad raster or reach does not stop the whole library.
+func forEach(n, concurrent int, fn func(i int) error) (failed int) {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	idx := make(chan int)
+	for w := 0; w < concurrent; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				if err := fn(i); err != nil {
+					slog.Error("Library task failed", "error", err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+	return failed
+}
@@ -0,0 +1,142 @@
+package sample
+
+import (
+	"flag"
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+var usage string = `Usage of sample:
+Given a points file and a control table with a fim library folder (or an existing composite FIM),
+return the depth or extent value and the contributing reach_id at each point.
+When a control table is given, only library FIMs whose bounds contain a point are read. With -index, FIMs of reaches whose
+domain footprint in a 'flows2fim library index' file contains no point are left out before any FIM is opened.
+Precedence is the same as in the composite FIM, later reaches in the control table win.
+Interpolated controls (flow_upper and weight columns) are blended at each point the same way as in 'fim'.
+GDAL VSI paths can be used for library and composite FIM, given GDAL must have access to cloud creds.
+
+Points file can be:
+- A CSV with 'lat' and 'lon' columns (also 'latitude'/'y' and 'long'/'lng'/'longitude'/'x') and an optional 'id' column
+- A GeoJSON FeatureCollection of Point features, feature id or 'id' property is used as point id
+Coordinates must be WGS84 longitude/latitude.
+
+Output CSV has columns id, lon, lat, value, reach_id, flow, control_stage.
+value is empty for points on nodata or outside all FIMs. reach_id, flow and control_stage are empty when sampling a composite FIM.
+
+Arguments:` // Usage should be always followed by PrintDefaults()
+
+func Run(args []string) error {
+	flags := flag.NewFlagSet("sample", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println(usage)
+		flags.PrintDefaults()
+	}
+
+	var pointsFile, controlsFile, fimLibDir, fimFile, indexFile, outputFile string
+	var concurrent int
+
+	flags.StringVar(&pointsFile, "p", "", "Path to the points CSV or GeoJSON file")
+	flags.StringVar(&controlsFile, "c", "", "Path to the controls CSV file, requires -lib")
+	flags.StringVar(&fimLibDir, "lib", "", "Directory containing FIM Library. GDAL VSI paths can be used, given GDAL must have access to cloud creds")
+	flags.StringVar(&fimFile, "fim", "", "Path to an existing composite FIM to sample instead of -c and -lib")
+	flags.StringVar(&indexFile, "index", "", "Optional library index (.gpkg or .fgb) written by 'flows2fim library index', used with -c and -lib to skip reaches away from the points")
+	flags.StringVar(&outputFile, "o", "", "Output CSV file path")
+	flags.IntVar(&concurrent, "cc", 25, "Concurrent Count, number of FIMs to read concurrently")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("error parsing flags: %v", err)
+	}
+
+	// Validate required flags
+	if pointsFile == "" || outputFile == "" || fimFile == "" && (controlsFile == "" || fimLibDir == "") {
+		fmt.Println("Missing required flags")
+		flags.PrintDefaults()
+		return fmt.Errorf("missing required flags")
+	}
+	if fimFile != "" && (controlsFile != "" || fimLibDir != "") {
+		return fmt.Errorf("-fim can not be used with -c and -lib")
+	}
+	if fimFile != "" && indexFile != "" {
+		return fmt.Errorf("-index can only be used with -c and -lib")
+	}
+
+	requiredTools := []string{"gdalinfo", "gdallocationinfo"}
+	if indexFile != "" {
+		requiredTools = append(requiredTools, "ogr2ogr")
+	}
+	for _, tool := range requiredTools {
+		if !utils.CheckGDALToolAvailable(tool) {
+			slog.Error("GDAL tool missing", "tool", tool)
+			return fmt.Errorf("%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH", tool)
+		}
+	}
+
+	points, err := utils.ReadPoints(pointsFile)
+	if err != nil {
+		return err
+	}
+	slog.Debug("Read points", "points_count", len(points))
+
+	var samples []library.Sample
+	if fimFile != "" {
+		samples, err = library.SampleRaster(fimFile, points)
+	} else {
+		var absFimLibPath string
+		absFimLibPath, err = library.AbsPath(fimLibDir)
+		if err != nil {
+			return fmt.Errorf("error getting absolute path for FIM library directory: %v", err)
+		}
+
+		var entries []library.Entry
+		entries, err = library.ReadControls(controlsFile, absFimLibPath)
+		if err != nil {
+			return err
+		}
+		if indexFile != "" {
+			index, err := library.ReadIndex(indexFile)
+			if err != nil {
+				return err
+			}
+			kept := library.PointEntries(entries, index, points)
+			slog.Debug("Filtered FIMs with library index", "fims_count", len(entries), "kept_count", len(kept))
+			entries = kept
+		}
+		samples, err = library.SampleEntries(entries, points, concurrent)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := writeSamples(points, samples, outputFile); err != nil {
+		return fmt.Errorf("error writing samples: %v", err)
+	}
+
+	fmt.Printf("Point samples created at %s\n", outputFile)
+	return nil
+}
+
+func writeSamples(points []utils.Point, samples []library.Sample, filePath string) error {
+	records := [][]string{{"id", "lon", "lat", "value", "reach_id", "flow", "control_stage"}}
+	for i, p := range points {
+		record := []string{
+			p.ID,
+			strconv.FormatFloat(p.Lon, 'f', -1, 64),
+			strconv.FormatFloat(p.Lat, 'f', -1, 64),
+			"", "", "", "",
+		}
+		if s := samples[i]; s.OK {
+			record[3] = strconv.FormatFloat(s.Value, 'f', -1, 64)
+			if s.Entry != nil {
+				record[4] = s.Entry.ReachID
+				record[5] = s.Entry.Flow
+				record[6] = strings.ReplaceAll(s.Entry.ControlStage, "_", ".")
+			}
+		}
+		records = append(records, record)
+	}
+	return utils.WriteCSV(filePath, records)
+}
@@ -0,0 +1,46 @@
+package sample
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"flows2fim/internal/library"
+	"flows2fim/pkg/utils"
+)
+
+func TestWriteSamples(t *testing.T) {
+	points := []utils.Point{{ID: "a", Lon: -95.5, Lat: 30.25}, {ID: "b", Lon: -95, Lat: 30}, {ID: "c", Lon: -94, Lat: 29}}
+	entry := library.Entry{ReachID: "2821866", Flow: "100", ControlStage: "53_5"}
+	samples := []library.Sample{
+		{Value: 1.5, OK: true, Entry: &entry},
+		{Value: 2, OK: true}, // sampled from a composite FIM
+		{},                   // nodata or outside all FIMs
+	}
+
+	path := filepath.Join(t.TempDir(), "out", "samples.csv")
+	if err := writeSamples(points, samples, path); err != nil {
+		t.Fatalf("writeSamples() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "id,lon,lat,value,reach_id,flow,control_stage\n" +
+		"a,-95.5,30.25,1.5,2821866,100,53.5\n" +
+		"b,-95,30,2,,,\n" +
+		"c,-94,29,,,,\n"
+	if string(data) != want {
+		t.Errorf("writeSamples() wrote\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestRunFlags(t *testing.T) {
+	if err := Run([]string{"-p", "points.csv", "-o", "out.csv", "-fim", "fim.tif", "-c", "controls.csv"}); err == nil {
+		t.Error("Run() with -fim and -c: expected error")
+	}
+	if err := Run([]string{"-p", "points.csv", "-o", "out.csv", "-c", "controls.csv"}); err == nil {
+		t.Error("Run() with -c and without -lib: expected error")
+	}
+}
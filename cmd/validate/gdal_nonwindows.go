@@ -1,5 +0,0 @@
-//go:build !windows
-
-package validate
-
-var gdalLSName = "gdal_ls.py"
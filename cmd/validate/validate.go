@@ -1,8 +1,6 @@
 package validate
 
 import (
-	"bufio"
-	"bytes"
 	"database/sql"
 	"encoding/csv"
 	"flag"
@@ -10,7 +8,6 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -122,107 +119,17 @@ type fimRow struct {
 	boundaryCondition string
 }
 
-// dirEntry holds a path + info about whether it's a directory
-type dirEntry struct {
-	path  string
-	isDir bool
-}
-
-// readDir is the wrapper that calls either gatherLocalEntries or gatherCloudEntries
-// to get all paths (files + dirs).
-// If recursive is true, it will recursively list all files and directories.
-func readDir(dir string, recursive bool) ([]dirEntry, error) {
-	var allEntries []dirEntry
-	var err error
-
-	if strings.HasPrefix(dir, "/vsi") {
-		allEntries, err = gatherVSIEntries(dir, recursive)
-	} else {
-		allEntries, err = gatherLocalEntries(dir, recursive)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("error gathering entries from %s: %v", dir, err)
-	}
-
-	return allEntries, nil
-}
-
-// gatherLocalEntries uses either os.ReadDir (non-recursive) or filepath.WalkDir (recursive)
-func gatherLocalEntries(dir string, recursive bool) ([]dirEntry, error) {
-	if !recursive {
-		// Non-recursive approach: just top-level entries
-		entries, err := os.ReadDir(dir)
-		if err != nil {
-			return nil, err
-		}
-		var results []dirEntry
-		for _, e := range entries {
-			results = append(results, dirEntry{
-				path:  filepath.Join(dir, e.Name()),
-				isDir: e.IsDir(),
-			})
-		}
-		return results, nil
-	}
-
-	// Recursive approach with WalkDir
-	var results []dirEntry
-	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, werr error) error {
-		if werr != nil {
-			return werr
-		}
-		results = append(results, dirEntry{path: path, isDir: d.IsDir()})
-		return nil
-	})
-	return results, err
-}
-
-// gatherVSIEntries calls gdal_ls (with or without -r) to list entries in a VSI path
-func gatherVSIEntries(dir string, recursive bool) ([]dirEntry, error) {
-	var args []string
-	if recursive {
-		args = []string{"-r", dir}
-	} else {
-		args = []string{dir}
-	}
-
-	cmd := exec.Command(gdalLSName, args...)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("error gathering entries from %s: %v", dir, err)
-	}
-
-	scanner := bufio.NewScanner(bytes.NewReader(out))
-	var lines []string
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	if err := scanner.Err(); err != nil {
-		slog.Warn("Error reading gdal_ls output", "tool", gdalLSName, "dir", dir, "error", err)
-	}
-
-	var results []dirEntry
-	for _, line := range lines {
-		if line == "" || !strings.HasPrefix(line, "/") { // ignore lines not starting with /
-			continue
-		}
-		isDir := strings.HasSuffix(line, "/")
-		results = append(results, dirEntry{path: line, isDir: isDir})
-	}
-	return results, nil
-}
-
 // processLibEntry parse boundary condition folders (z_XXX) and flow tif files (f_*.tif) from dirEntry path.
 // It sends the parsed data to fimChan channel
-func processLibEntry(e dirEntry, absFimLibDir string, fimChan chan<- fimRow) {
+func processLibEntry(e utils.DirEntry, absFimLibDir string, fimChan chan<- fimRow) {
 	// Skip directories
-	if e.isDir {
+	if e.IsDir {
 		return
 	}
 
-	relPath, relErr := filepath.Rel(absFimLibDir, e.path)
+	relPath, relErr := filepath.Rel(absFimLibDir, e.Path)
 	if relErr != nil {
-		slog.Error("Relative path resolution failed", "path", e.path, "error", relErr)
+		slog.Error("Relative path resolution failed", "path", e.Path, "error", relErr)
 		return
 	}
 	// On windows relPath will have backslashes, convert to forward slashes for /vsi paths
@@ -230,7 +137,7 @@ func processLibEntry(e dirEntry, absFimLibDir string, fimChan chan<- fimRow) {
 		relPath = filepath.ToSlash(relPath)
 	}
 
-	name := filepath.Base(e.path)
+	name := filepath.Base(e.Path)
 	ext := filepath.Ext(name)
 	if utils.SliceContains(extIgnore, ext) {
 		return
@@ -486,9 +393,9 @@ func Run(args []string) error {
 	}
 
 	// Check if gdalbuildvrt or GDAL tool is available
-	if strings.HasPrefix(fimLibDir, "/vsi") && !utils.CheckGDALToolAvailable(gdalLSName) {
+	if strings.HasPrefix(fimLibDir, "/vsi") && !utils.CheckGDALToolAvailable(utils.GDALLSName) {
 		return fmt.Errorf(`%[1]s is not available. Please install GDAL and ensure %[1]s is in your PATH. %[1]s is not available in PATH
-		by default. Please refer to docs for instructions on how to add it to Path`, gdalLSName)
+		by default. Please refer to docs for instructions on how to add it to Path`, utils.GDALLSName)
 	}
 
 	// 1) Open the input DB ( we won't modify it).
@@ -542,14 +449,14 @@ func Run(args []string) error {
 	// sync/semaphore could also have been used here
 
 	// 4) Find top-level directories (reach folders) and process them
-	libEntries, err := readDir(absFimLibDir, false)
+	libEntries, err := utils.ReadDir(absFimLibDir, false)
 	if err != nil {
 		return fmt.Errorf("error reading fim library directory: %v", err)
 	}
 
-	var reachDirs []dirEntry
+	var reachDirs []utils.DirEntry
 	for _, de := range libEntries {
-		if de.isDir {
+		if de.IsDir {
 			reachDirs = append(reachDirs, de)
 		}
 	}
@@ -564,15 +471,15 @@ func Run(args []string) error {
 
 	var reachDir string
 	for _, de := range libEntries {
-		if de.isDir {
+		if de.IsDir {
 			wg.Add(1)
 			sem <- struct{}{} // Acquire concurrency token
 			go func(reachDir string) {
 				defer wg.Done()
 				defer func() { <-sem }() // Release token
-				reachEntries, err := readDir(de.path, true)
+				reachEntries, err := utils.ReadDir(de.Path, true)
 				if err != nil {
-					slog.Warn("Reach directory read error", "path", de.path, "error", err)
+					slog.Warn("Reach directory read error", "path", de.Path, "error", err)
 					return
 				}
 				for _, e := range reachEntries {
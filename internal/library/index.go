@@ -0,0 +1,113 @@
+package library
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"flows2fim/pkg/utils"
+)
+
+// IndexLayer is the name of the reach layer of a library index
+const IndexLayer = "reaches"
+
+// Sources of the footprint of a reach in a library index
+const (
+	FootprintDomain = "domain" // traced from <reach>/domain.tif
+	FootprintBounds = "bounds" // bounding box of the reach FIMs, the reach has no domain
+)
+
+// indexFormats maps library index file extensions to OGR formats
+var indexFormats = map[string]string{".gpkg": "GPKG", ".fgb": "FlatGeobuf"}
+
+// IndexEntry is a reach of a library index
+type IndexEntry struct {
+	ReachID   string
+	FIMCount  int
+	Footprint string         // FootprintDomain or FootprintBounds
+	Geometry  utils.Geometry // footprint in WGS84
+}
+
+// IndexFormat returns the OGR format of a library index from its extension, .gpkg or .fgb
+func IndexFormat(path string) (string, error) {
+	if format, ok := indexFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return format, nil
+	}
+	return "", fmt.Errorf("library index must be a GeoPackage (.gpkg) or FlatGeobuf (.fgb) file")
+}
+
+// indexLayer returns the layer of a library index to read. The FlatGeobuf driver names its only layer after the file,
+// whatever name it was written with, so the whole file is read.
+func indexLayer(path string) string {
+	if format, _ := IndexFormat(path); format == "FlatGeobuf" {
+		return ""
+	}
+	return IndexLayer
+}
+
+// ReadIndex reads the reaches of a library index written by 'library index', footprints are returned in WGS84
+func ReadIndex(path string) ([]IndexEntry, error) {
+	features, err := utils.ReadVector(path, indexLayer(path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading library index: %v", err)
+	}
+
+	entries := make([]IndexEntry, 0, len(features))
+	for _, f := range features {
+		reachID, ok := f.Properties["reach_id"].(string)
+		if !ok {
+			return nil, fmt.Errorf("library index feature %s has no reach_id", f.ID)
+		}
+		e := IndexEntry{ReachID: reachID, Geometry: f.Geometry}
+		if n, ok := f.Properties["fim_count"].(float64); ok {
+			e.FIMCount = int(n)
+		}
+		e.Footprint, _ = f.Properties["footprint"].(string)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// IntersectingReaches returns reach_ids of index entries with a domain footprint intersecting any of the geometries,
+// in index order
+func IntersectingReaches(entries []IndexEntry, geometries []utils.Geometry) []string {
+	var reachIDs []string
+	for _, e := range entries {
+		if e.Footprint != FootprintDomain {
+			continue
+		}
+		for _, g := range geometries {
+			if e.Geometry.Intersects(g) {
+				reachIDs = append(reachIDs, e.ReachID)
+				break
+			}
+		}
+	}
+	return reachIDs
+}
+
+// PointEntries returns the entries of reaches whose domain footprint in the index contains any of the points, in entries order.
+// Entries of reaches missing from the index, or indexed by the bounding box of their FIMs, are always kept.
+func PointEntries(entries []Entry, index []IndexEntry, points []utils.Point) []Entry {
+	hit := make(map[string]bool, len(index))
+	for _, e := range index {
+		if e.Footprint != FootprintDomain {
+			continue
+		}
+		contains := false
+		for _, p := range points {
+			if contains = e.Geometry.Contains(p.Lon, p.Lat); contains {
+				break
+			}
+		}
+		hit[e.ReachID] = hit[e.ReachID] || contains
+	}
+
+	var kept []Entry
+	for _, e := range entries {
+		if h, indexed := hit[e.ReachID]; !indexed || h {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,61 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestIndexFormat(t *testing.T) {
+	for path, want := range map[string]string{"index.gpkg": "GPKG", "/vsis3/bucket/index.FGB": "FlatGeobuf"} {
+		if got, err := IndexFormat(path); err != nil || got != want {
+			t.Errorf("IndexFormat(%s) = %s, %v, want %s", path, got, err, want)
+		}
+	}
+	if _, err := IndexFormat("index.shp"); err == nil {
+		t.Error("IndexFormat(index.shp): expected error")
+	}
+}
+
+func TestIndexLayer(t *testing.T) {
+	for path, want := range map[string]string{"index.gpkg": IndexLayer, "/vsis3/bucket/index.FGB": ""} {
+		if got := indexLayer(path); got != want {
+			t.Errorf("indexLayer(%s) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestIntersectingReaches(t *testing.T) {
+	square := func(x, y float64) utils.Geometry {
+		return utils.Geometry{Type: "Polygon", Rings: [][][2]float64{{{x, y}, {x + 1, y}, {x + 1, y + 1}, {x, y + 1}, {x, y}}}}
+	}
+	entries := []IndexEntry{
+		{ReachID: "100", Footprint: FootprintDomain, Geometry: square(0, 0)},
+		{ReachID: "200", Footprint: FootprintDomain, Geometry: square(5, 5)},
+		{ReachID: "300", Footprint: FootprintBounds, Geometry: square(0, 0)}, // no domain
+		{ReachID: "400", Footprint: FootprintDomain, Geometry: square(0.5, 0.5)},
+	}
+
+	got := IntersectingReaches(entries, []utils.Geometry{square(0.8, 0.8), square(10, 10)})
+	if want := []string{"100", "400"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IntersectingReaches() = %v, want %v", got, want)
+	}
+}
+
+func TestPointEntries(t *testing.T) {
+	square := utils.Geometry{Type: "Polygon", Rings: [][][2]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}}
+	far := utils.Geometry{Type: "Polygon", Rings: [][][2]float64{{{5, 5}, {6, 5}, {6, 6}, {5, 6}, {5, 5}}}}
+	index := []IndexEntry{
+		{ReachID: "100", Footprint: FootprintDomain, Geometry: square},
+		{ReachID: "200", Footprint: FootprintDomain, Geometry: far},
+		{ReachID: "300", Footprint: FootprintBounds, Geometry: far}, // no domain
+	}
+	entries := []Entry{{ReachID: "100"}, {ReachID: "200"}, {ReachID: "300"}, {ReachID: "400"}, {ReachID: "100", Flow: "20"}}
+
+	got := PointEntries(entries, index, []utils.Point{{Lon: 0.5, Lat: 0.5}, {Lon: 10, Lat: 10}})
+	want := []Entry{{ReachID: "100"}, {ReachID: "300"}, {ReachID: "400"}, {ReachID: "100", Flow: "20"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PointEntries() = %v, want %v", got, want)
+	}
+}
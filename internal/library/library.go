@@ -0,0 +1,367 @@
+package library
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"flows2fim/pkg/utils"
+)
+
+// Policies for FIMs referenced by controls table but not found in library
+const (
+	MissingFail    = "fail"    // return an error listing missing FIMs
+	MissingSkip    = "skip"    // leave the reach out of the composite
+	MissingNearest = "nearest" // use nearest available flow in the same z_ folder
+	MissingNone    = "none"    // no check, gdalbuildvrt decides
+)
+
+// Entry is a single controls table row resolved to a FIM library path
+type Entry struct {
+	ReachID      string
+	Flow         string // flow as written in controls table, also used in file name
+	ControlStage string // control stage with '.' replaced by '_', also used in folder name
+	Path         string
+	DomainPath   string
+	UpperFlow    string  // upper bracketing flow when depth is interpolated, empty otherwise
+	UpperPath    string  // FIM path of upper bracketing flow
+	Weight       float64 // weight of upper FIM, depth is (1 - Weight) * FIM + Weight * upper FIM
+	Priority     float64 // value of optional 'priority' column, higher wins overlaps with precedence priority
+	HasPriority  bool    // whether the controls file has a 'priority' column
+}
+
+// Interpolated reports whether the entry is a blend of two bracketing FIMs
+func (e Entry) Interpolated() bool {
+	return e.UpperPath != "" && e.Weight > 0 && e.Weight < 1
+}
+
+// MissingRecord is a row of the missing FIMs report
+type MissingRecord struct {
+	Entry          Entry
+	Action         string
+	SubstituteFlow string
+}
+
+// Listing caches flows available in z_ folders of a FIM library.
+// It is safe for concurrent use so it can be shared between multiple fim runs.
+type Listing struct {
+	mu      sync.Mutex
+	folders map[string][]int // z_ folder path -> sorted flows of f_*.tif files
+	errs    map[string]error // z_ folder path -> listing error, listed again by the next Load
+}
+
+// NewListing returns an empty listing
+func NewListing() *Listing {
+	return &Listing{folders: make(map[string][]int), errs: make(map[string]error)}
+}
+
+// Load lists all folders not already cached, with at most concurrent listings at a time
+func (l *Listing) Load(folders []string, concurrent int) {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	var toList []string
+	l.mu.Lock()
+	for _, f := range folders {
+		if _, ok := l.folders[f]; !ok && !utils.SliceContains(toList, f) {
+			toList = append(toList, f)
+		}
+	}
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for _, folder := range toList {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(folder string) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+
+			flows, err := listFlows(folder)
+			l.mu.Lock()
+			if err != nil {
+				l.errs[folder] = err
+			} else {
+				l.folders[folder] = flows
+				delete(l.errs, folder)
+			}
+			l.mu.Unlock()
+		}(folder)
+	}
+	wg.Wait()
+	slog.Debug("Listed FIM library folders", "listed_count", len(toList), "cached_count", len(l.folders))
+}
+
+// Flows returns cached flows of a folder, or the error listing it. Load must be called before.
+func (l *Listing) Flows(folder string) ([]int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err, ok := l.errs[folder]; ok {
+		return nil, err
+	}
+	return l.folders[folder], nil
+}
+
+// listFlows returns sorted flows of f_*.tif files in a folder.
+// A local folder that does not exist is empty since the reach or boundary condition may not be in library,
+// gdal_ls lists missing VSI folders as empty. Other errors are returned so a failed listing does not drop FIMs.
+func listFlows(folder string) ([]int, error) {
+	entries, err := utils.ReadDir(folder, false)
+	if err != nil {
+		if _, serr := os.Stat(folder); !strings.HasPrefix(folder, "/vsi") && os.IsNotExist(serr) {
+			slog.Debug("Library folder does not exist", "folder", folder)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var flows []int
+	for _, e := range entries {
+		if e.IsDir {
+			continue
+		}
+		name := filepath.Base(e.Path)
+		if !strings.HasPrefix(name, "f_") || !strings.HasSuffix(name, ".tif") {
+			continue
+		}
+		flow, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "f_"), ".tif"))
+		if err != nil {
+			continue
+		}
+		flows = append(flows, flow)
+	}
+	sort.Ints(flows)
+	return flows, nil
+}
+
+// containsFlow reports whether sorted flows contain flow
+func containsFlow(flows []int, flow int) bool {
+	i := sort.SearchInts(flows, flow)
+	return i < len(flows) && flows[i] == flow
+}
+
+// nearestFlow returns the flow closest to target, ties are resolved to the higher flow.
+// ok is false if flows is empty.
+func nearestFlow(flows []int, target int) (nearest int, ok bool) {
+	if len(flows) == 0 {
+		return 0, false
+	}
+	nearest = flows[0]
+	for _, f := range flows[1:] {
+		if math.Abs(float64(f-target)) <= math.Abs(float64(nearest-target)) {
+			nearest = f
+		}
+	}
+	return nearest, true
+}
+
+// ResolveMissing checks every entry against the library listing and applies the missing policy.
+// It returns the entries to use in the composite and a record for each missing FIM.
+func ResolveMissing(entries []Entry, policy string, listing *Listing, concurrent int) ([]Entry, []MissingRecord, error) {
+	folders := make([]string, 0, len(entries))
+	for _, e := range entries {
+		folders = append(folders, FIMFolder(e.Path))
+	}
+	listing.Load(folders, concurrent)
+
+	var resolved []Entry
+	var report []MissingRecord
+	for _, e := range entries {
+		flow, path, record, ok, err := resolveFlow(e, e.Flow, e.Path, policy, listing)
+		if err != nil {
+			return nil, report, err
+		}
+		if record != nil {
+			report = append(report, *record)
+		}
+		if !ok {
+			continue
+		}
+		e.Flow, e.Path = flow, path
+
+		// A missing upper FIM only affects interpolation, the reach is kept with its lower FIM
+		if e.Interpolated() {
+			upperFlow, upperPath, record, ok, err := resolveFlow(e, e.UpperFlow, e.UpperPath, policy, listing)
+			if err != nil {
+				return nil, report, err
+			}
+			if record != nil {
+				report = append(report, *record)
+			}
+			if ok {
+				e.UpperFlow, e.UpperPath = upperFlow, upperPath
+			} else {
+				e.UpperFlow, e.UpperPath, e.Weight = "", "", 0
+			}
+		}
+		resolved = append(resolved, e)
+	}
+
+	if policy == MissingFail && len(report) > 0 {
+		return nil, report, fmt.Errorf("%d FIMs referenced in controls file are missing from library, first missing: %s", len(report), report[0].Entry.Path)
+	}
+
+	return resolved, report, nil
+}
+
+// resolveFlow checks a single FIM of an entry and applies the missing policy.
+// It returns the flow and path to use, a record if the FIM is missing and false if there is no FIM to use.
+// An error is returned if the folder of the FIM could not be listed.
+func resolveFlow(e Entry, flowStr, path, policy string, listing *Listing) (string, string, *MissingRecord, bool, error) {
+	folder := FIMFolder(path)
+	flows, err := listing.Flows(folder)
+	if err != nil {
+		return "", "", nil, false, fmt.Errorf("error listing library folder of reach %s: %v", e.ReachID, err)
+	}
+	flow, err := strconv.Atoi(flowStr)
+	if err == nil && containsFlow(flows, flow) {
+		return flowStr, path, nil, true, nil
+	}
+
+	missing := e
+	missing.Flow, missing.Path = flowStr, path
+	switch policy {
+	case MissingNearest:
+		nearest, ok := nearestFlow(flows, flow)
+		if !ok {
+			slog.Warn("FIM missing and no substitute available", "reach_id", e.ReachID, "flow", flowStr, "control_stage", e.ControlStage)
+			return "", "", &MissingRecord{Entry: missing, Action: "skipped"}, false, nil
+		}
+		substitute := strconv.Itoa(nearest)
+		slog.Warn("FIM missing, using nearest flow", "reach_id", e.ReachID, "flow", flowStr, "substitute_flow", nearest)
+		return substitute, JoinPath(folder, fmt.Sprintf("f_%d.tif", nearest)), &MissingRecord{Entry: missing, Action: "substituted", SubstituteFlow: substitute}, true, nil
+	case MissingSkip:
+		slog.Warn("FIM missing, skipping", "reach_id", e.ReachID, "flow", flowStr, "control_stage", e.ControlStage)
+		return "", "", &MissingRecord{Entry: missing, Action: "skipped"}, false, nil
+	default:
+		return "", "", &MissingRecord{Entry: missing, Action: "missing"}, false, nil
+	}
+}
+
+// WriteMissingReport writes missing records to a CSV file
+func WriteMissingReport(records []MissingRecord, filePath string) error {
+	rows := [][]string{{"reach_id", "flow", "control_stage", "action", "substitute_flow"}}
+	for _, r := range records {
+		rows = append(rows, []string{
+			r.Entry.ReachID,
+			r.Entry.Flow,
+			strings.ReplaceAll(r.Entry.ControlStage, "_", "."),
+			r.Action,
+			r.SubstituteFlow,
+		})
+	}
+	return utils.WriteCSV(filePath, rows)
+}
+
+// FIMFolder returns the z_ folder of a FIM path, keeping forward slashes for /vsi paths
+func FIMFolder(fimPath string) string {
+	if strings.HasPrefix(fimPath, "/vsi") {
+		return fimPath[:strings.LastIndex(fimPath, "/")]
+	}
+	return filepath.Dir(fimPath)
+}
+
+// JoinPath joins library path elements
+// join on windows may cause \vsi, so /vsi paths are converted back to forward slashes
+func JoinPath(elem ...string) string {
+	p := filepath.Join(elem...)
+	if strings.HasPrefix(p, `\vsi`) {
+		p = strings.ReplaceAll(p, `\`, "/")
+	}
+	return p
+}
+
+// ReadControls reads the controls CSV file and resolves each row to FIM and domain paths in the library
+func ReadControls(controlsFile, absFimLibPath string) ([]Entry, error) {
+	file, err := os.Open(controlsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening controls file: %v", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading CSV file: %v", err)
+	}
+
+	if len(records) < 2 {
+		return nil, fmt.Errorf("no records in control file")
+	}
+
+	// Optional interpolation and priority columns are found by name, the first three columns are always reach_id, flow and control_stage
+	upperCol, weightCol, priorityCol := -1, -1, -1
+	for i, h := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "flow_upper":
+			upperCol = i
+		case "weight":
+			weightCol = i
+		case "priority":
+			priorityCol = i
+		}
+	}
+	if (upperCol == -1) != (weightCol == -1) {
+		return nil, fmt.Errorf("controls file must have both 'flow_upper' and 'weight' columns for interpolation")
+	}
+
+	var entries []Entry
+	for _, record := range records[1:] { // Skip header row
+		if len(record) < 3 {
+			return nil, fmt.Errorf("invalid controls record %v, expected reach_id, flow and control_stage", record)
+		}
+		reachID := record[0]
+		controlStage := strings.Replace(record[2], ".", "_", -1) // Replace '.' with '_'
+		folder := JoinPath(absFimLibPath, reachID, fmt.Sprintf("z_%s", controlStage))
+
+		e := Entry{
+			ReachID:      reachID,
+			Flow:         record[1],
+			ControlStage: controlStage,
+			Path:         JoinPath(folder, fmt.Sprintf("f_%s.tif", record[1])),
+			DomainPath:   JoinPath(absFimLibPath, reachID, "domain.tif"),
+		}
+
+		e.HasPriority = priorityCol != -1
+		if priorityCol != -1 && priorityCol < len(record) && strings.TrimSpace(record[priorityCol]) != "" {
+			if e.Priority, err = strconv.ParseFloat(strings.TrimSpace(record[priorityCol]), 64); err != nil {
+				return nil, fmt.Errorf("invalid priority '%s' for reach %s", record[priorityCol], reachID)
+			}
+		}
+
+		if upperCol != -1 && record[upperCol] != "" && record[weightCol] != "" {
+			weight, err := strconv.ParseFloat(strings.TrimSpace(record[weightCol]), 64)
+			if err != nil || weight < 0 || weight > 1 {
+				return nil, fmt.Errorf("invalid weight '%s' for reach %s, must be between 0 and 1", record[weightCol], reachID)
+			}
+			upperFlow := strings.TrimSpace(record[upperCol])
+			upperPath := JoinPath(folder, fmt.Sprintf("f_%s.tif", upperFlow))
+			if weight == 1 { // upper FIM only, no blend needed
+				e.Flow, e.Path = upperFlow, upperPath
+			} else if weight > 0 {
+				e.UpperFlow, e.UpperPath, e.Weight = upperFlow, upperPath, weight
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// AbsPath returns the absolute path of a local path, GDAL VSI paths are returned as is
+func AbsPath(p string) (string, error) {
+	if strings.HasPrefix(p, "/vsi") {
+		return p, nil
+	}
+	return filepath.Abs(p)
+}
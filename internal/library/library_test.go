@@ -0,0 +1,149 @@
+package library
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNearestFlow(t *testing.T) {
+	tests := []struct {
+		name   string
+		flows  []int
+		target int
+		want   int
+		wantOk bool
+	}{
+		{"empty", []int{}, 100, 0, false},
+		{"below range", []int{200, 300}, 100, 200, true},
+		{"above range", []int{200, 300}, 1000, 300, true},
+		{"closest", []int{100, 180, 300}, 200, 180, true},
+		{"tie resolves to higher flow", []int{100, 300}, 200, 300, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nearestFlow(tt.flows, tt.target)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("nearestFlow() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestResolveMissing(t *testing.T) {
+	libDir := t.TempDir()
+	for _, f := range []string{
+		"100/z_nd/f_50.tif",
+		"100/z_nd/f_150.tif",
+		"200/z_10_5/f_75.tif",
+	} {
+		p := filepath.Join(libDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entry := func(reachID, flow, controlStage string) Entry {
+		return Entry{
+			ReachID:      reachID,
+			Flow:         flow,
+			ControlStage: controlStage,
+			Path:         filepath.Join(libDir, reachID, "z_"+controlStage, "f_"+flow+".tif"),
+		}
+	}
+	entries := []Entry{
+		entry("100", "150", "nd"),
+		entry("100", "140", "nd"),
+		entry("200", "75", "10_5"),
+		entry("300", "10", "nd"),
+	}
+
+	tests := []struct {
+		name        string
+		policy      string
+		wantPaths   []string
+		wantActions []string
+		wantErr     bool
+	}{
+		{"fail", MissingFail, nil, []string{"missing", "missing"}, true},
+		{"skip", MissingSkip, []string{entries[0].Path, entries[2].Path}, []string{"skipped", "skipped"}, false},
+		{"nearest", MissingNearest, []string{entries[0].Path, filepath.Join(libDir, "100", "z_nd", "f_150.tif"), entries[2].Path}, []string{"substituted", "skipped"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, report, err := ResolveMissing(entries, tt.policy, NewListing(), 2)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveMissing() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var gotPaths, gotActions []string
+			for _, e := range resolved {
+				gotPaths = append(gotPaths, e.Path)
+			}
+			for _, r := range report {
+				gotActions = append(gotActions, r.Action)
+			}
+			if !reflect.DeepEqual(gotPaths, tt.wantPaths) {
+				t.Errorf("ResolveMissing() paths = %v, want %v", gotPaths, tt.wantPaths)
+			}
+			if !reflect.DeepEqual(gotActions, tt.wantActions) {
+				t.Errorf("ResolveMissing() actions = %v, want %v", gotActions, tt.wantActions)
+			}
+		})
+	}
+}
+
+func TestResolveMissingListingError(t *testing.T) {
+	libDir := t.TempDir()
+	// z_nd is a file, so listing the folder fails with an error other than not exist
+	if err := os.MkdirAll(filepath.Join(libDir, "100"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(libDir, "100", "z_nd"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{{ReachID: "100", Flow: "50", ControlStage: "nd", Path: filepath.Join(libDir, "100", "z_nd", "f_50.tif")}}
+
+	listing := NewListing()
+	if _, _, err := ResolveMissing(entries, MissingSkip, listing, 1); err == nil {
+		t.Error("ResolveMissing() with unreadable folder: expected error, got reach skipped")
+	}
+
+	// The folder is listed again by the next Load
+	if err := os.Remove(filepath.Join(libDir, "100", "z_nd")); err != nil {
+		t.Fatal(err)
+	}
+	resolved, report, err := ResolveMissing(entries, MissingSkip, listing, 1)
+	if err != nil || len(resolved) != 0 || len(report) != 1 {
+		t.Errorf("ResolveMissing() after folder removed = %v, %v, %v, want reach skipped", resolved, report, err)
+	}
+}
+
+func TestReadControlsInterpolation(t *testing.T) {
+	controls := filepath.Join(t.TempDir(), "controls.csv")
+	data := "reach_id,flow,control_stage,flow_upper,weight\n1,100,nd,200,0.25\n2,100,5.5,200,1\n3,100,nd,,\n"
+	if err := os.WriteFile(controls, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadControls(controls, "/lib")
+	if err != nil {
+		t.Fatalf("ReadControls() error = %v", err)
+	}
+
+	if e := entries[0]; !e.Interpolated() || e.UpperFlow != "200" || e.Weight != 0.25 || e.UpperPath != JoinPath("/lib", "1", "z_nd", "f_200.tif") {
+		t.Errorf("entry with weight 0.25 = %+v, want interpolated with upper flow 200", e)
+	}
+	if e := entries[1]; e.Interpolated() || e.Flow != "200" || e.Path != JoinPath("/lib", "2", "z_5_5", "f_200.tif") {
+		t.Errorf("entry with weight 1 = %+v, want upper flow FIM only", e)
+	}
+	if e := entries[2]; e.Interpolated() || e.Flow != "100" {
+		t.Errorf("entry without upper flow = %+v, want not interpolated", e)
+	}
+}
@@ -0,0 +1,178 @@
+package library
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+
+	_ "modernc.org/sqlite"
+)
+
+// Precedence policies decide which reach wins where FIMs overlap
+const (
+	PrecedenceControls    = "controls"     // later rows of controls file win
+	PrecedenceDownstream  = "downstream"   // downstream reaches win, FIMs are ordered upstream to downstream
+	PrecedenceStreamOrder = "stream_order" // reaches with higher Strahler stream order win
+	PrecedenceDeeper      = "deeper"       // deeper value wins at each pixel
+	PrecedencePriority    = "priority"     // reaches with higher 'priority' column value win
+)
+
+// Precedences lists valid precedence policies
+var Precedences = []string{PrecedenceControls, PrecedenceDownstream, PrecedenceStreamOrder, PrecedenceDeeper, PrecedencePriority}
+
+// NeedsNetwork reports whether a precedence policy needs the reach network
+func NeedsNetwork(policy string) bool {
+	return policy == PrecedenceDownstream || policy == PrecedenceStreamOrder
+}
+
+// Network is the reach network of a reach database, reach_id to updated_to_id
+type Network struct {
+	toID map[string]string
+}
+
+// ReadNetwork reads table 'network' (reach_id, updated_to_id) of a reach database
+func ReadNetwork(dbPath string) (*Network, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("database file does not exist: %s", dbPath)
+	}
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT reach_id, updated_to_id FROM network;")
+	if err != nil {
+		return nil, fmt.Errorf("error reading network table: %v", err)
+	}
+	defer rows.Close()
+
+	n := &Network{toID: map[string]string{}}
+	for rows.Next() {
+		var reachID int64
+		var toID sql.NullInt64
+		if err := rows.Scan(&reachID, &toID); err != nil {
+			return nil, fmt.Errorf("error reading network table: %v", err)
+		}
+		if toID.Valid {
+			n.toID[strconv.FormatInt(reachID, 10)] = strconv.FormatInt(toID.Int64, 10)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading network table: %v", err)
+	}
+
+	slog.Debug("Read reach network", "reaches_count", len(n.toID))
+	return n, nil
+}
+
+// NewNetwork returns a network from a map of reach_id to downstream reach_id
+func NewNetwork(toID map[string]string) *Network {
+	return &Network{toID: toID}
+}
+
+// DownstreamCount returns the number of reaches downstream of a reach until the outlet
+func (n *Network) DownstreamCount(reachID string) int {
+	count := 0
+	seen := map[string]bool{reachID: true}
+	for r, ok := n.toID[reachID]; ok; r, ok = n.toID[r] {
+		if seen[r] { // cycle
+			break
+		}
+		seen[r] = true
+		count++
+	}
+	return count
+}
+
+// StreamOrders returns the Strahler stream order of every reach in the network, headwater reaches are 1
+func (n *Network) StreamOrders() map[string]int {
+	upstream := map[string][]string{}
+	for r, to := range n.toID {
+		upstream[to] = append(upstream[to], r)
+	}
+
+	orders := map[string]int{}
+	var order func(r string, visiting map[string]bool) int
+	order = func(r string, visiting map[string]bool) int {
+		if o, ok := orders[r]; ok {
+			return o
+		}
+		if visiting[r] { // cycle
+			return 1
+		}
+		visiting[r] = true
+
+		highest, count := 0, 0
+		for _, u := range upstream[r] {
+			switch o := order(u, visiting); {
+			case o > highest:
+				highest, count = o, 1
+			case o == highest:
+				count++
+			}
+		}
+		o := highest
+		if highest == 0 {
+			o = 1
+		} else if count > 1 {
+			o = highest + 1
+		}
+		orders[r] = o
+		return o
+	}
+
+	visiting := map[string]bool{}
+	for r := range n.toID {
+		order(r, visiting)
+	}
+	for r := range upstream {
+		order(r, visiting)
+	}
+	return orders
+}
+
+// OrderEntries sorts entries so that later entries win overlaps, the same way as sources of a VRT.
+// Entries with equal rank keep the controls file order. Precedence deeper is not an order and leaves entries as is.
+func OrderEntries(entries []Entry, policy string, network *Network) error {
+	var rank func(e Entry) float64
+	switch policy {
+	case PrecedenceControls, PrecedenceDeeper:
+		return nil
+	case PrecedenceDownstream:
+		if network == nil {
+			return fmt.Errorf("precedence %s needs the reach network", policy)
+		}
+		rank = func(e Entry) float64 { return -float64(network.DownstreamCount(e.ReachID)) }
+	case PrecedenceStreamOrder:
+		if network == nil {
+			return fmt.Errorf("precedence %s needs the reach network", policy)
+		}
+		orders := network.StreamOrders()
+		rank = func(e Entry) float64 { return float64(orders[e.ReachID]) }
+	case PrecedencePriority:
+		if len(entries) > 0 && !entries[0].HasPriority {
+			return fmt.Errorf("precedence %s needs a 'priority' column in the controls file", policy)
+		}
+		rank = func(e Entry) float64 { return e.Priority }
+	default:
+		return fmt.Errorf("invalid precedence '%s'", policy)
+	}
+
+	type ranked struct {
+		entry Entry
+		rank  float64
+	}
+	rs := make([]ranked, len(entries))
+	for i, e := range entries {
+		rs[i] = ranked{e, rank(e)}
+	}
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].rank < rs[j].rank })
+	for i := range rs {
+		entries[i] = rs[i].entry
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testNetwork is 1 and 2 joining into 3, 4 joining 3 into 5, 5 is the outlet
+//
+//	1   2
+//	 \ /
+//	  3   4
+//	   \ /
+//	    5
+func testNetwork() *Network {
+	return NewNetwork(map[string]string{"1": "3", "2": "3", "3": "5", "4": "5"})
+}
+
+func TestStreamOrders(t *testing.T) {
+	want := map[string]int{"1": 1, "2": 1, "3": 2, "4": 1, "5": 2}
+	if got := testNetwork().StreamOrders(); !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamOrders() = %v, want %v", got, want)
+	}
+}
+
+func TestOrderEntries(t *testing.T) {
+	reaches := func(entries []Entry) []string {
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ReachID)
+		}
+		return ids
+	}
+	controls := func() []Entry {
+		// BFS order from the outlet, as written by controls command
+		return []Entry{{ReachID: "5", HasPriority: true}, {ReachID: "3", Priority: 2, HasPriority: true}, {ReachID: "4", Priority: 1, HasPriority: true},
+			{ReachID: "1", HasPriority: true}, {ReachID: "2", HasPriority: true}}
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{PrecedenceControls, []string{"5", "3", "4", "1", "2"}},
+		{PrecedenceDownstream, []string{"1", "2", "3", "4", "5"}},
+		{PrecedenceStreamOrder, []string{"4", "1", "2", "5", "3"}},
+		{PrecedencePriority, []string{"5", "1", "2", "4", "3"}},
+	}
+	for _, tt := range tests {
+		entries := controls()
+		if err := OrderEntries(entries, tt.policy, testNetwork()); err != nil {
+			t.Fatalf("OrderEntries(%s) error = %v", tt.policy, err)
+		}
+		if got := reaches(entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("OrderEntries(%s) = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+
+	if err := OrderEntries(controls(), PrecedenceDownstream, nil); err == nil {
+		t.Errorf("OrderEntries() without network should fail")
+	}
+	if err := OrderEntries([]Entry{{ReachID: "1"}, {ReachID: "2"}}, PrecedencePriority, nil); err == nil {
+		t.Errorf("OrderEntries() without priority column should fail")
+	}
+}
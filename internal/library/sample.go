@@ -0,0 +1,160 @@
+package library
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"flows2fim/pkg/utils"
+)
+
+// Sample is the value at a point and the entry of the FIM that provided it.
+// OK is false if no FIM has a value at the point, Entry is nil when sampling a composite raster.
+type Sample struct {
+	Value float64
+	OK    bool
+	Entry *Entry
+}
+
+// entrySamples holds values of one entry at the points that fall in the bounds of its FIMs, by point index.
+// Points where the entry has no data are left out.
+type entrySamples map[int]float64
+
+// SampleEntries returns the composite value at each point without building the composite.
+// Only FIMs whose bounds contain a point are read, with at most concurrent FIMs read at a time.
+// Precedence is the same as the composite, later entries win over earlier ones. Interpolated entries are blended
+// at each point the same way as the composite, (1 - weight) * lower + weight * upper with dry pixels as 0 depth.
+// A FIM that can not be read is an error, so it is never reported as dry or left to a lower precedence reach.
+func SampleEntries(entries []Entry, points []utils.Point, concurrent int) ([]Sample, error) {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	perEntry := make([]entrySamples, len(entries))
+	errs := make([]error, len(entries))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i, e := range entries {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(i int, e Entry) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+
+			lower, err := sampleFIM(e.Path, points)
+			if err != nil {
+				errs[i] = fmt.Errorf("error sampling FIM of reach %s: %v", e.ReachID, err)
+				return
+			}
+			if !e.Interpolated() {
+				perEntry[i] = lower
+				return
+			}
+			upper, err := sampleFIM(e.UpperPath, points)
+			if err != nil {
+				errs[i] = fmt.Errorf("error sampling upper FIM of reach %s: %v", e.ReachID, err)
+				return
+			}
+			perEntry[i] = blendSamples(lower, upper, e.Weight)
+		}(i, e)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeSamples(entries, perEntry, len(points)), nil
+}
+
+// sampleFIM returns the values of a FIM at the points inside its bounds, points on nodata are left out
+func sampleFIM(path string, points []utils.Point) (entrySamples, error) {
+	info, err := utils.GDALInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	bounds, err := info.WGS84Bounds()
+	if err != nil {
+		return nil, err
+	}
+	noData, hasNoData := info.NoData()
+
+	var pointIdx []int
+	var lonLats [][2]float64
+	for pi, p := range points {
+		if p.Lon >= bounds[0] && p.Lon <= bounds[2] && p.Lat >= bounds[1] && p.Lat <= bounds[3] {
+			pointIdx = append(pointIdx, pi)
+			lonLats = append(lonLats, [2]float64{p.Lon, p.Lat})
+		}
+	}
+	if len(lonLats) == 0 {
+		return nil, nil
+	}
+
+	values, ok, err := utils.LocationValues(path, lonLats)
+	if err != nil {
+		return nil, err
+	}
+	s := entrySamples{}
+	for j, pi := range pointIdx {
+		if ok[j] && !math.IsNaN(values[j]) && !(hasNoData && values[j] == noData) {
+			s[pi] = values[j]
+		}
+	}
+	return s, nil
+}
+
+// blendSamples blends samples of the lower and upper FIMs of an entry as (1 - weight) * lower + weight * upper.
+// Where only one of them has data the other counts as dry (0 depth), points without data in both are left out.
+func blendSamples(lower, upper entrySamples, weight float64) entrySamples {
+	blended := entrySamples{}
+	for pi, l := range lower {
+		blended[pi] = (1 - weight) * math.Max(l, 0)
+	}
+	for pi, u := range upper {
+		blended[pi] += weight * math.Max(u, 0)
+	}
+	return blended
+}
+
+// mergeSamples returns the value at each point from the last entry with data at the point, the same precedence as the composite.
+// perEntry holds the samples of each entry.
+func mergeSamples(entries []Entry, perEntry []entrySamples, nPoints int) []Sample {
+	samples := make([]Sample, nPoints)
+	for i := len(entries) - 1; i >= 0; i-- { // later entries are on top in the composite
+		for pi, v := range perEntry[i] {
+			if !samples[pi].OK {
+				samples[pi] = Sample{Value: v, OK: true, Entry: &entries[i]}
+			}
+		}
+	}
+	return samples
+}
+
+// SampleRaster returns the value of an existing raster, e.g. a composite FIM, at each point
+func SampleRaster(path string, points []utils.Point) ([]Sample, error) {
+	info, err := utils.GDALInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	noData, hasNoData := info.NoData()
+
+	lonLats := make([][2]float64, len(points))
+	for i, p := range points {
+		lonLats[i] = [2]float64{p.Lon, p.Lat}
+	}
+	values, ok, err := utils.LocationValues(path, lonLats)
+	if err != nil {
+		return nil, fmt.Errorf("error sampling %s: %v", path, err)
+	}
+
+	samples := make([]Sample, len(points))
+	for i := range points {
+		if ok[i] && !(hasNoData && values[i] == noData) {
+			samples[i] = Sample{Value: values[i], OK: true}
+		}
+	}
+	return samples, nil
+}
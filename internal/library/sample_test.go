@@ -0,0 +1,52 @@
+package library
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeSamples(t *testing.T) {
+	entries := []Entry{{ReachID: "100"}, {ReachID: "200"}, {ReachID: "300"}, {ReachID: "400"}}
+	perEntry := []entrySamples{
+		{0: 1, 1: 1, 2: 1},
+		{1: 2}, // nodata at point 2
+		nil,    // no point in the FIM bounds
+		{3: 4}, // point 0 outside the raster
+	}
+
+	samples := mergeSamples(entries, perEntry, 5)
+
+	want := []struct {
+		value float64
+		ok    bool
+		reach string
+	}{
+		{1, true, "100"}, // later entry is outside the raster
+		{2, true, "200"}, // later entry wins
+		{1, true, "100"}, // later entry has nodata
+		{4, true, "400"},
+		{0, false, ""}, // no entry covers the point
+	}
+	for i, w := range want {
+		s := samples[i]
+		reach := ""
+		if s.Entry != nil {
+			reach = s.Entry.ReachID
+		}
+		if s.Value != w.value || s.OK != w.ok || reach != w.reach {
+			t.Errorf("point %d = %v, %v, reach %q, want %v, %v, reach %q", i, s.Value, s.OK, reach, w.value, w.ok, w.reach)
+		}
+	}
+}
+
+func TestBlendSamples(t *testing.T) {
+	lower := entrySamples{0: 2, 1: 1, 3: -1}
+	upper := entrySamples{0: 4, 2: 2, 3: 1}
+
+	got := blendSamples(lower, upper, 0.25)
+	// point 1 is dry in the upper FIM and point 2 in the lower FIM, negative depths are dry
+	want := entrySamples{0: 2.5, 1: 0.75, 2: 0.5, 3: 0.25}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("blendSamples() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package library
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"flows2fim/pkg/utils"
+)
+
+// File is a FIM or domain raster found in a FIM library
+type File struct {
+	Path         string // absolute path, or VSI path
+	Rel          string // path relative to the library with forward slashes
+	ReachID      string
+	ControlStage string // z_ folder without prefix, empty for domains
+	Flow         string // f_ file name without prefix and extension, empty for domains
+	Domain       bool
+}
+
+// readDir lists directories, replaced in tests
+var readDir = utils.ReadDir
+
+// Walk lists FIMs (<reach>/z_*/f_*.tif) and domains (<reach>/domain.tif) of a library, with at most concurrent reach folders
+// listed at a time. Other files are ignored. Files are sorted by relative path.
+// Reach folders that can not be listed are logged and returned as reachErrs, so callers can count them as failed reaches.
+func Walk(absFimLibPath string, concurrent int) (files []File, reachErrs []error, err error) {
+	libEntries, err := readDir(absFimLibPath, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading fim library directory: %v", err)
+	}
+
+	var reachDirs []string
+	for _, de := range libEntries {
+		if de.IsDir {
+			reachDirs = append(reachDirs, de.Path)
+		}
+	}
+	if len(reachDirs) == 0 {
+		if strings.HasPrefix(absFimLibPath, "/vsi") {
+			return nil, nil, fmt.Errorf("no entries found in VSI path. Is it a valid FIM library? Does GDAL have access to cloud credentials?")
+		}
+		return nil, nil, fmt.Errorf("no entries found in fim library directory. Not a valid fim library")
+	}
+
+	if concurrent < 1 {
+		concurrent = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	dirErrs := make([]error, len(reachDirs))
+	sem := make(chan struct{}, concurrent)
+	for i, reachDir := range reachDirs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, reachDir string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			reachEntries, err := readDir(reachDir, true)
+			if err != nil {
+				slog.Error("Reach directory read error", "path", reachDir, "error", err)
+				dirErrs[i] = fmt.Errorf("error reading reach directory %s: %v", reachDir, err)
+				return
+			}
+			for _, e := range reachEntries {
+				if e.IsDir {
+					continue
+				}
+				rel, err := filepath.Rel(absFimLibPath, e.Path)
+				if err != nil {
+					continue
+				}
+				if f, ok := ParseLibraryPath(filepath.ToSlash(rel)); ok {
+					f.Path = e.Path
+					mu.Lock()
+					files = append(files, f)
+					mu.Unlock()
+				}
+			}
+		}(i, reachDir)
+	}
+	wg.Wait()
+
+	for _, err := range dirErrs {
+		if err != nil {
+			reachErrs = append(reachErrs, err)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Rel < files[j].Rel })
+	slog.Debug("Walked FIM library", "reach_dir_count", len(reachDirs), "files_count", len(files), "unreadable_count", len(reachErrs))
+	return files, reachErrs, nil
+}
+
+// ParseLibraryPath parses a path relative to the library with forward slashes, ok is false if it is not a FIM or domain
+func ParseLibraryPath(rel string) (f File, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	f.Rel = strings.Join(parts, "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "domain.tif":
+		f.ReachID, f.Domain = parts[0], true
+		return f, true
+	case len(parts) == 3 && strings.HasPrefix(parts[1], "z_") && strings.HasPrefix(parts[2], "f_") && strings.HasSuffix(parts[2], ".tif"):
+		f.ReachID = parts[0]
+		f.ControlStage = strings.TrimPrefix(parts[1], "z_")
+		f.Flow = strings.TrimSuffix(strings.TrimPrefix(parts[2], "f_"), ".tif")
+		return f, f.Flow != "" && f.ControlStage != ""
+	}
+	return File{}, false
+}
@@ -0,0 +1,67 @@
+package library
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"flows2fim/pkg/utils"
+)
+
+func TestWalk(t *testing.T) {
+	libDir := t.TempDir()
+	for _, f := range []string{
+		"100/z_nd/f_50.tif",
+		"100/z_nd/f_50.tif.aux.xml",
+		"100/domain.tif",
+		"200/z_10_5/f_75.tif",
+		"200/notes.txt",
+	} {
+		p := filepath.Join(libDir, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, reachErrs, err := Walk(libDir, 2)
+	if err != nil || len(reachErrs) > 0 {
+		t.Fatalf("Walk() error = %v, reach errors = %v", err, reachErrs)
+	}
+	want := []File{
+		{Path: filepath.Join(libDir, "100", "domain.tif"), Rel: "100/domain.tif", ReachID: "100", Domain: true},
+		{Path: filepath.Join(libDir, "100", "z_nd", "f_50.tif"), Rel: "100/z_nd/f_50.tif", ReachID: "100", ControlStage: "nd", Flow: "50"},
+		{Path: filepath.Join(libDir, "200", "z_10_5", "f_75.tif"), Rel: "200/z_10_5/f_75.tif", ReachID: "200", ControlStage: "10_5", Flow: "75"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Walk() = %+v, want %+v", files, want)
+	}
+
+	if _, _, err := Walk(t.TempDir(), 2); err == nil {
+		t.Errorf("Walk() of empty library should fail")
+	}
+
+	// A reach folder that can not be listed is returned, the other reaches are still listed
+	readDir = func(dir string, recursive bool) ([]utils.DirEntry, error) {
+		if dir == filepath.Join(libDir, "200") {
+			return nil, errors.New("access denied")
+		}
+		return utils.ReadDir(dir, recursive)
+	}
+	defer func() { readDir = utils.ReadDir }()
+	files, reachErrs, err = Walk(libDir, 2)
+	if err != nil {
+		t.Fatalf("Walk() error = %v", err)
+	}
+	if len(reachErrs) != 1 || !strings.Contains(reachErrs[0].Error(), "access denied") {
+		t.Errorf("Walk() reach errors = %v, want the error of reach 200", reachErrs)
+	}
+	if !reflect.DeepEqual(files, want[:2]) {
+		t.Errorf("Walk() = %+v, want %+v", files, want[:2])
+	}
+}
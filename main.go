@@ -6,9 +6,13 @@ import (
 	"os"
 	"time"
 
+	"flows2fim/cmd/compare"
 	"flows2fim/cmd/controls"
 	"flows2fim/cmd/domain"
 	"flows2fim/cmd/fim"
+	"flows2fim/cmd/impact"
+	"flows2fim/cmd/library"
+	"flows2fim/cmd/sample"
 	"flows2fim/cmd/validate"
 	"flows2fim/internal/config"
 
@@ -25,6 +29,10 @@ Available Commands:
   - controls: Given a flow file and a rating curves database, create a control table of reach flows and downstream boundary conditions.
   - fim: Given a control table and a fim library folder, create a flood inundation map for the control conditions.
   - domain: Given a reach_id list (or a control table) and a fim library folder, create a composite domain map for the given reaches.
+  - sample: Given a points file and a control table (or a composite FIM), return depth or extent value and contributing reach_id at each point.
+  - compare: Given two control tables (or two composite FIMs), create depth difference and change class rasters with area summaries.
+  - impact: Given a structures file and a control table (or a composite FIM), find inundated structures, their max depth and counts per reach.
+  - library: Given a FIM library folder, derive related libraries and files e.g. 'library derive-extent' (extent library) and 'library build-domain' (missing domains).
   - validate: Given a fim library folder and a rating curves database, validate there is one to one correspondence between the entries of rating curves table and fim library objects.
 
 Dependencies:
@@ -69,6 +77,14 @@ func run(args []string) (err error) {
 		_, err = fim.Run(args[2:])
 	case "domain":
 		_, err = domain.Run(args[2:])
+	case "sample":
+		err = sample.Run(args[2:])
+	case "compare":
+		err = compare.Run(args[2:])
+	case "impact":
+		err = impact.Run(args[2:])
+	case "library":
+		err = library.Run(args[2:])
 	case "validate":
 		err = validate.Run(args[2:])
 	default:
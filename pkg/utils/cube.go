@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cubeTimeUnits are CF units of the time dimension of cubes
+const cubeTimeUnits = "seconds since 1970-01-01 00:00:00"
+
+// CubeFormat returns the GDAL format of a cube output from its extension, '.nc' for NetCDF and '.zarr' for Zarr
+func CubeFormat(p string) (string, error) {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".nc", ".nc4":
+		return "netCDF", nil
+	case ".zarr":
+		return "Zarr", nil
+	}
+	return "", fmt.Errorf("invalid cube output %s, must end with .nc or .zarr", p)
+}
+
+// CubeRequiredTools returns GDAL tools needed to write a cube to p
+func CubeRequiredTools(p string) []string {
+	if format, _ := CubeFormat(p); format == "Zarr" {
+		return []string{"gdal_translate", "gdalmdimtranslate"}
+	}
+	return []string{"gdal_translate"}
+}
+
+// CubeWriter writes rasters on the same grid as time steps of a NetCDF or Zarr cube with a CF time dimension.
+// Rows of all steps are written together from top to bottom with a RasterWriter that has a band per step, so no step
+// is held in memory. NetCDF is written by gdal_translate from its VRT with netCDF driver dimension metadata,
+// Zarr is converted from that NetCDF by gdalmdimtranslate.
+type CubeWriter struct {
+	Grid     RasterHeader
+	SRSWKT   string
+	Variable string
+	LongName string
+
+	raster *RasterWriter
+}
+
+// NewCubeWriter returns a writer of a cube on grid with the given time steps in ascending order, Cleanup must be called when done
+func NewCubeWriter(grid RasterHeader, srsWKT, variable, longName string, times []time.Time) (*CubeWriter, error) {
+	if len(times) == 0 {
+		return nil, fmt.Errorf("cube has no time steps")
+	}
+	for i := 1; i < len(times); i++ {
+		if !times[i].After(times[i-1]) {
+			return nil, fmt.Errorf("time step %s is not after %s", times[i].Format(time.RFC3339), times[i-1].Format(time.RFC3339))
+		}
+	}
+	var name strings.Builder
+	if err := xml.EscapeText(&name, []byte(longName)); err != nil {
+		return nil, fmt.Errorf("error encoding long name: %v", err)
+	}
+
+	values := make([]string, len(times))
+	bands := make([]rawBand, len(times))
+	for i, t := range times {
+		values[i] = strconv.FormatInt(t.Unix(), 10)
+		bands[i] = float32Band(grid, fmt.Sprintf(`
+    <Metadata>
+      <MDI key="NETCDF_VARNAME">%s</MDI>
+      <MDI key="long_name">%s</MDI>
+      <MDI key="NETCDF_DIM_time">%s</MDI>
+    </Metadata>`, variable, name.String(), values[i]))
+	}
+	raster, err := newRasterWriter(grid, bands)
+	if err != nil {
+		return nil, err
+	}
+	raster.metadata = fmt.Sprintf(`
+  <Metadata>
+    <MDI key="NETCDF_DIM_EXTRA">{time}</MDI>
+    <MDI key="NETCDF_DIM_time_DEF">{%d,6}</MDI>
+    <MDI key="NETCDF_DIM_time_VALUES">{%s}</MDI>
+    <MDI key="time#standard_name">time</MDI>
+    <MDI key="time#long_name">time</MDI>
+    <MDI key="time#units">%s</MDI>
+    <MDI key="time#calendar">standard</MDI>
+    <MDI key="time#axis">T</MDI>
+  </Metadata>`, len(values), strings.Join(values, ","), cubeTimeUnits)
+	return &CubeWriter{Grid: grid, SRSWKT: srsWKT, Variable: variable, LongName: longName, raster: raster}, nil
+}
+
+// WriteRow appends the next row of every time step, in the order of the times of the writer
+func (w *CubeWriter) WriteRow(steps ...[]float32) error {
+	return w.raster.WriteRow(steps...)
+}
+
+// Close writes the cube to dstPath, format is given by extension (see CubeFormat).
+// NetCDF outputs can be GDAL VSI paths, Zarr outputs must be local.
+func (w *CubeWriter) Close(dstPath string) error {
+	format, err := CubeFormat(dstPath)
+	if err != nil {
+		return err
+	}
+	vrtPath, err := w.raster.writeVRT(w.SRSWKT)
+	if err != nil {
+		return err
+	}
+
+	ncArgs := []string{"-q", "-of", "netCDF", "-co", "FORMAT=NC4", "-co", "COMPRESS=DEFLATE", vrtPath}
+	if format == "netCDF" {
+		return WriteStaged(dstPath, func(local string) error {
+			return runGDAL("gdal_translate", append(ncArgs, local)...)
+		})
+	}
+
+	if IsVSI(dstPath) {
+		return fmt.Errorf("cubes in Zarr format can not be written to a VSI path, write .nc instead")
+	}
+	ncPath := filepath.Join(w.raster.tempDir, "cube.nc")
+	if err := runGDAL("gdal_translate", append(ncArgs, ncPath)...); err != nil {
+		return err
+	}
+	if err := removeZarr(dstPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("could not create directories for %s: %v", dstPath, err)
+	}
+	return runGDAL("gdalmdimtranslate", "-q", "-of", "Zarr", ncPath, dstPath)
+}
+
+// Cleanup removes temporary files of the writer
+func (w *CubeWriter) Cleanup() {
+	w.raster.Cleanup()
+}
+
+// removeZarr removes an existing Zarr store at p so it can be overwritten, other existing paths are an error
+func removeZarr(p string) error {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return nil
+	}
+	for _, marker := range []string{".zgroup", "zarr.json"} {
+		if _, err := os.Stat(filepath.Join(p, marker)); err == nil {
+			return os.RemoveAll(p)
+		}
+	}
+	return fmt.Errorf("%s already exists and is not a Zarr store", p)
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCubeWriter(t *testing.T) {
+	grid := RasterHeader{Width: 2, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: -9999, HasNoData: true}
+	t0 := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	if _, err := NewCubeWriter(grid, "", "fim", "", []time.Time{t0, t0}); err == nil {
+		t.Errorf("NewCubeWriter() with repeated time should fail")
+	}
+
+	w, err := NewCubeWriter(grid, "", "fim", "composite flood inundation map", []time.Time{t0, t0.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("NewCubeWriter() error = %v", err)
+	}
+	defer w.Cleanup()
+
+	if err := w.WriteRow([]float32{1, 2}); err == nil {
+		t.Errorf("WriteRow() with a missing step should fail")
+	}
+	if err := w.WriteRow([]float32{1, 2}, []float32{3, -9999}); err != nil {
+		t.Fatalf("WriteRow() error = %v", err)
+	}
+
+	vrt, err := w.raster.vrt(w.SRSWKT)
+	if err != nil {
+		t.Fatalf("vrt() error = %v", err)
+	}
+	for _, want := range []string{
+		`<MDI key="NETCDF_DIM_time_DEF">{2,6}</MDI>`,
+		`<MDI key="NETCDF_DIM_time_VALUES">{1714543200,1714546800}</MDI>`,
+		`<MDI key="NETCDF_DIM_time">1714546800</MDI>`,
+		`<ImageOffset>8</ImageOffset>`,
+		`<LineOffset>16</LineOffset>`,
+		`<NoDataValue>-9999</NoDataValue>`,
+	} {
+		if !strings.Contains(vrt, want) {
+			t.Errorf("vrt() missing %s", want)
+		}
+	}
+}
+
+func TestCubeFormat(t *testing.T) {
+	for p, want := range map[string]string{"out.nc": "netCDF", "/vsis3/b/out.NC": "netCDF", "out.zarr": "Zarr"} {
+		if got, err := CubeFormat(p); err != nil || got != want {
+			t.Errorf("CubeFormat(%q) = %q, %v, want %q", p, got, err, want)
+		}
+	}
+	if _, err := CubeFormat("out.tif"); err == nil {
+		t.Errorf("CubeFormat() of .tif should fail")
+	}
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DirEntry holds a path + info about whether it's a directory
+type DirEntry struct {
+	Path  string
+	IsDir bool
+}
+
+// ReadDir is the wrapper that calls either gatherLocalEntries or gatherVSIEntries
+// to get all paths (files + dirs).
+// If recursive is true, it will recursively list all files and directories.
+func ReadDir(dir string, recursive bool) ([]DirEntry, error) {
+	var allEntries []DirEntry
+	var err error
+
+	if strings.HasPrefix(dir, "/vsi") {
+		allEntries, err = gatherVSIEntries(dir, recursive)
+	} else {
+		allEntries, err = gatherLocalEntries(dir, recursive)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error gathering entries from %s: %v", dir, err)
+	}
+
+	return allEntries, nil
+}
+
+// gatherLocalEntries uses either os.ReadDir (non-recursive) or filepath.WalkDir (recursive)
+func gatherLocalEntries(dir string, recursive bool) ([]DirEntry, error) {
+	if !recursive {
+		// Non-recursive approach: just top-level entries
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var results []DirEntry
+		for _, e := range entries {
+			results = append(results, DirEntry{
+				Path:  filepath.Join(dir, e.Name()),
+				IsDir: e.IsDir(),
+			})
+		}
+		return results, nil
+	}
+
+	// Recursive approach with WalkDir
+	var results []DirEntry
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, werr error) error {
+		if werr != nil {
+			return werr
+		}
+		results = append(results, DirEntry{Path: path, IsDir: d.IsDir()})
+		return nil
+	})
+	return results, err
+}
+
+// gatherVSIEntries calls gdal_ls (with or without -r) to list entries in a VSI path
+func gatherVSIEntries(dir string, recursive bool) ([]DirEntry, error) {
+	var args []string
+	if recursive {
+		args = []string{"-r", dir}
+	} else {
+		args = []string{dir}
+	}
+
+	cmd := exec.Command(GDALLSName, args...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error gathering entries from %s: %v", dir, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Warn("Error reading gdal_ls output", "tool", GDALLSName, "dir", dir, "error", err)
+	}
+
+	var results []DirEntry
+	for _, line := range lines {
+		if line == "" || !strings.HasPrefix(line, "/") { // ignore lines not starting with /
+			continue
+		}
+		isDir := strings.HasSuffix(line, "/")
+		results = append(results, DirEntry{Path: line, IsDir: isDir})
+	}
+	return results, nil
+}
@@ -1,11 +1,16 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -51,3 +56,310 @@ func CreateTempVRT(inputFileListPath, absOutputPath string) (string, error) {
 
 	return tempVRTPath, nil
 }
+
+// RasterInfo is a subset of gdalinfo JSON output
+type RasterInfo struct {
+	Size             [2]int     `json:"size"`
+	GeoTransform     [6]float64 `json:"geoTransform"`
+	CoordinateSystem struct {
+		WKT string `json:"wkt"`
+	} `json:"coordinateSystem"`
+	WGS84Extent *struct {
+		Coordinates [][][2]float64 `json:"coordinates"`
+	} `json:"wgs84Extent"`
+	Bands []struct {
+		Band        int             `json:"band"`
+		Type        string          `json:"type"`
+		NoDataValue json.RawMessage `json:"noDataValue"`
+	} `json:"bands"`
+}
+
+// GDALInfo runs gdalinfo -json on a raster
+func GDALInfo(path string) (*RasterInfo, error) {
+	out, err := exec.Command("gdalinfo", "-json", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running gdalinfo on %s: %v", path, err)
+	}
+
+	var info RasterInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("error parsing gdalinfo output for %s: %v", path, err)
+	}
+	return &info, nil
+}
+
+// NoData returns the nodata value of the first band, ok is false if it has none.
+// gdalinfo writes NaN as a string.
+func (info *RasterInfo) NoData() (value float64, ok bool) {
+	if len(info.Bands) == 0 || len(info.Bands[0].NoDataValue) == 0 {
+		return 0, false
+	}
+	raw := strings.Trim(string(info.Bands[0].NoDataValue), `"`)
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// Header returns the grid and nodata of the first band of the raster
+func (info *RasterInfo) Header() RasterHeader {
+	h := RasterHeader{Width: info.Size[0], Height: info.Size[1], GeoTransform: info.GeoTransform}
+	h.NoData, h.HasNoData = info.NoData()
+	return h
+}
+
+// verticalDatumPattern matches the vertical datum name of WKT2 (VDATUM) and WKT1 (VERT_DATUM) coordinate systems
+var verticalDatumPattern = regexp.MustCompile(`(?:VDATUM|VERT_DATUM)\["([^"]+)"`)
+
+// VerticalDatum returns the name of the vertical datum of a compound coordinate system, or "" if there is none
+func (info *RasterInfo) VerticalDatum() string {
+	if m := verticalDatumPattern.FindStringSubmatch(info.CoordinateSystem.WKT); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// WGS84Bounds returns the longitude/latitude bounding box of the raster as minLon, minLat, maxLon, maxLat
+func (info *RasterInfo) WGS84Bounds() ([4]float64, error) {
+	if info.WGS84Extent == nil || len(info.WGS84Extent.Coordinates) == 0 || len(info.WGS84Extent.Coordinates[0]) == 0 {
+		return [4]float64{}, fmt.Errorf("raster has no WGS84 extent, does it have a coordinate system?")
+	}
+	ring := info.WGS84Extent.Coordinates[0]
+	b := [4]float64{ring[0][0], ring[0][1], ring[0][0], ring[0][1]}
+	for _, c := range ring[1:] {
+		b[0] = math.Min(b[0], c[0])
+		b[1] = math.Min(b[1], c[1])
+		b[2] = math.Max(b[2], c[0])
+		b[3] = math.Max(b[3], c[1])
+	}
+	return b, nil
+}
+
+// WGS84PixelSize returns the approximate pixel size of the raster in degrees
+func (info *RasterInfo) WGS84PixelSize() (float64, error) {
+	b, err := info.WGS84Bounds()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size[0] == 0 || info.Size[1] == 0 {
+		return 0, fmt.Errorf("raster has no pixels")
+	}
+	return math.Min((b[2]-b[0])/float64(info.Size[0]), (b[3]-b[1])/float64(info.Size[1])), nil
+}
+
+// LocationValues returns first band values of a raster at WGS84 longitude/latitude locations using gdallocationinfo.
+// ok is false for locations outside the raster. Nodata values are returned as is.
+func LocationValues(path string, lonLats [][2]float64) (values []float64, ok []bool, err error) {
+	values = make([]float64, len(lonLats))
+	ok = make([]bool, len(lonLats))
+	if len(lonLats) == 0 {
+		return values, ok, nil
+	}
+
+	// Batch mode, coordinates are read from stdin and one line is written per location
+	var input strings.Builder
+	for _, ll := range lonLats {
+		fmt.Fprintf(&input, "%.9f %.9f\n", ll[0], ll[1])
+	}
+	cmd := exec.Command("gdallocationinfo", "-valonly", "-b", "1", "-wgs84", path)
+	cmd.Stdin = strings.NewReader(input.String())
+	out, runErr := cmd.Output()
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+
+	if runErr == nil && len(lines) == len(lonLats) {
+		for i, line := range lines {
+			values[i], ok[i] = parseLocationValue(line)
+		}
+		return values, ok, nil
+	}
+
+	// Some GDAL versions skip lines for locations off the raster, fall back to one call per location
+	slog.Debug("Falling back to gdallocationinfo per location", "path", path, "locations", len(lonLats), "lines", len(lines))
+	for i, ll := range lonLats {
+		out, err := exec.Command("gdallocationinfo", "-valonly", "-b", "1", "-wgs84", path,
+			strconv.FormatFloat(ll[0], 'f', 9, 64), strconv.FormatFloat(ll[1], 'f', 9, 64)).Output()
+		if err != nil {
+			continue // location is off the raster
+		}
+		values[i], ok[i] = parseLocationValue(string(out))
+	}
+	return values, ok, nil
+}
+
+func parseLocationValue(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// TransformToWGS84 transforms coordinates from the coordinate system srsWKT to WGS84 longitude/latitude using gdaltransform
+func TransformToWGS84(coords [][2]float64, srsWKT string) ([][2]float64, error) {
+	lonLats := make([][2]float64, len(coords))
+	if len(coords) == 0 {
+		return lonLats, nil
+	}
+
+	var input strings.Builder
+	for _, c := range coords {
+		fmt.Fprintf(&input, "%.9f %.9f\n", c[0], c[1])
+	}
+	// One "x y z" line is written per coordinate, traditional GIS order keeps longitude first
+	cmd := exec.Command("gdaltransform", "-s_srs", srsWKT, "-t_srs", "EPSG:4326")
+	cmd.Env = append(os.Environ(), "OGR_CT_FORCE_TRADITIONAL_GIS_ORDER=YES")
+	cmd.Stdin = strings.NewReader(input.String())
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running gdaltransform: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	if len(lines) != len(coords) {
+		return nil, fmt.Errorf("gdaltransform returned %d coordinates, expected %d", len(lines), len(coords))
+	}
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid gdaltransform output '%s'", line)
+		}
+		for j := 0; j < 2; j++ {
+			if lonLats[i][j], err = strconv.ParseFloat(fields[j], 64); err != nil {
+				return nil, fmt.Errorf("invalid gdaltransform output '%s'", line)
+			}
+		}
+	}
+	return lonLats, nil
+}
+
+// WarpToGrid resamples a raster (local or VSI) to a grid and coordinate system with gdalwarp and writes it as a GTiff
+func WarpToGrid(srcPath, dstPath string, grid RasterHeader, srsWKT, resampling string) error {
+	args := append([]string{"-q", "-overwrite", "-r", resampling}, gridArgs(grid)...)
+	args = append(args, "-of", "GTiff", "-co", "COMPRESS=LZW")
+	if srsWKT != "" {
+		args = append(args, "-t_srs", srsWKT)
+	}
+	return runGDAL("gdalwarp", append(args, srcPath, dstPath)...)
+}
+
+// gridArgs returns the -te and -ts arguments of gdalwarp and gdal_rasterize for the extent and size of grid
+func gridArgs(grid RasterHeader) []string {
+	gt := grid.GeoTransform
+	minX, maxY := gt[0], gt[3]
+	maxX, minY := gt[0]+float64(grid.Width)*gt[1], gt[3]+float64(grid.Height)*gt[5]
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return []string{"-te", f(minX), f(minY), f(maxX), f(maxY), "-ts", strconv.Itoa(grid.Width), strconv.Itoa(grid.Height)}
+}
+
+// ErrNoFeatures is returned by RasterizeLayer when no feature matches
+var ErrNoFeatures = errors.New("no matching features")
+
+// RasterizeLayer burns a value into the features of a vector layer matching where (an OGR SQL WHERE clause) and writes a Float32 GTiff
+// on grid with the coordinate system srsWKT, like WarpToGrid. Features are reprojected with ogr2ogr first since gdal_rasterize
+// does not reproject. Pixels outside features, and parts of features outside the grid, are noData.
+func RasterizeLayer(srcPath, layer, where, srsWKT string, grid RasterHeader, burn, noData float64, dstPath string) error {
+	tempDir, err := os.MkdirTemp("", "f2f_rasterize_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	features := filepath.Join(tempDir, "features.geojson")
+	if err := runGDAL("ogr2ogr", "-f", "GeoJSON", "-t_srs", srsWKT, "-where", where, features, srcPath, layer); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(features)
+	if err != nil {
+		return fmt.Errorf("error reading reprojected features: %v", err)
+	}
+	var fc struct {
+		Features []json.RawMessage `json:"features"`
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return fmt.Errorf("error parsing reprojected features: %v", err)
+	}
+	if len(fc.Features) == 0 {
+		return ErrNoFeatures
+	}
+
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	args := append([]string{"-q", "-burn", f(burn), "-init", f(noData), "-a_nodata", f(noData)}, gridArgs(grid)...)
+	args = append(args, "-ot", "Float32", "-of", "GTiff", "-co", "COMPRESS=LZW", features, dstPath)
+	return runGDAL("gdal_rasterize", args...)
+}
+
+// Polygonize traces connected pixels with data of the first band of a raster (8-connected) with gdal_polygonize
+// and returns their polygons as rings in the raster coordinate system, outer ring first
+func Polygonize(srcPath string) ([][][][2]float64, error) {
+	tempDir, err := os.MkdirTemp("", "f2f_polygonize_*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dstPath := filepath.Join(tempDir, "polygons.geojson")
+	if err := runGDAL(GDALPolygonizeName, "-q", "-8", srcPath, "-f", "GeoJSON", dstPath); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(dstPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading polygons: %v", err)
+	}
+	var fc struct {
+		Features []struct {
+			Geometry struct {
+				Type        string         `json:"type"`
+				Coordinates [][][2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, fmt.Errorf("error parsing polygons: %v", err)
+	}
+
+	polygons := make([][][][2]float64, 0, len(fc.Features))
+	for _, f := range fc.Features {
+		if f.Geometry.Type == "Polygon" && len(f.Geometry.Coordinates) > 0 {
+			polygons = append(polygons, f.Geometry.Coordinates)
+		}
+	}
+	return polygons, nil
+}
+
+// TranslateVector converts a vector file to an OGR format with ogr2ogr as a MultiPolygon layer named layer.
+// srcSRSWKT is assigned to the source. GeoJSON is written in WGS84 (RFC 7946), other formats keep the source coordinate system.
+// An existing destination is replaced.
+func TranslateVector(srcPath, dstPath, format, srcSRSWKT, layer string) error {
+	if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing existing %s: %v", dstPath, err)
+	}
+	args := []string{"-f", format, "-s_srs", srcSRSWKT, "-nln", layer, "-nlt", "MULTIPOLYGON"}
+	if format == "GeoJSON" {
+		args = append(args, "-lco", "RFC7946=YES")
+	}
+	return runGDAL("ogr2ogr", append(args, dstPath, srcPath)...)
+}
+
+// ReadVector reads a layer of any OGR vector file, local or VSI, as WGS84 features by converting it to GeoJSON with ogr2ogr.
+// An empty layer reads every layer, e.g. the only layer of a FlatGeobuf file.
+func ReadVector(path, layer string) ([]Feature, error) {
+	tempDir, err := os.MkdirTemp("", "f2f_vector_*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dstPath := filepath.Join(tempDir, "features.geojson")
+	args := []string{"-f", "GeoJSON", "-lco", "RFC7946=YES", dstPath, path}
+	if layer != "" {
+		args = append(args, layer)
+	}
+	if err := runGDAL("ogr2ogr", args...); err != nil {
+		return nil, err
+	}
+	return ReadGeoJSON(dstPath)
+}
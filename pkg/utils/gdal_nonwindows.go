@@ -0,0 +1,15 @@
+//go:build !windows
+
+package utils
+
+// GDALLSName is the name of gdal_ls executable, it is a python script on non windows platforms
+var GDALLSName = "gdal_ls.py"
+
+// GDAL2TilesName is the name of gdal2tiles executable, it is a python script on non windows platforms
+var GDAL2TilesName = "gdal2tiles.py"
+
+// GDALCPName is the name of gdal_cp executable, it is a python script on non windows platforms
+var GDALCPName = "gdal_cp.py"
+
+// GDALPolygonizeName is the name of gdal_polygonize executable, it is a python script on non windows platforms
+var GDALPolygonizeName = "gdal_polygonize.py"
@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGridArgs(t *testing.T) {
+	grid := RasterHeader{Width: 4, Height: 2, GeoTransform: [6]float64{100, 3, 0, 50, 0, -3}}
+	want := []string{"-te", "100", "44", "112", "50", "-ts", "4", "2"}
+	if got := gridArgs(grid); !reflect.DeepEqual(got, want) {
+		t.Errorf("gridArgs() = %v, want %v", got, want)
+	}
+}
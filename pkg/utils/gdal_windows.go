@@ -0,0 +1,15 @@
+//go:build windows
+
+package utils
+
+// GDALLSName is the name of gdal_ls executable, it is a bat wrapper on windows
+var GDALLSName = "gdal_ls"
+
+// GDAL2TilesName is the name of gdal2tiles executable, it is a bat wrapper on windows
+var GDAL2TilesName = "gdal2tiles"
+
+// GDALCPName is the name of gdal_cp executable, it is a bat wrapper on windows
+var GDALCPName = "gdal_cp"
+
+// GDALPolygonizeName is the name of gdal_polygonize executable, it is a bat wrapper on windows
+var GDALPolygonizeName = "gdal_polygonize"
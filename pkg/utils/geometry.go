@@ -0,0 +1,129 @@
+package utils
+
+import "math"
+
+// maxGeometrySamples caps the number of sample locations of a single polygon
+const maxGeometrySamples = 10000
+
+// Contains reports whether a location is inside a Polygon or MultiPolygon using the even-odd rule,
+// so holes are outside. It is always false for Points.
+func (g Geometry) Contains(lon, lat float64) bool {
+	if g.Type == "Point" {
+		return false
+	}
+	inside := false
+	for _, ring := range g.Rings {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > lat) != (b[1] > lat) && lon < (b[0]-a[0])*(lat-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// Bounds returns the bounding box of the geometry as minLon, minLat, maxLon, maxLat
+func (g Geometry) Bounds() [4]float64 {
+	first := g.Rings[0][0]
+	b := [4]float64{first[0], first[1], first[0], first[1]}
+	for _, ring := range g.Rings {
+		for _, c := range ring {
+			b[0] = math.Min(b[0], c[0])
+			b[1] = math.Min(b[1], c[1])
+			b[2] = math.Max(b[2], c[0])
+			b[3] = math.Max(b[3], c[1])
+		}
+	}
+	return b
+}
+
+// SampleLocations returns longitude/latitude locations covering the geometry.
+// A Point is its own location. A polygon is sampled at the centers of a grid with spacing step (in degrees),
+// its vertices are added so polygons smaller than a grid cell are still sampled.
+// Spacing is increased if a polygon would need more than maxGeometrySamples locations.
+func (g Geometry) SampleLocations(step float64) [][2]float64 {
+	if g.Type == "Point" {
+		return [][2]float64{g.Rings[0][0]}
+	}
+
+	b := g.Bounds()
+	if step <= 0 {
+		step = math.Max(b[2]-b[0], b[3]-b[1])
+	}
+	if n := ((b[2] - b[0]) / step) * ((b[3] - b[1]) / step); n > maxGeometrySamples {
+		step *= math.Sqrt(n / maxGeometrySamples)
+	}
+
+	var locations [][2]float64
+	for lat := b[1] + step/2; lat < b[3]; lat += step {
+		for lon := b[0] + step/2; lon < b[2]; lon += step {
+			if g.Contains(lon, lat) {
+				locations = append(locations, [2]float64{lon, lat})
+			}
+		}
+	}
+	for _, ring := range g.Rings {
+		locations = append(locations, ring...)
+	}
+	return locations
+}
+
+// Intersects reports whether two Polygon or MultiPolygon geometries overlap or touch. It is always false for Points.
+func (g Geometry) Intersects(o Geometry) bool {
+	if g.Type == "Point" || o.Type == "Point" {
+		return false
+	}
+	a, b := g.Bounds(), o.Bounds()
+	if a[0] > b[2] || b[0] > a[2] || a[1] > b[3] || b[1] > a[3] {
+		return false
+	}
+
+	// One geometry inside the other
+	for _, ring := range g.Rings {
+		if len(ring) > 0 && o.Contains(ring[0][0], ring[0][1]) {
+			return true
+		}
+	}
+	for _, ring := range o.Rings {
+		if len(ring) > 0 && g.Contains(ring[0][0], ring[0][1]) {
+			return true
+		}
+	}
+
+	// Crossing boundaries
+	for _, r := range g.Rings {
+		for i := 1; i < len(r); i++ {
+			for _, s := range o.Rings {
+				for j := 1; j < len(s); j++ {
+					if segmentsIntersect(r[i-1], r[i], s[j-1], s[j]) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// segmentsIntersect reports whether segments p1-p2 and q1-q2 share any point
+func segmentsIntersect(p1, p2, q1, q2 [2]float64) bool {
+	d1, d2 := orientation(q1, q2, p1), orientation(q1, q2, p2)
+	d3, d4 := orientation(p1, p2, q1), orientation(p1, p2, q2)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(q1, q2, p1)) || (d2 == 0 && onSegment(q1, q2, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, q1)) || (d4 == 0 && onSegment(p1, p2, q2))
+}
+
+// orientation is the cross product of b-a and c-a, positive when a, b, c turn counter clockwise
+func orientation(a, b, c [2]float64) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+// onSegment reports whether c, collinear with a and b, lies between them
+func onSegment(a, b, c [2]float64) bool {
+	return math.Min(a[0], b[0]) <= c[0] && c[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= c[1] && c[1] <= math.Max(a[1], b[1])
+}
@@ -0,0 +1,76 @@
+package utils
+
+import "testing"
+
+func TestGeometryContains(t *testing.T) {
+	// 10x10 square with a 2x2 hole in the middle
+	g := Geometry{Type: "Polygon", Rings: [][][2]float64{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}},
+	}}
+
+	tests := []struct {
+		name     string
+		lon, lat float64
+		want     bool
+	}{
+		{"inside", 1, 1, true},
+		{"in hole", 5, 5, false},
+		{"outside", 11, 5, false},
+	}
+	for _, tt := range tests {
+		if got := g.Contains(tt.lon, tt.lat); got != tt.want {
+			t.Errorf("Contains() %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGeometrySampleLocations(t *testing.T) {
+	square := Geometry{Type: "Polygon", Rings: [][][2]float64{{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}}}}
+
+	// 4x4 grid cell centers and 5 ring vertices
+	if got := len(square.SampleLocations(1)); got != 21 {
+		t.Errorf("SampleLocations(1) returned %d locations, want 21", got)
+	}
+
+	// Spacing is increased to stay within maxGeometrySamples
+	if got := len(square.SampleLocations(1e-6)); got > maxGeometrySamples+5 {
+		t.Errorf("SampleLocations(1e-6) returned %d locations, want at most %d", got, maxGeometrySamples+5)
+	}
+
+	point := Geometry{Type: "Point", Rings: [][][2]float64{{{1, 2}}}}
+	if got := point.SampleLocations(1); len(got) != 1 || got[0] != [2]float64{1, 2} {
+		t.Errorf("SampleLocations() of point = %v, want [[1 2]]", got)
+	}
+}
+
+func TestGeometryIntersects(t *testing.T) {
+	square := func(x, y, size float64) Geometry {
+		return Geometry{Type: "Polygon", Rings: [][][2]float64{{{x, y}, {x + size, y}, {x + size, y + size}, {x, y + size}, {x, y}}}}
+	}
+	// 10x10 square with a 4x4 hole in the middle
+	holed := square(0, 0, 10)
+	holed.Rings = append(holed.Rings, square(3, 3, 4).Rings[0])
+	vertical := Geometry{Type: "Polygon", Rings: [][][2]float64{{{4, 0}, {6, 0}, {6, 10}, {4, 10}, {4, 0}}}}
+	horizontal := Geometry{Type: "Polygon", Rings: [][][2]float64{{{0, 4}, {10, 4}, {10, 6}, {0, 6}, {0, 4}}}}
+
+	tests := []struct {
+		name string
+		a, b Geometry
+		want bool
+	}{
+		{"overlap", square(0, 0, 4), square(2, 2, 4), true},
+		{"inside", square(0, 0, 10), square(2, 2, 1), true},
+		{"contains", square(2, 2, 1), square(0, 0, 10), true},
+		{"crossing without vertices inside", vertical, horizontal, true},
+		{"touching", square(0, 0, 2), square(2, 0, 2), true},
+		{"disjoint", square(0, 0, 2), square(5, 5, 2), false},
+		{"in hole", holed, square(4, 4, 1), false},
+		{"point", square(0, 0, 2), Geometry{Type: "Point", Rings: [][][2]float64{{{1, 1}}}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Intersects(tt.b); got != tt.want {
+			t.Errorf("Intersects() %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
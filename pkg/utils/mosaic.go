@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// Mosaic places rasters of the same resolution, aligned to the same grid, on a grid covering all of them.
+// This is the case for FIMs of a library and composites built from a library.
+// Rows of the mosaic are computed one at a time from rows of its rasters, which can be in memory or on disk.
+type Mosaic struct {
+	Grid    RasterHeader
+	Rasters []RasterRows
+	Offsets [][2]int // x, y pixel offset of each raster in the grid
+}
+
+// NewMosaic returns the mosaic of rasters
+func NewMosaic[R RasterRows](rasters []R) (*Mosaic, error) {
+	headers := make([]RasterHeader, len(rasters))
+	for i, r := range rasters {
+		headers[i] = r.Header()
+	}
+	grid, offsets, err := MosaicGrid(headers)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Mosaic{Grid: grid, Rasters: make([]RasterRows, len(rasters)), Offsets: offsets}
+	for i, r := range rasters {
+		m.Rasters[i] = r
+	}
+	return m, nil
+}
+
+// MosaicGrid returns the grid covering rasters of the same resolution with the given headers, without nodata,
+// and the x, y pixel offset of each raster in the grid
+func MosaicGrid(headers []RasterHeader) (RasterHeader, [][2]int, error) {
+	if len(headers) == 0 {
+		return RasterHeader{}, nil, fmt.Errorf("no rasters to mosaic")
+	}
+
+	h0 := headers[0]
+	first := h0.GeoTransform
+	resX, resY := first[1], first[5]
+	minX, maxY := first[0], first[3]
+	maxX, minY := minX+float64(h0.Width)*resX, maxY+float64(h0.Height)*resY
+	for _, h := range headers[1:] {
+		gt := h.GeoTransform
+		if math.Abs(gt[1]-resX) > 1e-9*math.Abs(resX) || math.Abs(gt[5]-resY) > 1e-9*math.Abs(resY) {
+			return RasterHeader{}, nil, fmt.Errorf("all rasters must have the same resolution, found %g x %g and %g x %g", resX, resY, gt[1], gt[5])
+		}
+		minX = math.Min(minX, gt[0])
+		maxY = math.Max(maxY, gt[3])
+		maxX = math.Max(maxX, gt[0]+float64(h.Width)*resX)
+		minY = math.Min(minY, gt[3]+float64(h.Height)*resY)
+	}
+
+	grid := RasterHeader{
+		Width:        int(math.Round((maxX - minX) / resX)),
+		Height:       int(math.Round((minY - maxY) / resY)),
+		GeoTransform: [6]float64{minX, resX, 0, maxY, 0, resY},
+	}
+	offsets := make([][2]int, len(headers))
+	for i, h := range headers {
+		gt := h.GeoTransform
+		offsets[i] = [2]int{
+			int(math.Round((gt[0] - minX) / resX)),
+			int(math.Round((gt[3] - maxY) / resY)),
+		}
+	}
+	return grid, offsets, nil
+}
+
+// OpenMosaic opens rasters with OpenRaster, at most concurrent at a time, and returns their mosaic.
+// Rasters are read from disk one row at a time. Close must be called when done.
+func OpenMosaic(paths []string, concurrent int) (*Mosaic, error) {
+	rasters, err := OpenRasters(paths, concurrent)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMosaic(rasters)
+	if err != nil {
+		for _, r := range rasters {
+			r.Close()
+		}
+		return nil, err
+	}
+	return m, nil
+}
+
+// Close removes temporary files of rasters opened from disk
+func (m *Mosaic) Close() {
+	for _, r := range m.Rasters {
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// NoData returns the nodata value of the first raster, or noData if it has none
+func (m *Mosaic) NoData(noData float64) float64 {
+	if h := m.Rasters[0].Header(); h.HasNoData {
+		return h.NoData
+	}
+	return noData
+}
+
+// NewRaster returns a raster on the mosaic grid with every pixel set to noData
+func (m *Mosaic) NewRaster(noData float64) *Raster {
+	r := &Raster{
+		Width:        m.Grid.Width,
+		Height:       m.Grid.Height,
+		GeoTransform: m.Grid.GeoTransform,
+		NoData:       noData,
+		HasNoData:    true,
+		Data:         make([]float32, m.Grid.Width*m.Grid.Height),
+	}
+	for i := range r.Data {
+		r.Data[i] = float32(noData)
+	}
+	return r
+}
+
+// rasterRow returns row y of the mosaic grid of raster i, nil if the raster does not cover the row
+func (m *Mosaic) rasterRow(i, y int) ([]float32, RasterHeader, error) {
+	r, off := m.Rasters[i], m.Offsets[i]
+	h := r.Header()
+	if y < off[1] || y >= off[1]+h.Height {
+		return nil, h, nil
+	}
+	row, err := r.Row(y - off[1])
+	return row, h, err
+}
+
+// CompositeRow writes row y of the composite of rasters idxs into dst, later rasters win over earlier ones
+// the same way as sources of a VRT. Pixels where none of the rasters have data are left as is.
+// If src is not nil, it receives the index of the raster that provided each pixel.
+func (m *Mosaic) CompositeRow(y int, idxs []int, dst []float32, src []int) error {
+	for _, i := range idxs {
+		row, h, err := m.rasterRow(i, y)
+		if err != nil {
+			return err
+		}
+		off := m.Offsets[i]
+		for x, v := range row {
+			if h.IsNoData(v) {
+				continue
+			}
+			dst[off[0]+x] = v
+			if src != nil {
+				src[off[0]+x] = i
+			}
+		}
+	}
+	return nil
+}
+
+// MaxRow writes row y of the per pixel maximum of rasters idxs into dst, later rasters win ties.
+// src is required and must hold -1 where dst has no value yet, it receives the index of the raster that provided each pixel.
+func (m *Mosaic) MaxRow(y int, idxs []int, dst []float32, src []int) error {
+	for _, i := range idxs {
+		row, h, err := m.rasterRow(i, y)
+		if err != nil {
+			return err
+		}
+		off := m.Offsets[i]
+		for x, v := range row {
+			if h.IsNoData(v) {
+				continue
+			}
+			if src[off[0]+x] == -1 || v >= dst[off[0]+x] {
+				dst[off[0]+x] = v
+				src[off[0]+x] = i
+			}
+		}
+	}
+	return nil
+}
+
+// ReadRasters reads rasters into memory with at most concurrent reads at a time
+func ReadRasters(paths []string, concurrent int) ([]*Raster, error) {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	rasters := make([]*Raster, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+			rasters[i], errs[i] = ReadRaster(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rasters, nil
+}
+
+// OpenRasters opens rasters with OpenRaster with at most concurrent conversions at a time
+func OpenRasters(paths []string, concurrent int) ([]*RasterFile, error) {
+	if concurrent < 1 {
+		concurrent = 1
+	}
+
+	rasters := make([]*RasterFile, len(paths))
+	errs := make([]error, len(paths))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrent)
+	for i, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{} // Acquire concurrency token
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }() // Release token
+			rasters[i], errs[i] = OpenRaster(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			for _, r := range rasters {
+				if r != nil {
+					r.Close()
+				}
+			}
+			return nil, err
+		}
+	}
+	return rasters, nil
+}
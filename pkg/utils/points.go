@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Point is a WGS84 location with an identifier
+type Point struct {
+	ID  string
+	Lon float64
+	Lat float64
+}
+
+var (
+	latColumns = []string{"lat", "latitude", "y"}
+	lonColumns = []string{"lon", "long", "lng", "longitude", "x"}
+	idColumns  = []string{"id", "name", "point_id"}
+)
+
+// ReadPoints reads points from a GeoJSON file (.geojson or .json) or a CSV file with lat and lon columns.
+// CSV column names are case insensitive, an optional id column is used as point ID.
+// Points without an ID get their 1 based position as ID.
+func ReadPoints(path string) ([]Point, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".geojson" || ext == ".json" {
+		features, err := ReadGeoJSON(path)
+		if err != nil {
+			return nil, err
+		}
+		var points []Point
+		for _, f := range features {
+			if f.Geometry.Type != "Point" {
+				return nil, fmt.Errorf("feature %s in %s is a %s, only Point geometries are supported", f.ID, path, f.Geometry.Type)
+			}
+			c := f.Geometry.Rings[0][0]
+			points = append(points, Point{ID: f.ID, Lon: c[0], Lat: c[1]})
+		}
+		return points, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening points file: %v", err)
+	}
+	defer file.Close()
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error reading points file: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("no records in points file")
+	}
+
+	latCol, lonCol, idCol := -1, -1, -1
+	for i, h := range records[0] {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch {
+		case SliceContains(latColumns, h) && latCol == -1:
+			latCol = i
+		case SliceContains(lonColumns, h) && lonCol == -1:
+			lonCol = i
+		case SliceContains(idColumns, h) && idCol == -1:
+			idCol = i
+		}
+	}
+	if latCol == -1 || lonCol == -1 {
+		return nil, fmt.Errorf("points file must have lat and lon columns")
+	}
+
+	var points []Point
+	for i, record := range records[1:] {
+		lat, err := strconv.ParseFloat(strings.TrimSpace(record[latCol]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latitude on line %d: %v", i+2, err)
+		}
+		lon, err := strconv.ParseFloat(strings.TrimSpace(record[lonCol]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid longitude on line %d: %v", i+2, err)
+		}
+		id := strconv.Itoa(i + 1)
+		if idCol != -1 && record[idCol] != "" {
+			id = record[idCol]
+		}
+		points = append(points, Point{ID: id, Lon: lon, Lat: lat})
+	}
+	return points, nil
+}
+
+// Feature is a GeoJSON feature in WGS84 with its geometry flattened to rings of coordinates.
+// A Point has one ring with one coordinate, a Polygon has one ring per boundary and
+// a MultiPolygon has the rings of all its polygons.
+type Feature struct {
+	ID         string
+	Properties map[string]interface{}
+	Geometry   Geometry
+}
+
+// Geometry is a GeoJSON geometry flattened to rings of longitude/latitude coordinates
+type Geometry struct {
+	Type  string
+	Rings [][][2]float64
+}
+
+// ReadGeoJSON reads Point, Polygon and MultiPolygon features of a GeoJSON FeatureCollection
+func ReadGeoJSON(path string) ([]Feature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening GeoJSON file: %v", err)
+	}
+
+	var fc struct {
+		Type     string `json:"type"`
+		Features []struct {
+			ID         interface{}            `json:"id"`
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, fmt.Errorf("error parsing GeoJSON file: %v", err)
+	}
+	if fc.Type != "FeatureCollection" {
+		return nil, fmt.Errorf("GeoJSON file must be a FeatureCollection")
+	}
+
+	var features []Feature
+	for i, f := range fc.Features {
+		feature := Feature{ID: featureID(f.ID, f.Properties, i), Properties: f.Properties}
+		feature.Geometry.Type = f.Geometry.Type
+
+		switch f.Geometry.Type {
+		case "Point":
+			var c [2]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &c)
+			feature.Geometry.Rings = [][][2]float64{{c}}
+		case "Polygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &feature.Geometry.Rings)
+		case "MultiPolygon":
+			var polygons [][][][2]float64
+			err = json.Unmarshal(f.Geometry.Coordinates, &polygons)
+			for _, p := range polygons {
+				feature.Geometry.Rings = append(feature.Geometry.Rings, p...)
+			}
+		default:
+			return nil, fmt.Errorf("feature %s has unsupported geometry type '%s'", feature.ID, f.Geometry.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid coordinates for feature %s: %v", feature.ID, err)
+		}
+		if len(feature.Geometry.Rings) == 0 || len(feature.Geometry.Rings[0]) == 0 {
+			return nil, fmt.Errorf("feature %s has empty geometry", feature.ID)
+		}
+		features = append(features, feature)
+	}
+	return features, nil
+}
+
+// featureID returns the feature id, or the id property, or the 1 based feature position
+func featureID(id interface{}, props map[string]interface{}, i int) string {
+	if id == nil {
+		id = props["id"]
+	}
+	switch v := id.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// WriteGeoJSON writes features as a GeoJSON FeatureCollection. Point, MultiPoint and Polygon geometries are supported,
+// a MultiPoint has one ring with all its points. VSI destinations are uploaded once complete.
+func WriteGeoJSON(path string, features []Feature) error {
+	type geoJSONFeature struct {
+		Type       string                 `json:"type"`
+		ID         string                 `json:"id,omitempty"`
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string      `json:"type"`
+			Coordinates interface{} `json:"coordinates"`
+		} `json:"geometry"`
+	}
+	fc := struct {
+		Type     string           `json:"type"`
+		Features []geoJSONFeature `json:"features"`
+	}{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(features))}
+
+	for _, f := range features {
+		gf := geoJSONFeature{Type: "Feature", ID: f.ID, Properties: f.Properties}
+		gf.Geometry.Type = f.Geometry.Type
+		rings := f.Geometry.Rings
+		if len(rings) == 0 || len(rings[0]) == 0 {
+			return fmt.Errorf("feature %s has empty geometry", f.ID)
+		}
+		switch f.Geometry.Type {
+		case "Point":
+			gf.Geometry.Coordinates = rings[0][0]
+		case "MultiPoint":
+			gf.Geometry.Coordinates = rings[0]
+		case "Polygon":
+			gf.Geometry.Coordinates = rings
+		default:
+			return fmt.Errorf("feature %s has unsupported geometry type '%s'", f.ID, f.Geometry.Type)
+		}
+		fc.Features = append(fc.Features, gf)
+	}
+
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return fmt.Errorf("error encoding GeoJSON: %v", err)
+	}
+
+	return WriteStaged(path, func(local string) error {
+		if err := os.WriteFile(local, data, 0644); err != nil {
+			return fmt.Errorf("error writing GeoJSON file: %v", err)
+		}
+		return nil
+	})
+}
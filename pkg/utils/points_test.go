@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadPoints(t *testing.T) {
+	dir := t.TempDir()
+
+	csvPath := filepath.Join(dir, "points.csv")
+	csvData := "Name,Latitude,Longitude\ngauge_a,35.1,-92.5\n,35.2,-92.6\n"
+	if err := os.WriteFile(csvPath, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	geojsonPath := filepath.Join(dir, "points.geojson")
+	geojsonData := `{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "id": 7, "properties": {}, "geometry": {"type": "Point", "coordinates": [-92.5, 35.1]}},
+		{"type": "Feature", "properties": {"id": "b"}, "geometry": {"type": "Point", "coordinates": [-92.6, 35.2]}}
+	]}`
+	if err := os.WriteFile(geojsonPath, []byte(geojsonData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want []Point
+	}{
+		{"csv", csvPath, []Point{{ID: "gauge_a", Lon: -92.5, Lat: 35.1}, {ID: "2", Lon: -92.6, Lat: 35.2}}},
+		{"geojson", geojsonPath, []Point{{ID: "7", Lon: -92.5, Lat: 35.1}, {ID: "b", Lon: -92.6, Lat: 35.2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadPoints(tt.path)
+			if err != nil {
+				t.Fatalf("ReadPoints() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadPoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "features.geojson")
+	square := [][][2]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}
+	features := []Feature{
+		{ID: "a", Properties: map[string]interface{}{"pixels": 2.0}, Geometry: Geometry{Type: "Polygon", Rings: square}},
+		{ID: "b", Properties: map[string]interface{}{}, Geometry: Geometry{Type: "Point", Rings: [][][2]float64{{{2, 3}}}}},
+	}
+	if err := WriteGeoJSON(path, features); err != nil {
+		t.Fatalf("WriteGeoJSON() error = %v", err)
+	}
+
+	got, err := ReadGeoJSON(path)
+	if err != nil {
+		t.Fatalf("ReadGeoJSON() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, features) {
+		t.Errorf("ReadGeoJSON() = %v, want %v", got, features)
+	}
+
+	multi := []Feature{{ID: "c", Geometry: Geometry{Type: "MultiPolygon", Rings: square}}}
+	if err := WriteGeoJSON(path, multi); err == nil {
+		t.Errorf("WriteGeoJSON() with MultiPolygon should fail")
+	}
+}
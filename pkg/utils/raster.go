@@ -0,0 +1,534 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Raster is the first band of a raster read into memory as Float32
+type Raster struct {
+	Width        int
+	Height       int
+	GeoTransform [6]float64
+	NoData       float64
+	HasNoData    bool
+	Data         []float32 // row major, len is Width * Height
+}
+
+// RasterHeader describes a raster scanned with ScanRaster
+type RasterHeader struct {
+	Width        int
+	Height       int
+	GeoTransform [6]float64
+	NoData       float64
+	HasNoData    bool
+}
+
+// IsNoData reports whether v is nodata, NaN is always treated as nodata
+func (h RasterHeader) IsNoData(v float32) bool {
+	return math.IsNaN(float64(v)) || (h.HasNoData && v == float32(h.NoData))
+}
+
+// PixelArea returns area of a pixel in squared CRS units
+func (h RasterHeader) PixelArea() float64 {
+	return math.Abs(h.GeoTransform[1] * h.GeoTransform[5])
+}
+
+// IsNoData reports whether v is nodata, NaN is always treated as nodata
+func (r *Raster) IsNoData(v float32) bool {
+	return r.Header().IsNoData(v)
+}
+
+// Header returns the raster header
+func (r *Raster) Header() RasterHeader {
+	return RasterHeader{Width: r.Width, Height: r.Height, GeoTransform: r.GeoTransform, NoData: r.NoData, HasNoData: r.HasNoData}
+}
+
+// RasterRows is a raster read one row at a time. Rows of a Raster are in memory, rows of a RasterFile are read from disk.
+type RasterRows interface {
+	Header() RasterHeader
+	// Row returns row y, the values may be overwritten by the next call to Row
+	Row(y int) ([]float32, error)
+}
+
+// Row returns row y of the raster
+func (r *Raster) Row(y int) ([]float32, error) {
+	return r.Data[y*r.Width : (y+1)*r.Width], nil
+}
+
+// toEHdr converts the first band of a GDAL readable raster to a Float32 EHdr file in dir with gdal_translate
+// and returns its header, byte order and path
+func toEHdr(path, dir string, extraArgs []string) (RasterHeader, binary.ByteOrder, string, error) {
+	bilPath := filepath.Join(dir, "raster.bil")
+	args := append([]string{"-q", "-b", "1", "-ot", "Float32", "-of", "EHdr"}, extraArgs...)
+	args = append(args, path, bilPath)
+
+	cmd := exec.Command("gdal_translate", args...)
+	cmd.Stderr = os.Stderr
+	slog.Debug("Reading raster", "command", fmt.Sprintf("gdal_translate %s", strings.Join(args, " ")))
+	if err := cmd.Run(); err != nil {
+		return RasterHeader{}, nil, "", fmt.Errorf("error reading raster %s: %v", path, err)
+	}
+
+	h, byteOrder, err := readEHdrHeader(filepath.Join(dir, "raster.hdr"))
+	if err != nil {
+		return RasterHeader{}, nil, "", fmt.Errorf("error reading raster %s: %v", path, err)
+	}
+	return h, byteOrder, bilPath, nil
+}
+
+// ScanRaster converts the first band of a GDAL readable raster to a temporary EHdr file with gdal_translate
+// and calls fn for each row from top to bottom. Only one row is held in memory at a time.
+// extraArgs are passed to gdal_translate, e.g. '-projwin' to read a window.
+func ScanRaster(path string, fn func(h RasterHeader, row int, values []float32) error, extraArgs ...string) error {
+	tempDir, err := os.MkdirTemp("", "f2f_raster_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	h, byteOrder, bilPath, err := toEHdr(path, tempDir, extraArgs)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(bilPath)
+	if err != nil {
+		return fmt.Errorf("error reading raster %s: %v", path, err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+	buf := make([]byte, h.Width*4)
+	values := make([]float32, h.Width)
+	for row := 0; row < h.Height; row++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("error reading raster %s row %d: %v", path, row, err)
+		}
+		for i := range values {
+			values[i] = math.Float32frombits(byteOrder.Uint32(buf[i*4:]))
+		}
+		if err := fn(h, row, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RasterFile is the first band of a raster converted to a temporary Float32 EHdr file. Rows are read from disk
+// when needed, so only one row is held in memory. The file is opened on the first read and closed once the last row is read,
+// so rasters read from top to bottom hold a file open only while their rows are read. It is not safe for concurrent use.
+type RasterFile struct {
+	header    RasterHeader
+	byteOrder binary.ByteOrder
+	tempDir   string
+	bilPath   string
+
+	file *os.File
+	buf  []byte
+	row  []float32
+	y    int // row held in row, -1 if none
+}
+
+// OpenRaster converts the first band of a raster to a temporary file, see ScanRaster for extraArgs. Close must be called when done.
+func OpenRaster(path string, extraArgs ...string) (*RasterFile, error) {
+	tempDir, err := os.MkdirTemp("", "f2f_raster_*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	h, byteOrder, bilPath, err := toEHdr(path, tempDir, extraArgs)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	return &RasterFile{header: h, byteOrder: byteOrder, tempDir: tempDir, bilPath: bilPath, y: -1}, nil
+}
+
+// Header returns the raster header
+func (r *RasterFile) Header() RasterHeader {
+	return r.header
+}
+
+// Row returns row y, the values are overwritten by the next call to Row
+func (r *RasterFile) Row(y int) ([]float32, error) {
+	if y == r.y {
+		return r.row, nil
+	}
+	if y < 0 || y >= r.header.Height {
+		return nil, fmt.Errorf("row %d is outside of raster with %d rows", y, r.header.Height)
+	}
+	if r.file == nil {
+		f, err := os.Open(r.bilPath)
+		if err != nil {
+			return nil, fmt.Errorf("error opening raster data: %v", err)
+		}
+		r.file = f
+	}
+	if r.buf == nil {
+		r.buf, r.row = make([]byte, r.header.Width*4), make([]float32, r.header.Width)
+	}
+
+	if _, err := r.file.ReadAt(r.buf, int64(y)*int64(len(r.buf))); err != nil {
+		return nil, fmt.Errorf("error reading raster row %d: %v", y, err)
+	}
+	for i := range r.row {
+		r.row[i] = math.Float32frombits(r.byteOrder.Uint32(r.buf[i*4:]))
+	}
+	r.y = y
+
+	if y == r.header.Height-1 {
+		r.file.Close()
+		r.file = nil
+	}
+	return r.row, nil
+}
+
+// Close removes the temporary file
+func (r *RasterFile) Close() error {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return os.RemoveAll(r.tempDir)
+}
+
+// ReadRaster reads the first band of a raster into memory as Float32, see ScanRaster for extraArgs
+func ReadRaster(path string, extraArgs ...string) (*Raster, error) {
+	var r *Raster
+	err := ScanRaster(path, func(h RasterHeader, row int, values []float32) error {
+		if r == nil {
+			r = &Raster{
+				Width:        h.Width,
+				Height:       h.Height,
+				GeoTransform: h.GeoTransform,
+				NoData:       h.NoData,
+				HasNoData:    h.HasNoData,
+				Data:         make([]float32, h.Width*h.Height),
+			}
+		}
+		copy(r.Data[row*h.Width:], values)
+		return nil
+	}, extraArgs...)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("raster %s is empty", path)
+	}
+	return r, nil
+}
+
+// readEHdrHeader parses the .hdr file written by GDAL EHdr driver
+func readEHdrHeader(hdrPath string) (RasterHeader, binary.ByteOrder, error) {
+	var h RasterHeader
+	var byteOrder binary.ByteOrder = binary.LittleEndian
+
+	f, err := os.Open(hdrPath)
+	if err != nil {
+		return h, nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			values[strings.ToUpper(fields[0])] = fields[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return h, nil, err
+	}
+
+	if strings.ToUpper(values["BYTEORDER"]) == "M" {
+		byteOrder = binary.BigEndian
+	}
+
+	parse := func(key string) (float64, error) {
+		v, ok := values[key]
+		if !ok {
+			return 0, fmt.Errorf("%s missing in %s", key, hdrPath)
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+
+	var ncols, nrows, ulx, uly, xdim, ydim float64
+	for key, target := range map[string]*float64{
+		"NCOLS": &ncols, "NROWS": &nrows, "ULXMAP": &ulx, "ULYMAP": &uly, "XDIM": &xdim, "YDIM": &ydim,
+	} {
+		if *target, err = parse(key); err != nil {
+			return h, nil, err
+		}
+	}
+
+	h.Width, h.Height = int(ncols), int(nrows)
+	// ULXMAP and ULYMAP are centre of the upper left pixel
+	h.GeoTransform = [6]float64{ulx - xdim/2, xdim, 0, uly + ydim/2, 0, -ydim}
+
+	if _, ok := values["NODATA"]; ok {
+		if h.NoData, err = parse("NODATA"); err != nil {
+			return h, nil, err
+		}
+		h.HasNoData = true
+	}
+
+	return h, byteOrder, nil
+}
+
+// WriteRaster writes a raster with the given WKT coordinate system to dstPath, as Float32 unless opts sets a data type.
+// Data is written to a temporary raw binary file described by a VRT, which is then converted with Translate.
+// Nodata pixels must already hold the raster nodata value.
+func WriteRaster(r *Raster, srsWKT, dstPath, format string, opts CreationOptions) error {
+	return writeRaster(r, srsWKT, dstPath, format, opts, "")
+}
+
+// WriteRows writes a raster read one row at a time, see WriteRaster. Only one row is held in memory.
+func WriteRows(r RasterRows, srsWKT, dstPath, format string, opts CreationOptions) error {
+	return writeRaster(r, srsWKT, dstPath, format, opts, "")
+}
+
+// writeRaster writes the raster, bandXML is added to the band of the intermediate VRT
+func writeRaster(r RasterRows, srsWKT, dstPath, format string, opts CreationOptions, bandXML string) error {
+	h := r.Header()
+	w, err := newRasterWriter(h, []rawBand{float32Band(h, bandXML)})
+	if err != nil {
+		return err
+	}
+	defer w.Cleanup()
+
+	for y := 0; y < h.Height; y++ {
+		row, err := r.Row(y)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return w.Close(srsWKT, dstPath, format, opts)
+}
+
+// rawBand is a band of the raw binary file of a RasterWriter, every band has 4 byte values
+type rawBand struct {
+	dataType string
+	noData   string // empty for no nodata
+	xml      string // added to the band of the intermediate VRT
+}
+
+// float32Band returns a Float32 band with the nodata of h
+func float32Band(h RasterHeader, bandXML string) rawBand {
+	band := rawBand{dataType: "Float32", xml: bandXML}
+	if h.HasNoData {
+		band.noData = strconv.FormatFloat(h.NoData, 'g', -1, 64)
+	}
+	return band
+}
+
+// RasterWriter writes a raster one row at a time from top to bottom, so a computed raster is never held in memory.
+// Rows of all bands are appended to a temporary raw binary file (band interleaved by line) described by a VRT,
+// which is converted with Translate on Close.
+type RasterWriter struct {
+	Header RasterHeader
+
+	bands    []rawBand
+	dataType string // output data type that replaces the one of the creation options, empty to keep it
+	metadata string // added to the dataset of the intermediate VRT
+	rows     int
+	tempDir  string
+	bin      *os.File
+	w        *bufio.Writer
+	buf      []byte
+}
+
+// NewRasterWriter returns a writer of a Float32 raster on the grid of h with the nodata of h, Cleanup must be called when done
+func NewRasterWriter(h RasterHeader) (*RasterWriter, error) {
+	return newRasterWriter(h, []rawBand{float32Band(h, "")})
+}
+
+// NewClassRasterWriter returns a writer of a raster of classes, written as Byte with a color table and category names.
+// Index of a color or name is the class value, class 0 is nodata. Cleanup must be called when done.
+func NewClassRasterWriter(h RasterHeader, colors []VRTColorEntry, names []string) (*RasterWriter, error) {
+	var band strings.Builder
+	band.WriteString("\n    <ColorInterp>Palette</ColorInterp>\n    <ColorTable>")
+	for _, c := range colors {
+		fmt.Fprintf(&band, "\n      <Entry c1=\"%d\" c2=\"%d\" c3=\"%d\" c4=\"%d\" />", c.C1, c.C2, c.C3, c.C4)
+	}
+	band.WriteString("\n    </ColorTable>\n    <CategoryNames>")
+	for _, n := range names {
+		band.WriteString("\n      <Category>")
+		if err := xml.EscapeText(&band, []byte(n)); err != nil {
+			return nil, fmt.Errorf("error encoding category names: %v", err)
+		}
+		band.WriteString("</Category>")
+	}
+	band.WriteString("\n    </CategoryNames>")
+
+	h.NoData, h.HasNoData = 0, true
+	w, err := newRasterWriter(h, []rawBand{float32Band(h, band.String())})
+	if err != nil {
+		return nil, err
+	}
+	w.dataType = "Byte"
+	return w, nil
+}
+
+// NewInt32RasterWriter returns a writer of Int32 bands on the grid of h, one band per description set as band description.
+// 0 is nodata. Cleanup must be called when done.
+func NewInt32RasterWriter(h RasterHeader, descriptions []string) (*RasterWriter, error) {
+	bands := make([]rawBand, len(descriptions))
+	for b, d := range descriptions {
+		var desc strings.Builder
+		desc.WriteString("\n    <Description>")
+		if err := xml.EscapeText(&desc, []byte(d)); err != nil {
+			return nil, fmt.Errorf("error encoding band description: %v", err)
+		}
+		desc.WriteString("</Description>")
+		bands[b] = rawBand{dataType: "Int32", noData: "0", xml: desc.String()}
+	}
+	return newRasterWriter(h, bands)
+}
+
+// newRasterWriter returns a writer of bands on the grid of h
+func newRasterWriter(h RasterHeader, bands []rawBand) (*RasterWriter, error) {
+	tempDir, err := os.MkdirTemp("", "f2f_raster_*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temp directory: %v", err)
+	}
+	bin, err := os.Create(filepath.Join(tempDir, "raster.bin"))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("error creating raster data file: %v", err)
+	}
+	return &RasterWriter{Header: h, bands: bands, tempDir: tempDir, bin: bin, w: bufio.NewWriterSize(bin, 1<<20), buf: make([]byte, h.Width*4)}, nil
+}
+
+// WriteRow appends the next row of each band of a Float32 raster
+func (w *RasterWriter) WriteRow(bands ...[]float32) error {
+	if w.bands[0].dataType != "Float32" {
+		return fmt.Errorf("raster has %s bands, not Float32", w.bands[0].dataType)
+	}
+	return w.writeRow(len(bands), func(b int) int { return len(bands[b]) }, func(b, x int) uint32 { return math.Float32bits(bands[b][x]) })
+}
+
+// WriteInt32Row appends the next row of each band of an Int32 raster
+func (w *RasterWriter) WriteInt32Row(bands ...[]int32) error {
+	if w.bands[0].dataType != "Int32" {
+		return fmt.Errorf("raster has %s bands, not Int32", w.bands[0].dataType)
+	}
+	return w.writeRow(len(bands), func(b int) int { return len(bands[b]) }, func(b, x int) uint32 { return uint32(bands[b][x]) })
+}
+
+// writeRow appends a row of n bands, size returns the number of values of a band and value a value as 4 bytes
+func (w *RasterWriter) writeRow(n int, size func(b int) int, value func(b, x int) uint32) error {
+	if n != len(w.bands) {
+		return fmt.Errorf("row has %d bands, want %d", n, len(w.bands))
+	}
+	if w.rows == w.Header.Height {
+		return fmt.Errorf("raster has only %d rows", w.Header.Height)
+	}
+	for b := 0; b < n; b++ {
+		if size(b) != w.Header.Width {
+			return fmt.Errorf("row %d of band %d has %d values, want %d", w.rows, b+1, size(b), w.Header.Width)
+		}
+		for x := 0; x < w.Header.Width; x++ {
+			binary.LittleEndian.PutUint32(w.buf[x*4:], value(b, x))
+		}
+		if _, err := w.w.Write(w.buf); err != nil {
+			return fmt.Errorf("error writing raster data: %v", err)
+		}
+	}
+	w.rows++
+	return nil
+}
+
+// Close writes the raster with the given WKT coordinate system to dstPath once all rows are written, see WriteRaster.
+// GDAL VSI destinations are uploaded once complete.
+func (w *RasterWriter) Close(srsWKT, dstPath, format string, opts CreationOptions) error {
+	if format == "VRT" {
+		return fmt.Errorf("computed rasters can not be written as VRT, use COG or GTiff")
+	}
+	if w.dataType != "" {
+		opts.DataType, opts.Scale, opts.NoData = w.dataType, 0, ""
+	}
+	vrtPath, err := w.writeVRT(srsWKT)
+	if err != nil {
+		return err
+	}
+	return WriteStaged(dstPath, func(local string) error {
+		return Translate(vrtPath, local, format, opts)
+	})
+}
+
+// writeVRT completes the raw binary file once all rows are written and returns the path of the VRT describing it
+func (w *RasterWriter) writeVRT(srsWKT string) (string, error) {
+	if w.rows != w.Header.Height {
+		return "", fmt.Errorf("raster has %d of %d rows written", w.rows, w.Header.Height)
+	}
+	if err := w.w.Flush(); err != nil {
+		return "", fmt.Errorf("error writing raster data: %v", err)
+	}
+	if err := w.bin.Close(); err != nil {
+		return "", fmt.Errorf("error writing raster data: %v", err)
+	}
+
+	vrt, err := w.vrt(srsWKT)
+	if err != nil {
+		return "", err
+	}
+	vrtPath := filepath.Join(w.tempDir, "raster.vrt")
+	if err := os.WriteFile(vrtPath, []byte(vrt), 0644); err != nil {
+		return "", fmt.Errorf("error writing raster VRT: %v", err)
+	}
+	return vrtPath, nil
+}
+
+// Cleanup removes temporary files of the writer
+func (w *RasterWriter) Cleanup() {
+	w.bin.Close()
+	os.RemoveAll(w.tempDir)
+}
+
+// vrt returns the VRT describing the raw binary file
+func (w *RasterWriter) vrt(srsWKT string) (string, error) {
+	var wkt strings.Builder
+	if err := xml.EscapeText(&wkt, []byte(srsWKT)); err != nil {
+		return "", fmt.Errorf("error encoding coordinate system: %v", err)
+	}
+	gt := make([]string, 6)
+	for i, v := range w.Header.GeoTransform {
+		gt[i] = fmt.Sprintf("%24.16e", v)
+	}
+
+	var vrt strings.Builder
+	fmt.Fprintf(&vrt, `<VRTDataset rasterXSize="%d" rasterYSize="%d">
+  <SRS>%s</SRS>
+  <GeoTransform>%s</GeoTransform>%s
+`, w.Header.Width, w.Header.Height, wkt.String(), strings.Join(gt, ","), w.metadata)
+	for b, band := range w.bands {
+		noData := ""
+		if band.noData != "" {
+			noData = fmt.Sprintf("\n    <NoDataValue>%s</NoDataValue>", band.noData)
+		}
+		fmt.Fprintf(&vrt, `  <VRTRasterBand dataType="%s" band="%d" subClass="VRTRawRasterBand">%s%s
+    <SourceFilename relativetoVRT="1">raster.bin</SourceFilename>
+    <ImageOffset>%d</ImageOffset>
+    <PixelOffset>4</PixelOffset>
+    <LineOffset>%d</LineOffset>
+    <ByteOrder>LSB</ByteOrder>
+  </VRTRasterBand>
+`, band.dataType, b+1, noData, band.xml, b*w.Header.Width*4, len(w.bands)*w.Header.Width*4)
+	}
+	vrt.WriteString("</VRTDataset>\n")
+	return vrt.String(), nil
+}
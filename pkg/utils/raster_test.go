@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadEHdrHeader(t *testing.T) {
+	hdr := `BYTEORDER      I
+LAYOUT         BIL
+NROWS          1163
+NCOLS          1185
+NBANDS         1
+NBITS          32
+PIXELTYPE      FLOAT
+ULXMAP         -1907133.5
+ULYMAP         3070636.5
+XDIM           3
+YDIM           3
+NODATA         -9999
+`
+	hdrPath := filepath.Join(t.TempDir(), "raster.hdr")
+	if err := os.WriteFile(hdrPath, []byte(hdr), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, byteOrder, err := readEHdrHeader(hdrPath)
+	if err != nil {
+		t.Fatalf("readEHdrHeader() error = %v", err)
+	}
+
+	want := RasterHeader{
+		Width:        1185,
+		Height:       1163,
+		GeoTransform: [6]float64{-1907135, 3, 0, 3070638, 0, -3},
+		NoData:       -9999,
+		HasNoData:    true,
+	}
+	if h != want {
+		t.Errorf("readEHdrHeader() = %+v, want %+v", h, want)
+	}
+	if byteOrder != binary.LittleEndian {
+		t.Errorf("readEHdrHeader() byte order = %v, want little endian", byteOrder)
+	}
+	if h.PixelArea() != 9 {
+		t.Errorf("PixelArea() = %v, want 9", h.PixelArea())
+	}
+	if !h.IsNoData(-9999) || h.IsNoData(0) {
+		t.Errorf("IsNoData() does not match nodata value")
+	}
+}
+
+func TestRasterWriter(t *testing.T) {
+	h := RasterHeader{Width: 2, Height: 2, GeoTransform: [6]float64{0, 1, 0, 2, 0, -1}}
+	w, err := NewInt32RasterWriter(h, []string{"reach_id", "fim_index"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Cleanup()
+
+	if err := w.WriteRow([]float32{1, 2}, []float32{3, 4}); err == nil {
+		t.Errorf("WriteRow() on Int32 bands should fail")
+	}
+	if err := w.WriteInt32Row([]int32{1, 2}); err == nil {
+		t.Errorf("WriteInt32Row() with one band should fail")
+	}
+	for _, row := range [][2][]int32{{{1, 2}, {3, 4}}, {{5, 6}, {7, 8}}} {
+		if err := w.WriteInt32Row(row[0], row[1]); err != nil {
+			t.Fatalf("WriteInt32Row() error = %v", err)
+		}
+	}
+	if err := w.WriteInt32Row([]int32{0, 0}, []int32{0, 0}); err == nil {
+		t.Errorf("WriteInt32Row() past the last row should fail")
+	}
+	if err := w.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(w.tempDir, "raster.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Band interleaved by line: row 0 of both bands, then row 1 of both bands
+	want := []uint32{1, 2, 3, 4, 5, 6, 7, 8}
+	if len(data) != len(want)*4 {
+		t.Fatalf("raster.bin has %d bytes, want %d", len(data), len(want)*4)
+	}
+	for i, v := range want {
+		if got := binary.LittleEndian.Uint32(data[i*4:]); got != v {
+			t.Errorf("raster.bin value %d = %d, want %d", i, got, v)
+		}
+	}
+
+	vrt, err := w.vrt("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"<ImageOffset>8</ImageOffset>", "<LineOffset>16</LineOffset>", "<Description>fim_index</Description>", "<NoDataValue>0</NoDataValue>"} {
+		if !strings.Contains(vrt, s) {
+			t.Errorf("vrt() does not contain %s:\n%s", s, vrt)
+		}
+	}
+}
+
+func TestRasterFileRow(t *testing.T) {
+	dir := t.TempDir()
+	bilPath := filepath.Join(dir, "raster.bil")
+	values := []float32{1, 2, 3, 4, 5, 6}
+	data := make([]byte, len(values)*4)
+	for i, v := range values {
+		binary.BigEndian.PutUint32(data[i*4:], math.Float32bits(v))
+	}
+	if err := os.WriteFile(bilPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &RasterFile{header: RasterHeader{Width: 2, Height: 3}, byteOrder: binary.BigEndian, tempDir: dir, bilPath: bilPath, y: -1}
+	for y := 0; y < 3; y++ {
+		row, err := r.Row(y)
+		if err != nil {
+			t.Fatalf("Row(%d) error = %v", y, err)
+		}
+		if row[0] != values[y*2] || row[1] != values[y*2+1] {
+			t.Errorf("Row(%d) = %v, want %v", y, row, values[y*2:y*2+2])
+		}
+	}
+	if r.file != nil {
+		t.Errorf("file is still open after the last row")
+	}
+	// The last row is kept without reopening the file
+	if row, err := r.Row(2); err != nil || row[0] != 5 || r.file != nil {
+		t.Errorf("Row(2) again = %v, %v", row, err)
+	}
+	if _, err := r.Row(3); err == nil {
+		t.Errorf("Row(3) outside of raster should fail")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Close() did not remove the temp directory")
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Color ramps in gdaldem color-relief format, 'nv' is nodata
+const (
+	// DepthRamp shows 0 (dry, e.g. domain) as grey and depths from light to dark blue
+	DepthRamp = `nv 0 0 0 0
+0 189 189 189 120
+0.001 198 219 239 255
+3 107 174 214 255
+6 33 113 181 255
+10 8 48 107 255
+`
+	// DomainRamp shows every value as grey
+	DomainRamp = `nv 0 0 0 0
+0 189 189 189 160
+`
+)
+
+// webMercatorZ0Resolution is the resolution in metres of zoom level 0 with 256 pixel tiles
+const webMercatorZ0Resolution = 2 * math.Pi * 6378137 / 256
+
+// TileOptions holds settings of XYZ tile outputs
+type TileOptions struct {
+	Zoom    string
+	Ramp    string
+	MinZoom int
+	MaxZoom int
+}
+
+// RegisterFlags adds the tile flags to a command's flag set
+func (o *TileOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Zoom, "zoom", "10-14", "Zoom levels of XYZ output as 'min-max' e.g. '8-14'")
+	flags.StringVar(&o.Ramp, "ramp", "", "Color ramp file for XYZ output in gdaldem color-relief format. Empty uses the default ramp")
+}
+
+// Validate parses the zoom range and checks the ramp file
+func (o *TileOptions) Validate() error {
+	parts := strings.Split(o.Zoom, "-")
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	var err error
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid zoom '%s', must be 'min-max'", o.Zoom)
+	}
+	if o.MinZoom, err = strconv.Atoi(strings.TrimSpace(parts[0])); err != nil {
+		return fmt.Errorf("invalid zoom '%s', must be 'min-max'", o.Zoom)
+	}
+	if o.MaxZoom, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+		return fmt.Errorf("invalid zoom '%s', must be 'min-max'", o.Zoom)
+	}
+	if o.MinZoom < 0 || o.MaxZoom > 24 || o.MinZoom > o.MaxZoom {
+		return fmt.Errorf("invalid zoom '%s', levels must be between 0 and 24 and min must not be greater than max", o.Zoom)
+	}
+
+	if o.Ramp != "" {
+		if _, err := os.Stat(o.Ramp); err != nil {
+			return fmt.Errorf("error opening color ramp file: %v", err)
+		}
+	}
+	return nil
+}
+
+// TileRequiredTools returns GDAL tools needed to write XYZ tiles to dstPath
+func TileRequiredTools(dstPath string) []string {
+	tools := []string{"gdaldem", "gdal_translate"}
+	if isMBTiles(dstPath) {
+		return append(tools, "gdalwarp", "gdaladdo")
+	}
+	return append(tools, GDAL2TilesName)
+}
+
+func isMBTiles(p string) bool {
+	return strings.EqualFold(filepath.Ext(p), ".mbtiles")
+}
+
+// RenderTiles renders the first band of a raster to a Web Mercator PNG tile pyramid.
+// dstPath is an MBTiles file if it has .mbtiles extension, otherwise a directory of XYZ tiles ({z}/{x}/{y}.png).
+// Paletted rasters use their color table, other rasters use opts.Ramp or defaultRamp.
+func RenderTiles(srcPath, dstPath string, opts TileOptions, defaultRamp string, paletted bool) error {
+	if strings.EqualFold(filepath.Ext(dstPath), ".pmtiles") {
+		return fmt.Errorf("PMTiles output is not supported by GDAL, write .mbtiles and convert it with the pmtiles CLI")
+	}
+	if IsVSI(dstPath) {
+		return fmt.Errorf("tiles can not be written to a VSI path")
+	}
+
+	tempDir, err := os.MkdirTemp("", "f2f_tiles_*")
+	if err != nil {
+		return fmt.Errorf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// RGBA VRT of the source
+	rgbaPath := filepath.Join(tempDir, "rgba.vrt")
+	if paletted {
+		err = runGDAL("gdal_translate", "-q", "-of", "VRT", "-expand", "rgba", srcPath, rgbaPath)
+	} else {
+		rampPath := opts.Ramp
+		if rampPath == "" {
+			rampPath = filepath.Join(tempDir, "ramp.txt")
+			if err := os.WriteFile(rampPath, []byte(defaultRamp), 0644); err != nil {
+				return fmt.Errorf("error writing color ramp: %v", err)
+			}
+		}
+		err = runGDAL("gdaldem", "color-relief", "-q", "-alpha", "-of", "VRT", srcPath, rampPath, rgbaPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return fmt.Errorf("could not create directories for %s: %v", dstPath, err)
+	}
+
+	if !isMBTiles(dstPath) {
+		return runGDAL(GDAL2TilesName, "--xyz", "-q", "-w", "none", "-r", "near",
+			"-z", fmt.Sprintf("%d-%d", opts.MinZoom, opts.MaxZoom), rgbaPath, dstPath)
+	}
+
+	// MBTiles driver picks the zoom level closest to the resolution, so the source is warped to max zoom resolution
+	// and lower zoom levels are added as overviews
+	res := strconv.FormatFloat(webMercatorZ0Resolution/math.Pow(2, float64(opts.MaxZoom)), 'f', -1, 64)
+	warpedPath := filepath.Join(tempDir, "warped.vrt")
+	if err := runGDAL("gdalwarp", "-q", "-t_srs", "EPSG:3857", "-tr", res, res, "-r", "near", "-of", "VRT", rgbaPath, warpedPath); err != nil {
+		return err
+	}
+	if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing existing %s: %v", dstPath, err)
+	}
+	if err := runGDAL("gdal_translate", "-q", "-of", "MBTiles", "-co", "TILE_FORMAT=PNG", warpedPath, dstPath); err != nil {
+		return err
+	}
+	if opts.MinZoom == opts.MaxZoom {
+		return nil
+	}
+
+	addoArgs := []string{"-q", "-r", "nearest", dstPath}
+	for z := opts.MaxZoom - 1; z >= opts.MinZoom; z-- {
+		addoArgs = append(addoArgs, strconv.Itoa(1<<(opts.MaxZoom-z)))
+	}
+	return runGDAL("gdaladdo", addoArgs...)
+}
+
+// runGDAL runs a GDAL tool with output sent to stdout and stderr
+func runGDAL(tool string, args ...string) error {
+	cmd := exec.Command(tool, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	slog.Debug("Running GDAL tool", "command", fmt.Sprintf("%s %s", tool, strings.Join(args, " ")))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running %s: %v", tool, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package utils
+
+import "testing"
+
+func TestTileOptionsValidate(t *testing.T) {
+	tests := []struct {
+		zoom    string
+		min     int
+		max     int
+		wantErr bool
+	}{
+		{"8-14", 8, 14, false},
+		{"12", 12, 12, false},
+		{"14-8", 0, 0, true},
+		{"0-25", 0, 0, true},
+		{"a-b", 0, 0, true},
+		{"1-2-3", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.zoom, func(t *testing.T) {
+			o := TileOptions{Zoom: tt.zoom}
+			err := o.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (o.MinZoom != tt.min || o.MaxZoom != tt.max) {
+				t.Errorf("Validate() zoom = %d-%d, want %d-%d", o.MinZoom, o.MaxZoom, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var validCompressions = []string{"NONE", "LZW", "DEFLATE", "ZSTD", "LERC", "LERC_DEFLATE", "LERC_ZSTD", "PACKBITS"}
+
+var validDataTypes = []string{"Byte", "Int8", "UInt16", "Int16", "UInt32", "Int32", "Float32", "Float64"}
+
+// CreationOptions holds user controlled settings used when a VRT is converted to GTiff or COG.
+// Zero values mean the driver default is used, except Compress which defaults to LZW through the flags.
+type CreationOptions struct {
+	Compress           string
+	Predictor          int
+	BlockSize          int
+	DataType           string
+	Scale              float64
+	NoData             string
+	Overviews          bool
+	OverviewResampling string
+	Metadata           []string // KEY=VALUE dataset metadata items, set by commands rather than flags
+}
+
+// RegisterFlags adds the creation option flags to a command's flag set
+func (o *CreationOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Compress, "compress", "LZW", "Compression for GTIFF and COG outputs: 'NONE', 'LZW', 'DEFLATE', 'ZSTD', 'LERC', 'LERC_DEFLATE', 'LERC_ZSTD' or 'PACKBITS'")
+	flags.IntVar(&o.Predictor, "predictor", 0, "Predictor for GTIFF and COG outputs: 1 (none), 2 (horizontal) or 3 (floating point). 0 uses driver default")
+	flags.IntVar(&o.BlockSize, "blocksize", 0, "Tile size in pixels for GTIFF and COG outputs, must be a multiple of 16. 0 uses driver default")
+	flags.StringVar(&o.DataType, "ot", "", "Output data type for GTIFF and COG outputs e.g. 'Int16'. Empty keeps library data type")
+	flags.Float64Var(&o.Scale, "scale", 0, "Multiply values by this factor for GTIFF and COG outputs e.g. 100 with -ot Int16 for centimetres. 0 disables scaling")
+	flags.StringVar(&o.NoData, "nodata", "", "Override nodata value for GTIFF and COG outputs. Must be representable in output data type")
+	flags.BoolVar(&o.Overviews, "overviews", false, "If true, build internal overviews for GTIFF outputs (COG outputs always include overviews)")
+	flags.StringVar(&o.OverviewResampling, "overview_resampling", "", "Resampling method for overviews e.g. 'NEAREST', 'AVERAGE', 'MODE'. Empty uses driver default")
+}
+
+// Validate normalizes and checks the creation options
+func (o *CreationOptions) Validate() error {
+	o.Compress = strings.ToUpper(o.Compress)
+	if o.Compress == "" {
+		o.Compress = "LZW"
+	}
+	if !SliceContains(validCompressions, o.Compress) {
+		return fmt.Errorf("invalid compression '%s', must be one of %s", o.Compress, strings.Join(validCompressions, ", "))
+	}
+
+	if o.Predictor < 0 || o.Predictor > 3 {
+		return fmt.Errorf("invalid predictor %d, must be 1, 2 or 3", o.Predictor)
+	}
+
+	if o.BlockSize < 0 || o.BlockSize%16 != 0 {
+		return fmt.Errorf("invalid block size %d, must be a multiple of 16", o.BlockSize)
+	}
+
+	if o.DataType != "" {
+		found := false
+		for _, dt := range validDataTypes {
+			if strings.EqualFold(dt, o.DataType) {
+				o.DataType = dt // GDAL data type names are case sensitive
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid data type '%s', must be one of %s", o.DataType, strings.Join(validDataTypes, ", "))
+		}
+	}
+
+	if o.Scale < 0 {
+		return fmt.Errorf("invalid scale %g, must be positive", o.Scale)
+	}
+
+	if o.NoData != "" && !strings.EqualFold(o.NoData, "none") {
+		if _, err := strconv.ParseFloat(o.NoData, 64); err != nil {
+			return fmt.Errorf("invalid nodata value '%s'", o.NoData)
+		}
+	}
+
+	o.OverviewResampling = strings.ToUpper(o.OverviewResampling)
+
+	return nil
+}
+
+// TranslateArgs returns the gdal_translate arguments, without input and output paths, for the given output format
+func (o CreationOptions) TranslateArgs(format string) []string {
+	args := []string{
+		"-co", "COMPRESS=" + o.Compress,
+		"-co", "NUM_THREADS=ALL_CPUS",
+	}
+
+	if format == "COG" {
+		switch o.Predictor { // COG driver uses names instead of numbers
+		case 1:
+			args = append(args, "-co", "PREDICTOR=NO")
+		case 2:
+			args = append(args, "-co", "PREDICTOR=STANDARD")
+		case 3:
+			args = append(args, "-co", "PREDICTOR=FLOATING_POINT")
+		}
+		if o.BlockSize > 0 {
+			args = append(args, "-co", fmt.Sprintf("BLOCKSIZE=%d", o.BlockSize))
+		}
+		if o.OverviewResampling != "" {
+			args = append(args, "-co", "OVERVIEW_RESAMPLING="+o.OverviewResampling)
+		}
+	} else {
+		if o.Predictor > 0 {
+			args = append(args, "-co", fmt.Sprintf("PREDICTOR=%d", o.Predictor))
+		}
+		if o.BlockSize > 0 {
+			args = append(args,
+				"-co", "TILED=YES",
+				"-co", fmt.Sprintf("BLOCKXSIZE=%d", o.BlockSize),
+				"-co", fmt.Sprintf("BLOCKYSIZE=%d", o.BlockSize),
+			)
+		}
+	}
+
+	if o.DataType != "" {
+		args = append(args, "-ot", o.DataType)
+	}
+
+	if o.Scale > 0 && o.Scale != 1 {
+		// Linear mapping of 0..1 to 0..scale is same as multiplying by scale
+		args = append(args, "-scale", "0", "1", "0", strconv.FormatFloat(o.Scale, 'f', -1, 64))
+	}
+
+	if o.NoData != "" {
+		args = append(args, "-a_nodata", o.NoData)
+	}
+
+	for _, m := range o.Metadata {
+		args = append(args, "-mo", m)
+	}
+
+	return append(args, "-of", format)
+}
+
+// RequiredTools returns GDAL tools needed to write the given output format with these options
+func (o CreationOptions) RequiredTools(format string) []string {
+	if format == "VRT" {
+		return nil
+	}
+	tools := []string{"gdal_translate"}
+	if o.Overviews && format != "COG" {
+		tools = append(tools, "gdaladdo")
+	}
+	return tools
+}
+
+// Translate converts a source raster (usually a VRT) to the output format using gdal_translate.
+// Overviews are added with gdaladdo for non COG formats if requested.
+func Translate(srcPath, dstPath, format string, opts CreationOptions) error {
+	translateArgs := append(opts.TranslateArgs(format), srcPath, dstPath)
+
+	translateCmd := exec.Command("gdal_translate", translateArgs...)
+	translateCmd.Stdout = os.Stdout
+	translateCmd.Stderr = os.Stderr
+
+	slog.Debug(fmt.Sprintf("Converting VRT to %s", format),
+		"command", fmt.Sprintf("gdal_translate %s", strings.Join(translateArgs, " ")),
+		"format", format,
+	)
+
+	if err := translateCmd.Run(); err != nil {
+		return fmt.Errorf("error converting VRT to %s: %v", format, err)
+	}
+
+	if !opts.Overviews || format == "COG" {
+		return nil
+	}
+
+	addoArgs := []string{"--config", "COMPRESS_OVERVIEW", opts.Compress}
+	if opts.OverviewResampling != "" {
+		addoArgs = append(addoArgs, "-r", strings.ToLower(opts.OverviewResampling))
+	}
+	addoArgs = append(addoArgs, dstPath)
+	addoCmd := exec.Command("gdaladdo", addoArgs...)
+	addoCmd.Stdout = os.Stdout
+	addoCmd.Stderr = os.Stderr
+
+	slog.Debug("Building overviews",
+		"command", fmt.Sprintf("gdaladdo %s", strings.Join(addoArgs, " ")),
+	)
+
+	if err := addoCmd.Run(); err != nil {
+		return fmt.Errorf("error building overviews for %s: %v", dstPath, err)
+	}
+
+	return nil
+}
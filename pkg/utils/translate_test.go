@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreationOptionsTranslateArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   CreationOptions
+		format string
+		want   []string
+	}{
+		{
+			name:   "defaults GTIFF",
+			opts:   CreationOptions{},
+			format: "GTIFF",
+			want:   []string{"-co", "COMPRESS=LZW", "-co", "NUM_THREADS=ALL_CPUS", "-of", "GTIFF"},
+		},
+		{
+			name:   "GTIFF centimetres",
+			opts:   CreationOptions{Compress: "zstd", Predictor: 2, BlockSize: 512, DataType: "int16", Scale: 100, NoData: "-32768"},
+			format: "GTIFF",
+			want: []string{
+				"-co", "COMPRESS=ZSTD", "-co", "NUM_THREADS=ALL_CPUS",
+				"-co", "PREDICTOR=2",
+				"-co", "TILED=YES", "-co", "BLOCKXSIZE=512", "-co", "BLOCKYSIZE=512",
+				"-ot", "Int16",
+				"-scale", "0", "1", "0", "100",
+				"-a_nodata", "-32768",
+				"-of", "GTIFF",
+			},
+		},
+		{
+			name:   "COG predictor and blocksize",
+			opts:   CreationOptions{Compress: "DEFLATE", Predictor: 3, BlockSize: 256, OverviewResampling: "average"},
+			format: "COG",
+			want: []string{
+				"-co", "COMPRESS=DEFLATE", "-co", "NUM_THREADS=ALL_CPUS",
+				"-co", "PREDICTOR=FLOATING_POINT",
+				"-co", "BLOCKSIZE=256",
+				"-co", "OVERVIEW_RESAMPLING=AVERAGE",
+				"-of", "COG",
+			},
+		},
+		{
+			name:   "GTIFF metadata",
+			opts:   CreationOptions{Metadata: []string{"PRODUCT=wse", "VERTICAL_DATUM=NAVD88"}},
+			format: "GTIFF",
+			want: []string{
+				"-co", "COMPRESS=LZW", "-co", "NUM_THREADS=ALL_CPUS",
+				"-mo", "PRODUCT=wse", "-mo", "VERTICAL_DATUM=NAVD88",
+				"-of", "GTIFF",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got := tt.opts.TranslateArgs(tt.format); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TranslateArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreationOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    CreationOptions
+		wantErr bool
+	}{
+		{"valid", CreationOptions{Compress: "lerc", DataType: "float32"}, false},
+		{"unknown compression", CreationOptions{Compress: "RAR"}, true},
+		{"predictor out of range", CreationOptions{Predictor: 4}, true},
+		{"block size not multiple of 16", CreationOptions{BlockSize: 100}, true},
+		{"unknown data type", CreationOptions{DataType: "Float16x"}, true},
+		{"invalid nodata", CreationOptions{NoData: "abc"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VRTDataset is a minimal model of a GDAL VRT file as written by gdalbuildvrt.
+// Elements that are not modelled are kept as is, so a VRT can be read, modified and written back.
+type VRTDataset struct {
+	XMLName      xml.Name        `xml:"VRTDataset"`
+	RasterXSize  int             `xml:"rasterXSize,attr"`
+	RasterYSize  int             `xml:"rasterYSize,attr"`
+	SRS          *VRTSRS         `xml:"SRS"`
+	GeoTransform string          `xml:"GeoTransform,omitempty"`
+	Metadata     []VRTElement    `xml:"Metadata"`
+	Bands        []VRTRasterBand `xml:"VRTRasterBand"`
+	Other        []VRTElement    `xml:",any"`
+}
+
+// VRTSRS is the spatial reference of a VRT dataset
+type VRTSRS struct {
+	DataAxisToSRSAxisMapping string `xml:"dataAxisToSRSAxisMapping,attr,omitempty"`
+	WKT                      string `xml:",chardata"`
+}
+
+// VRTRasterBand is a band of a VRT dataset. All band children that are not modelled are expected to be sources.
+type VRTRasterBand struct {
+	DataType      string            `xml:"dataType,attr"`
+	Band          int               `xml:"band,attr"`
+	SubClass      string            `xml:"subClass,attr,omitempty"`
+	Metadata      []VRTElement      `xml:"Metadata"`
+	NoDataValue   string            `xml:"NoDataValue,omitempty"`
+	UnitType      string            `xml:"UnitType,omitempty"`
+	Offset        string            `xml:"Offset,omitempty"`
+	Scale         string            `xml:"Scale,omitempty"`
+	ColorInterp   string            `xml:"ColorInterp,omitempty"`
+	ColorTable    *VRTColorTable    `xml:"ColorTable"`
+	CategoryNames *VRTCategoryNames `xml:"CategoryNames"`
+	Histograms    *VRTElement       `xml:"Histograms"`
+	Sources       []VRTSource       `xml:",any"`
+}
+
+// VRTColorTable is a palette of a VRT band
+type VRTColorTable struct {
+	Entries []VRTColorEntry `xml:"Entry"`
+}
+
+// VRTColorEntry is a single RGBA palette entry
+type VRTColorEntry struct {
+	C1 int `xml:"c1,attr"`
+	C2 int `xml:"c2,attr"`
+	C3 int `xml:"c3,attr"`
+	C4 int `xml:"c4,attr"`
+}
+
+// VRTCategoryNames holds names of a categorical band, index of name is the pixel value
+type VRTCategoryNames struct {
+	Categories []string `xml:"Category"`
+}
+
+// VRTSource is a SimpleSource or ComplexSource of a VRT band, XMLName holds the source type
+type VRTSource struct {
+	XMLName          xml.Name             `xml:""`
+	Resampling       string               `xml:"resampling,attr,omitempty"`
+	SourceFilename   VRTSourceFilename    `xml:"SourceFilename"`
+	SourceBand       string               `xml:"SourceBand"`
+	SourceProperties *VRTSourceProperties `xml:"SourceProperties"`
+	SrcRect          *VRTRect             `xml:"SrcRect"`
+	DstRect          *VRTRect             `xml:"DstRect"`
+	ScaleOffset      string               `xml:"ScaleOffset,omitempty"`
+	ScaleRatio       string               `xml:"ScaleRatio,omitempty"`
+	LUT              string               `xml:"LUT,omitempty"`
+	NoData           string               `xml:"NODATA,omitempty"`
+	UseMaskBand      string               `xml:"UseMaskBand,omitempty"`
+}
+
+// VRTSourceFilename is the path of a source raster
+type VRTSourceFilename struct {
+	RelativeToVRT string `xml:"relativeToVRT,attr,omitempty"`
+	Shared        string `xml:"shared,attr,omitempty"`
+	Path          string `xml:",chardata"`
+}
+
+// VRTSourceProperties caches properties of a source raster
+type VRTSourceProperties struct {
+	RasterXSize int    `xml:"RasterXSize,attr"`
+	RasterYSize int    `xml:"RasterYSize,attr"`
+	DataType    string `xml:"DataType,attr"`
+	BlockXSize  int    `xml:"BlockXSize,attr,omitempty"`
+	BlockYSize  int    `xml:"BlockYSize,attr,omitempty"`
+}
+
+// VRTRect is a source or destination window in pixels
+type VRTRect struct {
+	XOff  float64 `xml:"xOff,attr"`
+	YOff  float64 `xml:"yOff,attr"`
+	XSize float64 `xml:"xSize,attr"`
+	YSize float64 `xml:"ySize,attr"`
+}
+
+// VRTElement is an element kept verbatim
+type VRTElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+// ReadVRT parses a VRT file
+func ReadVRT(path string) (*VRTDataset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading VRT %s: %v", path, err)
+	}
+
+	var ds VRTDataset
+	if err := xml.Unmarshal(data, &ds); err != nil {
+		return nil, fmt.Errorf("error parsing VRT %s: %v", path, err)
+	}
+	return &ds, nil
+}
+
+// WriteVRT writes a VRT dataset to path, overwriting any existing file
+func WriteVRT(path string, ds *VRTDataset) error {
+	data, err := xml.MarshalIndent(ds, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding VRT: %v", err)
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing VRT %s: %v", path, err)
+	}
+	return nil
+}
+
+// GeoTransformValues parses the six geotransform coefficients of the dataset
+func (ds *VRTDataset) GeoTransformValues() ([6]float64, error) {
+	var gt [6]float64
+	parts := strings.Split(ds.GeoTransform, ",")
+	if len(parts) != 6 {
+		return gt, fmt.Errorf("invalid geotransform '%s'", ds.GeoTransform)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return gt, fmt.Errorf("invalid geotransform '%s': %v", ds.GeoTransform, err)
+		}
+		gt[i] = v
+	}
+	return gt, nil
+}
+
+// SetGeoTransformValues formats geotransform coefficients the same way as GDAL
+func (ds *VRTDataset) SetGeoTransformValues(gt [6]float64) {
+	parts := make([]string, 6)
+	for i, v := range gt {
+		parts[i] = fmt.Sprintf("%24.16e", v)
+	}
+	ds.GeoTransform = strings.Join(parts, ",")
+}
+
+// IsSource reports whether the element is a raster source
+func (s VRTSource) IsSource() bool {
+	switch s.XMLName.Local {
+	case "SimpleSource", "ComplexSource", "AveragedSource", "KernelFilteredSource":
+		return true
+	}
+	return false
+}
+
+// AbsPath returns the absolute path of the source, vrtDir is the folder of the VRT file
+func (s VRTSource) AbsPath(vrtDir string) string {
+	if s.SourceFilename.RelativeToVRT != "1" || strings.HasPrefix(s.SourceFilename.Path, "/vsi") {
+		return s.SourceFilename.Path
+	}
+	return filepath.Join(vrtDir, filepath.FromSlash(s.SourceFilename.Path))
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IsVSI reports whether p is a GDAL virtual file system path e.g. /vsis3/bucket/key
+func IsVSI(p string) bool {
+	return strings.HasPrefix(p, "/vsi")
+}
+
+// OutputStage is where an output is written before it is moved to its destination.
+// Local outputs are written in place. Outputs to GDAL VSI paths are written to a local temporary folder
+// and uploaded once complete, so a partial output is never visible at the destination.
+type OutputStage struct {
+	Path    string // local path to write the output to
+	vsiPath string
+	dir     string
+}
+
+// NewOutputStage returns the stage of an output path, Cleanup must be called when done
+func NewOutputStage(outputPath string) (*OutputStage, error) {
+	if !IsVSI(outputPath) {
+		absPath, err := filepath.Abs(outputPath)
+		if err != nil {
+			return nil, fmt.Errorf("error getting absolute path for output file: %v", err)
+		}
+		return &OutputStage{Path: absPath}, nil
+	}
+
+	dir, err := os.MkdirTemp("", "f2f_stage_*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %v", err)
+	}
+	return &OutputStage{Path: filepath.Join(dir, path.Base(outputPath)), vsiPath: outputPath, dir: dir}, nil
+}
+
+// IsVSI reports whether the output destination is a GDAL VSI path
+func (s *OutputStage) IsVSI() bool {
+	return s.vsiPath != ""
+}
+
+// Commit uploads a staged output to its VSI destination and returns the final output path.
+// Sources of staged VRTs are made absolute first, as relative paths would point into the staging folder.
+func (s *OutputStage) Commit() (string, error) {
+	if !s.IsVSI() {
+		return s.Path, nil
+	}
+
+	if strings.EqualFold(filepath.Ext(s.Path), ".vrt") {
+		if err := AbsoluteVRTSources(s.Path); err != nil {
+			return "", err
+		}
+	}
+	if err := runGDAL(GDALCPName, s.Path, s.vsiPath); err != nil {
+		return "", fmt.Errorf("error uploading %s: %v", s.vsiPath, err)
+	}
+	return s.vsiPath, nil
+}
+
+// Cleanup removes the staging folder of VSI outputs
+func (s *OutputStage) Cleanup() {
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// WriteStaged writes an output through its stage. write is called with the local path to write to, once its folder exists.
+// Outputs to VSI paths are uploaded once write succeeds.
+func WriteStaged(dst string, write func(local string) error) error {
+	stage, err := NewOutputStage(dst)
+	if err != nil {
+		return err
+	}
+	defer stage.Cleanup()
+
+	if err := os.MkdirAll(filepath.Dir(stage.Path), 0755); err != nil {
+		return fmt.Errorf("could not create directories for %s: %v", dst, err)
+	}
+	if err := write(stage.Path); err != nil {
+		return err
+	}
+	_, err = stage.Commit()
+	return err
+}
+
+// WriteCSV writes records to a CSV file through its stage
+func WriteCSV(dst string, records [][]string) error {
+	return WriteStaged(dst, func(local string) error {
+		file, err := os.Create(local)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := csv.NewWriter(file).WriteAll(records); err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// AbsoluteVRTSources rewrites sources of a VRT file that are relative to the VRT as absolute paths
+func AbsoluteVRTSources(vrtPath string) error {
+	ds, err := ReadVRT(vrtPath)
+	if err != nil {
+		return err
+	}
+
+	vrtDir := filepath.Dir(vrtPath)
+	for b := range ds.Bands {
+		for i := range ds.Bands[b].Sources {
+			src := &ds.Bands[b].Sources[i]
+			if !src.IsSource() || src.SourceFilename.RelativeToVRT != "1" {
+				continue
+			}
+			src.SourceFilename.Path = src.AbsPath(vrtDir)
+			src.SourceFilename.RelativeToVRT = "0"
+		}
+	}
+	return WriteVRT(vrtPath, ds)
+}
+
+// CopyFile copies a file to a local path, files on GDAL VSI paths are fetched with gdal_cp
+func CopyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("could not create directories for %s: %v", dst, err)
+	}
+	if IsVSI(src) {
+		return runGDAL(GDALCPName, src, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error copying %s: %v", src, err)
+	}
+	return out.Close()
+}
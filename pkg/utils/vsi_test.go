@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAbsoluteVRTSources(t *testing.T) {
+	dir := t.TempDir()
+	vrtPath := filepath.Join(dir, "out.vrt")
+	vrt := `<VRTDataset rasterXSize="1" rasterYSize="1">
+  <VRTRasterBand dataType="Float32" band="1">
+    <ComplexSource>
+      <SourceFilename relativeToVRT="1">lib/1/z_nd/f_100.tif</SourceFilename>
+      <SourceBand>1</SourceBand>
+    </ComplexSource>
+    <ComplexSource>
+      <SourceFilename relativeToVRT="0">/vsis3/bucket/lib/2/z_nd/f_200.tif</SourceFilename>
+      <SourceBand>1</SourceBand>
+    </ComplexSource>
+  </VRTRasterBand>
+</VRTDataset>
+`
+	if err := os.WriteFile(vrtPath, []byte(vrt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AbsoluteVRTSources(vrtPath); err != nil {
+		t.Fatalf("AbsoluteVRTSources() error = %v", err)
+	}
+
+	ds, err := ReadVRT(vrtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "lib", "1", "z_nd", "f_100.tif"), "/vsis3/bucket/lib/2/z_nd/f_200.tif"}
+	for i, src := range ds.Bands[0].Sources {
+		if src.SourceFilename.Path != want[i] || src.SourceFilename.RelativeToVRT != "0" {
+			t.Errorf("source %d = %+v, want absolute path %s", i, src.SourceFilename, want[i])
+		}
+	}
+}
+
+func TestNewOutputStage(t *testing.T) {
+	stage, err := NewOutputStage("/vsis3/bucket/outputs/fim.tif")
+	if err != nil {
+		t.Fatalf("NewOutputStage() error = %v", err)
+	}
+	defer stage.Cleanup()
+
+	if !stage.IsVSI() || filepath.Base(stage.Path) != "fim.tif" || IsVSI(stage.Path) {
+		t.Errorf("NewOutputStage() path = %s, want local staging path of fim.tif", stage.Path)
+	}
+	stage.Cleanup()
+	if _, err := os.Stat(filepath.Dir(stage.Path)); !os.IsNotExist(err) {
+		t.Errorf("Cleanup() did not remove staging folder")
+	}
+
+	local, err := NewOutputStage("fim.tif")
+	if err != nil {
+		t.Fatalf("NewOutputStage() error = %v", err)
+	}
+	if local.IsVSI() || !filepath.IsAbs(local.Path) {
+		t.Errorf("NewOutputStage() local path = %s, want absolute path", local.Path)
+	}
+}
+
+func TestWriteStaged(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "outputs", "summary.csv")
+	if err := WriteStaged(dst, func(local string) error {
+		if local != dst {
+			t.Errorf("WriteStaged() local path = %s, want %s", local, dst)
+		}
+		return os.WriteFile(local, []byte("a\n"), 0644)
+	}); err != nil {
+		t.Fatalf("WriteStaged() error = %v", err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "a\n" {
+		t.Errorf("WriteStaged() output = %q, %v, want %q", data, err, "a\n")
+	}
+
+	if err := WriteStaged(dst, func(string) error { return os.ErrInvalid }); err != os.ErrInvalid {
+		t.Errorf("WriteStaged() error = %v, want error of write", err)
+	}
+}
+
+// TestWriteRasterVSI uploads a raster to an S3 compatible store such as MinIO (see docker-compose.yml).
+// It runs only when F2F_TEST_VSI_PREFIX is set e.g. /vsis3/f2f-test, with GDAL configured to reach the store.
+func TestWriteRasterVSI(t *testing.T) {
+	prefix := os.Getenv("F2F_TEST_VSI_PREFIX")
+	if prefix == "" {
+		t.Skip("F2F_TEST_VSI_PREFIX not set")
+	}
+	for _, tool := range []string{"gdal_translate", "gdalinfo", GDALCPName} {
+		if !CheckGDALToolAvailable(tool) {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	r := &Raster{Width: 2, Height: 1, GeoTransform: [6]float64{0, 1, 0, 1, 0, -1}, NoData: -9999, HasNoData: true, Data: []float32{1, -9999}}
+	dst := strings.TrimSuffix(prefix, "/") + "/write_raster_test.tif"
+	if err := WriteRaster(r, "", dst, "COG", CreationOptions{}); err != nil {
+		t.Fatalf("WriteRaster() error = %v", err)
+	}
+
+	info, err := GDALInfo(dst)
+	if err != nil {
+		t.Fatalf("GDALInfo() of uploaded raster error = %v", err)
+	}
+	if info.Size != [2]int{2, 1} {
+		t.Errorf("uploaded raster size = %v, want [2 1]", info.Size)
+	}
+}